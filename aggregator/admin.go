@@ -0,0 +1,425 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminStore holds the pause, exclusion and maintenance window state
+// managed through the admin API (and SIGUSR1). Every change is written to
+// disk, so that the state survives an aggregator restart.
+type adminStore struct {
+	sync.RWMutex
+	path  string
+	state types.AdminState
+
+	// windows are the compiled maintenance windows of the state, updated
+	// whenever they change.
+	windows []*maintenanceWindow
+}
+
+var adminToken string
+
+// loadAdminStore reads the admin state from path, if it exists.
+func loadAdminStore(path string) (*adminStore, error) {
+	a := &adminStore{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return a, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &a.state); err != nil {
+		return nil, fmt.Errorf("error in reading admin state %s: %v", path, err)
+	}
+	a.compileWindows()
+	a.updateMetrics()
+	return a, nil
+}
+
+// save writes the admin state to disk. Caller must hold the lock.
+func (a *adminStore) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(a.state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// updateMetrics exports the pause and exclusion state. Caller must hold the lock.
+func (a *adminStore) updateMetrics() {
+	aggregatorPausedGauge.Reset()
+	aggregatorPausedGauge.With(prometheus.Labels{"scope": "global"}).Set(boolToFloat(a.state.Paused))
+	for _, dc := range a.state.PausedDatacenters {
+		aggregatorPausedGauge.With(prometheus.Labels{"scope": dc}).Set(1)
+	}
+
+	counts := map[string]int{"node": 0, "check": 0, "node_check": 0}
+	for _, e := range a.state.Exclusions {
+		counts[exclusionKind(e)]++
+	}
+	for kind, count := range counts {
+		exclusionsGauge.With(prometheus.Labels{"type": kind}).Set(float64(count))
+	}
+}
+
+// isPaused returns true if the aggregator is paused globally, or for the
+// given datacenter. Pass an empty datacenter to only check the global pause.
+func (a *adminStore) isPaused(datacenter string) bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	if a.state.Paused {
+		return true
+	}
+
+	for _, dc := range a.state.PausedDatacenters {
+		if dc == datacenter {
+			return true
+		}
+	}
+	return false
+}
+
+// setPaused pauses or resumes the aggregator globally, or for a single datacenter.
+func (a *adminStore) setPaused(datacenter string, paused bool) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if datacenter == "" {
+		a.state.Paused = paused
+	} else {
+		dcs := []string{}
+		for _, dc := range a.state.PausedDatacenters {
+			if dc != datacenter {
+				dcs = append(dcs, dc)
+			}
+		}
+		if paused {
+			dcs = append(dcs, datacenter)
+			sort.Strings(dcs)
+		}
+		a.state.PausedDatacenters = dcs
+	}
+
+	a.updateMetrics()
+	return a.save()
+}
+
+// flip toggles the global pause, and returns the new state.
+func (a *adminStore) flip() (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.state.Paused = !a.state.Paused
+	a.updateMetrics()
+	return a.state.Paused, a.save()
+}
+
+// addExclusion adds an exclusion, replacing any existing exclusion for
+// the same node and health check.
+func (a *adminStore) addExclusion(e types.Exclusion) error {
+	a.Lock()
+	defer a.Unlock()
+
+	a.removeLocked(e.NodeID, e.Check)
+	a.state.Exclusions = append(a.state.Exclusions, e)
+	a.updateMetrics()
+	return a.save()
+}
+
+// removeExclusion removes the exclusion for the node and health check.
+// It returns false if no such exclusion exists.
+func (a *adminStore) removeExclusion(nodeID, check string) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if !a.removeLocked(nodeID, check) {
+		return false, nil
+	}
+	a.updateMetrics()
+	return true, a.save()
+}
+
+func (a *adminStore) removeLocked(nodeID, check string) bool {
+	found := false
+	exclusions := []types.Exclusion{}
+	for _, e := range a.state.Exclusions {
+		if e.NodeID == nodeID && e.Check == check {
+			found = true
+			continue
+		}
+		exclusions = append(exclusions, e)
+	}
+	a.state.Exclusions = exclusions
+	return found
+}
+
+// expire removes the exclusions which have expired.
+func (a *adminStore) expire(now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	exclusions := []types.Exclusion{}
+	for _, e := range a.state.Exclusions {
+		if e.Expired(now) {
+			log.Info(fmt.Sprintf("Exclusion for node: %q check: %q expired.", e.NodeID, e.Check))
+			continue
+		}
+		exclusions = append(exclusions, e)
+	}
+
+	// Absolute maintenance windows which are over are removed as well.
+	windows := []types.MaintenanceWindow{}
+	for _, w := range a.state.MaintenanceWindows {
+		if w.Schedule == "" && !now.Before(w.End) {
+			log.Info(fmt.Sprintf("Maintenance window %s is over.", w.ID))
+			continue
+		}
+		windows = append(windows, w)
+	}
+
+	if len(exclusions) == len(a.state.Exclusions) && len(windows) == len(a.state.MaintenanceWindows) {
+		return
+	}
+
+	a.state.Exclusions = exclusions
+	a.state.MaintenanceWindows = windows
+	a.compileWindows()
+	a.updateMetrics()
+	if err := a.save(); err != nil {
+		log.Warning(fmt.Sprintf("Error in saving admin state: %v", err))
+	}
+}
+
+// nodeExcluded returns true if the node is excluded from aggregation.
+func (a *adminStore) nodeExcluded(nodeID string) bool {
+	return a.excluded(nodeID, "")
+}
+
+// checkExcluded returns true if the health check should not be enforced on the node.
+func (a *adminStore) checkExcluded(nodeID, check string) bool {
+	return a.excluded(nodeID, check) || a.excluded("", check)
+}
+
+func (a *adminStore) excluded(nodeID, check string) bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	now := time.Now()
+	for _, e := range a.state.Exclusions {
+		if e.NodeID == nodeID && e.Check == check && !e.Expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns a copy of the admin state.
+func (a *adminStore) snapshot() types.AdminState {
+	a.RLock()
+	defer a.RUnlock()
+
+	s := a.state
+	s.PausedDatacenters = append([]string{}, a.state.PausedDatacenters...)
+	s.Exclusions = append([]types.Exclusion{}, a.state.Exclusions...)
+	s.MaintenanceWindows = append([]types.MaintenanceWindow(nil), a.state.MaintenanceWindows...)
+	return s
+}
+
+func exclusionKind(e types.Exclusion) string {
+	switch {
+	case e.NodeID != "" && e.Check != "":
+		return "node_check"
+	case e.NodeID != "":
+		return "node"
+	default:
+		return "check"
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// registerAdminHandlers adds the authenticated admin HTTP API to mux.
+func (a *aggregator) registerAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/admin/state", withAdminAuth(a.adminStateHandler))
+	mux.HandleFunc("/v1/admin/pause", withAdminAuth(a.pauseHandler(true)))
+	mux.HandleFunc("/v1/admin/resume", withAdminAuth(a.pauseHandler(false)))
+	mux.HandleFunc("/v1/admin/exclusions", withAdminAuth(a.exclusionsHandler))
+	mux.HandleFunc("/v1/admin/maintenance", withAdminAuth(a.maintenanceHandler))
+}
+
+// withAdminAuth validates the AGGREGATOR_ADMIN_TOKEN in the authorization header.
+// The admin API is disabled, if AGGREGATOR_ADMIN_TOKEN is not set.
+func withAdminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "admin API is disabled, set AGGREGATOR_ADMIN_TOKEN to enable it", http.StatusForbidden)
+			return
+		}
+
+		tokens := strings.Split(r.Header.Get("Authorization"), " ")
+		if len(tokens) < 2 {
+			http.Error(w, "malformed or missing token in http request header", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := base64.StdEncoding.DecodeString(tokens[1])
+		if err != nil || subtle.ConstantTimeCompare(token, []byte(adminToken)) != 1 {
+			http.Error(w, "invalid token in http request header", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminStateHandler serves /v1/admin/state, which returns the pause and exclusion state.
+func (a *aggregator) adminStateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.admin.snapshot())
+}
+
+// pauseHandler serves /v1/admin/pause and /v1/admin/resume.
+// The optional datacenter query parameter limits the pause to a single datacenter.
+func (a *aggregator) pauseHandler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		datacenter := r.URL.Query().Get("datacenter")
+		if err := a.admin.setPaused(datacenter, paused); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		scope := "globally"
+		if datacenter != "" {
+			scope = "for datacenter " + datacenter
+		}
+		if paused {
+			log.Info("Aggregator paused " + scope + " through admin API.")
+		} else {
+			log.Info("Aggregator resumed " + scope + " through admin API.")
+		}
+		writeJSON(w, http.StatusOK, a.admin.snapshot())
+	}
+}
+
+// exclusionRequest is the body of POST /v1/admin/exclusions.
+// TTL is a duration e.g. 4h, and takes precedence over ExpiresAt.
+type exclusionRequest struct {
+	types.Exclusion
+	TTL string `json:"ttl,omitempty"`
+}
+
+// exclusionsHandler serves /v1/admin/exclusions.
+// GET lists the exclusions, POST adds one, and DELETE removes the one
+// matching the node_id and check query parameters.
+func (a *aggregator) exclusionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.admin.snapshot().Exclusions)
+	case http.MethodPost:
+		req := exclusionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		e := req.Exclusion
+		if e.NodeID == "" && e.Check == "" {
+			http.Error(w, "node_id or check must be set", http.StatusBadRequest)
+			return
+		}
+
+		e.CreatedAt = time.Now()
+		if req.TTL != "" {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid ttl: %v", err), http.StatusBadRequest)
+				return
+			}
+			e.ExpiresAt = e.CreatedAt.Add(ttl)
+		}
+
+		if err := a.admin.addExclusion(e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info(fmt.Sprintf("Exclusion added for node: %q check: %q through admin API.", e.NodeID, e.Check))
+		writeJSON(w, http.StatusOK, e)
+	case http.MethodDelete:
+		nodeID := r.URL.Query().Get("node_id")
+		check := r.URL.Query().Get("check")
+		found, err := a.admin.removeExclusion(nodeID, check)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "exclusion not found", http.StatusNotFound)
+			return
+		}
+		log.Info(fmt.Sprintf("Exclusion removed for node: %q check: %q through admin API.", nodeID, check))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// adminStatePath returns the location of the admin state file in dataDir.
+func adminStatePath(dataDir string) string {
+	return filepath.Join(dataDir, "admin.json")
+}
@@ -18,13 +18,11 @@ limitations under the License.
 package aggregator
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -37,61 +35,185 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+// aggregatorFlags are shared by the aggregator and the aggregator plan commands.
+var aggregatorFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "debug",
+		Usage: "Enable debug logging.",
+	},
+	&cli.StringFlag{
+		Name:    "detector-port",
+		Aliases: []string{"p"},
+		Value:   ":8083",
+		Usage:   "Detector HTTP server port",
+	},
+	&cli.StringSliceFlag{
+		Name:    "detector-datacenter",
+		Aliases: []string{"dc"},
+		Usage:   "List of datacenters where detector is running.",
+	},
+	&cli.IntFlag{
+		Name:  "detector-unreachable-cycles",
+		Value: 3,
+		Usage: "Number of consecutive aggregation cycles a detector must be unreachable, before the node reports a failing DetectorUnreachable health check. Set to 0 to disable it",
+	},
+	&cli.StringSliceFlag{
+		Name:    "enforce-health-check",
+		Aliases: []string{"hc"},
+		Usage:   "Health checks in this list will be enforced i.e. node will be taken out of the scheduling pool if health-check fails.",
+	},
+	&cli.StringFlag{
+		Name:    "nomad-server",
+		Aliases: []string{"s"},
+		Value:   "http://localhost:4646",
+		Usage:   "HTTP API address of a Nomad server or agent.",
+	},
+	&cli.IntFlag{
+		Name:  "flap-threshold",
+		Value: 4,
+		Usage: "Number of transitions between healthy and unhealthy within --flap-window, above which a node is flapping, and quarantined. Set to 0 to disable flap detection",
+	},
+	&cli.StringFlag{
+		Name:  "flap-window",
+		Value: "1h",
+		Usage: "Sliding window in which node transitions are counted for flap detection",
+	},
+	&cli.StringFlag{
+		Name:  "quarantine-base",
+		Value: "15m",
+		Usage: "Time a flapping node is held ineligible. It doubles with every quarantine, until the node is stable for a whole --flap-window",
+	},
+	&cli.StringFlag{
+		Name:  "quarantine-max",
+		Value: "24h",
+		Usage: "Maximum time a flapping node is held ineligible",
+	},
+	&cli.StringFlag{
+		Name:  "maintenance-config",
+		Usage: "JSON file of maintenance windows, during which enforcement is alert-only",
+	},
+	&cli.StringSliceFlag{
+		Name:  "check-severity",
+		Usage: "Severity of a health check, formatted as check=severity e.g. docker=10 (default: 1). When the threshold doesn't allow cordoning all unhealthy nodes, nodes with the most severe failing health checks are cordoned first.",
+	},
+	&cli.StringSliceFlag{
+		Name:  "node-attribute",
+		Usage: "Aggregator will filter nodes based on these attributes. E.g. if you set os.name=ubuntu, aggregator will only reach out to ubuntu nodes in the cluster.",
+	},
+	&cli.IntFlag{
+		Name:  "threshold-percentage",
+		Value: 85,
+		Usage: "If the number of eligible nodes goes below the threshold, npd will stop marking nodes as ineligible",
+	},
+	&cli.StringFlag{
+		Name:  "threshold-mode",
+		Value: thresholdModeNodes,
+		Usage: "How --threshold-percentage is evaluated: nodes (percentage of eligible nodes) or capacity (percentage of eligible allocatable CPU and memory)",
+	},
+	&cli.StringSliceFlag{
+		Name:  "threshold-scope",
+		Value: cli.NewStringSlice(scopeDatacenter, scopeNodePool, scopeNodeClass),
+		Usage: "Dimensions of the scopes --threshold-percentage is evaluated in: datacenter, node_pool, node_class. Set to cluster for a single, cluster wide scope",
+	},
+	&cli.StringSliceFlag{
+		Name:  "threshold-override",
+		Usage: "Override --threshold-percentage for matching scopes, formatted as <dimension>=<value>[,<dimension>=<value>...]:<percentage> e.g. datacenter=dc1,node_class=gpu:50",
+	},
+	&cli.StringFlag{
+		Name:  "data-dir",
+		Value: "/data/nnpd",
+		Usage: "Location where aggregator persists its state. Prefixed with $NOMAD_ALLOC_DIR when running as a Nomad task, so that the default is in alloc/data, which a sticky ephemeral disk migrates",
+	},
+}
+
 var AggregatorCommand = &cli.Command{
 	Name:  "aggregator",
 	Usage: "Run npd in aggregator mode",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:    "aggregation-cycle-time",
 			Aliases: []string{"t"},
 			Value:   "15s",
 			Usage:   "Time (in seconds) to wait between each aggregation cycle",
 		},
-		&cli.BoolFlag{
-			Name:  "debug",
-			Usage: "Enable debug logging.",
+		&cli.IntFlag{
+			Name:  "prometheus-server-port",
+			Value: 3000,
+			Usage: "The port used to expose aggregators metrics in prometheus format",
 		},
 		&cli.StringFlag{
-			Name:    "detector-port",
-			Aliases: []string{"p"},
-			Value:   ":8083",
-			Usage:   "Detector HTTP server port",
+			Name:  "prometheus-server-addr",
+			Value: "0.0.0.0",
+			Usage: "The address to bind the aggregator metrics exporter",
 		},
-		&cli.StringSliceFlag{
-			Name:    "detector-datacenter",
-			Aliases: []string{"dc"},
-			Usage:   "List of datacenters where detector is running.",
+		&cli.BoolFlag{
+			Name:  "node-info-metrics",
+			Usage: "Export the health of every node as the npd_aggregator_node_info metric, with a series per node",
 		},
-		&cli.StringSliceFlag{
-			Name:    "enforce-health-check",
-			Aliases: []string{"hc"},
-			Usage:   "Health checks in this list will be enforced i.e. node will be taken out of the scheduling pool if health-check fails.",
+		&cli.StringFlag{
+			Name:  "node-info-metrics-ttl",
+			Value: "15m",
+			Usage: "Time after which the npd_aggregator_node_info series of a node which is no longer checked is removed",
+		},
+		&cli.BoolFlag{
+			Name:  "publish-node-meta",
+			Usage: "Publish failing health checks as dynamic node meta (npd.healthy, npd.problem.<check>), so jobs can constrain on them. Requires Nomad 1.5+.",
 		},
 		&cli.StringFlag{
-			Name:    "nomad-server",
-			Aliases: []string{"s"},
-			Value:   "http://localhost:4646",
-			Usage:   "HTTP API address of a Nomad server or agent.",
+			Name:  "audit-log",
+			Usage: "Location of the audit log of eligibility decisions. Defaults to audit.jsonl in --data-dir. Set to \"off\" to disable it",
 		},
-		&cli.StringSliceFlag{
-			Name:  "node-attribute",
-			Usage: "Aggregator will filter nodes based on these attributes. E.g. if you set os.name=ubuntu, aggregator will only reach out to ubuntu nodes in the cluster.",
+		&cli.IntFlag{
+			Name:  "audit-log-max-size",
+			Value: 20,
+			Usage: "Size (in megabytes) of the audit log before it gets rotated",
 		},
 		&cli.IntFlag{
-			Name:  "threshold-percentage",
-			Value: 85,
-			Usage: "If the number of eligible nodes goes below the threshold, npd will stop marking nodes as ineligible",
+			Name:  "audit-log-max-files",
+			Value: 5,
+			Usage: "Number of rotated audit logs to keep",
+		},
+		&cli.StringFlag{
+			Name:  "history-retention",
+			Value: "720h",
+			Usage: "Time health check transitions are kept in the aggregator history. Set to 0 to disable the history",
 		},
 		&cli.IntFlag{
-			Name:  "prometheus-server-port",
-			Value: 3000,
-			Usage: "The port used to expose aggregators metrics in prometheus format",
+			Name:  "history-max-transitions",
+			Value: 10000,
+			Usage: "Maximum number of health check transitions kept in the aggregator history per node",
 		},
 		&cli.StringFlag{
-			Name:  "prometheus-server-addr",
-			Value: "0.0.0.0",
-			Usage: "The address to bind the aggregator metrics exporter",
+			Name:  "incident-retention",
+			Value: "2160h",
+			Usage: "Time closed incidents are kept, for SLO reporting",
+		},
+		&cli.BoolFlag{
+			Name:  "record",
+			Usage: "Record the node lists and node health of every aggregation cycle as a timeline, which can be replayed with `npd aggregator simulate`",
+		},
+		&cli.StringFlag{
+			Name:  "record-dir",
+			Usage: "Location of the recorded timeline files. Defaults to timeline in --data-dir",
+		},
+		&cli.IntFlag{
+			Name:  "record-max-size",
+			Value: 20,
+			Usage: "Size (in megabytes, compressed) of a timeline file before it gets rotated",
+		},
+		&cli.IntFlag{
+			Name:  "record-max-files",
+			Value: 10,
+			Usage: "Number of timeline files to keep",
 		},
+		&cli.StringSliceFlag{
+			Name:  "record-redact",
+			Usage: "Fields to redact from the recorded timeline: message, address, name, attributes, meta",
+		},
+	}, aggregatorFlags...),
+	Subcommands: []*cli.Command{
+		planCommand,
+		simulateCommand,
 	},
 	Action: func(c *cli.Context) error {
 		return aggregate(c)
@@ -99,360 +221,379 @@ var AggregatorCommand = &cli.Command{
 }
 
 var (
-	pause             bool
-	enforceHCMap      map[string]bool
-	detectorDCMap     map[string]bool
-	nodeAttributesMap map[string]string
+	instanceID string
+
+	queryOptions = &api.QueryOptions{AllowStale: true}
 )
 
-func aggregate(context *cli.Context) error {
-	debug := context.Bool("debug")
-	if debug {
+// newAggregator parses the flags shared by the aggregator commands.
+func newAggregator(context *cli.Context) (*aggregator, error) {
+	if context.Bool("debug") {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	nomadServer := context.String("nomad-server")
-	thresholdPercentage := context.Int("threshold-percentage")
-	if thresholdPercentage == 85 {
-		log.Warning(fmt.Sprintf("No override set for --threshold-percentage. Running with default value: %d\n", thresholdPercentage))
-		log.Warning("Recommended to set an override for --threshold-percentage based on your cluster capacity.")
-	}
-
-	client, err := getNomadClient(nomadServer)
+	client, err := getNomadClient(context.String("nomad-server"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	enforceHCList := context.StringSlice("enforce-health-check")
-	enforceHCMap = make(map[string]bool)
+	enforceHCMap := make(map[string]bool)
 	for _, hc := range enforceHCList {
 		enforceHCMap[hc] = true
 	}
 
+	checkSeverityMap, err := parseCheckSeverity(context.StringSlice("check-severity"))
+	if err != nil {
+		return nil, err
+	}
+
 	// Create the map of datacenters (DCs) where detector is running.
 	detectorDCList := context.StringSlice("detector-datacenter")
-	detectorDCMap = make(map[string]bool)
+	detectorDCMap := make(map[string]bool)
 	for _, dc := range detectorDCList {
 		detectorDCMap[dc] = true
 	}
 
 	// Read the node attributes, and populate the attributes map.
 	nodeAttributes := context.StringSlice("node-attribute")
-	nodeAttributesMap = make(map[string]string)
+	nodeAttributesMap := make(map[string]string)
 	for _, attribute := range nodeAttributes {
 		result := strings.Split(attribute, "=")
 		if len(result) != 2 {
-			return fmt.Errorf("invalid --node-attribute. Set key=val for valid node attribute")
+			return nil, fmt.Errorf("invalid --node-attribute. Set key=val for valid node attribute")
 		}
 		nodeAttributesMap[result[0]] = result[1]
 	}
 
-	aggregationCycleTime, err := time.ParseDuration(context.String("aggregation-cycle-time"))
-	if err != nil {
-		return err
-	}
-
-	detectorPort := context.String("detector-port")
-
-	authToken := os.Getenv("DETECTOR_HTTP_TOKEN")
-
 	// Read aggregator DC (Datacenter).
 	// $NOMAD_DC along with detector-datacenter list will be used
 	// when reaching out to npd detectors.
 	datacenter := os.Getenv("NOMAD_DC")
-	if datacenter == "" {
-		return fmt.Errorf("the environment variable `NOMAD_DC' is missing. Datacenter must be set")
+	if datacenter != "" {
+		detectorDCMap[datacenter] = true
 	}
-	detectorDCMap[datacenter] = true
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGUSR1)
-	go flipPause(sigs)
-
-	metricsExporter(context.String("prometheus-server-addr"), context.Int("prometheus-server-port"), context.App.Version)
+	thresholdMode := context.String("threshold-mode")
+	if thresholdMode != thresholdModeNodes && thresholdMode != thresholdModeCapacity {
+		return nil, fmt.Errorf("invalid --threshold-mode %s. Supported modes are nodes and capacity", thresholdMode)
+	}
 
-	nodeHandle := client.Nodes()
+	flapWindow, err := time.ParseDuration(context.String("flap-window"))
+	if err != nil {
+		return nil, err
+	}
 
-	queryOptions := &api.QueryOptions{AllowStale: true}
+	quarantineBase, err := time.ParseDuration(context.String("quarantine-base"))
+	if err != nil {
+		return nil, err
+	}
 
-	// Aggregation cycle index
-	index := 0
+	quarantineMax, err := time.ParseDuration(context.String("quarantine-max"))
+	if err != nil {
+		return nil, err
+	}
 
-	// map[nodeID][node health check /v1/nodehealth/]
-	m := make(map[string][]types.HealthCheck)
-	for {
-		aggregatorCyclesTotalCounter.With(prometheus.Labels{"dc": datacenter}).Inc()
-		if pause {
-			// Aggregator is paused. Wait for unpause.
-			continue
+	var configWindows []*maintenanceWindow
+	if path := context.String("maintenance-config"); path != "" {
+		configWindows, err = loadMaintenanceConfig(path)
+		if err != nil {
+			return nil, err
 		}
+		log.Info(fmt.Sprintf("Loaded %d maintenance windows from %s.", len(configWindows), path))
+	}
 
-		log.Info("Collect and aggregate nodes health")
-		startTime := time.Now()
+	thresholdScope, err := parseThresholdScope(context.StringSlice("threshold-scope"))
+	if err != nil {
+		return nil, err
+	}
 
-		nodes, _, err := nodeHandle.List(queryOptions)
+	var thresholdOverrides []thresholdOverride
+	for _, override := range context.StringSlice("threshold-override") {
+		o, err := parseThresholdOverride(override, thresholdScope)
 		if err != nil {
-			log.Warning(fmt.Sprintf("Error in listing nomad nodes: %v\n", err))
-			time.Sleep(aggregationCycleTime)
-			continue
+			return nil, err
 		}
+		thresholdOverrides = append(thresholdOverrides, o)
+	}
 
-		eligibleNodeCount := getEligibleNodeCount(nodes)
-		eligibleNodesGauge.With(prometheus.Labels{"dc": datacenter}).Set(float64(eligibleNodeCount))
+	instanceID = getInstanceID()
 
-		totalNodeCount := len(nodes)
-		nodesTotalGauge.With(prometheus.Labels{"dc": datacenter}).Set(float64(totalNodeCount))
+	cluster := &nomadCluster{client: client}
+	a := &aggregator{
+		nodes: cluster,
+		detector: &httpDetector{
+			port:      context.String("detector-port"),
+			authToken: os.Getenv("DETECTOR_HTTP_TOKEN"),
+		},
+		actuator:            cluster,
+		records:             make(map[string]*nodeRecord),
+		datacenter:          datacenter,
+		thresholdPercentage: context.Int("threshold-percentage"),
+		thresholdMode:       thresholdMode,
+		thresholdScope:      thresholdScope,
+		thresholdOverrides:  thresholdOverrides,
+		unreachableCycles:   context.Int("detector-unreachable-cycles"),
+		flap: flapPolicy{
+			window:    flapWindow,
+			threshold: context.Int("flap-threshold"),
+			base:      quarantineBase,
+			max:       quarantineMax,
+		},
+		enforcedChecks:  enforceHCMap,
+		checkSeverities: checkSeverityMap,
+		detectorDCs:     detectorDCMap,
+		nodeAttributes:  nodeAttributesMap,
+		configWindows:   configWindows,
+		admin:           &adminStore{},
+	}
+	a.status = newNodeRegistry(a.isEnforced)
+	return a, nil
+}
 
-		log.Info(fmt.Sprintf("Eligible Nodes: %d, Total Nodes: %d", eligibleNodeCount, totalNodeCount))
+// getDataDir returns the --data-dir, prefixed with $NOMAD_ALLOC_DIR when
+// running as a Nomad task.
+func getDataDir(context *cli.Context) string {
+	dataDir := context.String("data-dir")
+	if nomadAllocDir := os.Getenv("NOMAD_ALLOC_DIR"); nomadAllocDir != "" {
+		dataDir = nomadAllocDir + dataDir
+	}
+	return dataDir
+}
 
-		var nodeInfo *api.Node
-		for _, node := range nodes {
-			// Skip ineligible nodes
-			if node.SchedulingEligibility == "ineligible" {
-				continue
-			}
+func aggregate(context *cli.Context) error {
+	a, err := newAggregator(context)
+	if err != nil {
+		return err
+	}
 
-			nodeInfo, _, err = nodeHandle.Info(node.ID, queryOptions)
-			if err != nil {
-				log.Warning(fmt.Sprintf("Error in getting node info: %v. Skipping node: %s\n", err, node.Address))
-				nodeHandleErrorsCounter.With(prometheus.Labels{"dc": datacenter}).Inc()
-				continue
-			}
+	if a.datacenter == "" {
+		return fmt.Errorf("the environment variable `NOMAD_DC' is missing. Datacenter must be set")
+	}
 
-			skipNode := false
-			for key, val := range nodeAttributesMap {
-				res, ok := nodeInfo.Attributes[key]
-				if !ok {
-					if debug {
-						log.Debug(fmt.Sprintf("Node %s: node attribute: %s doesn't exist, skipping node.", node.Address, key))
-					}
-					skipNode = true
-					break
-				}
+	if a.thresholdPercentage == 85 {
+		log.Warning(fmt.Sprintf("No override set for --threshold-percentage. Running with default value: %d\n", a.thresholdPercentage))
+		log.Warning("Recommended to set an override for --threshold-percentage based on your cluster capacity.")
+	}
 
-				if res != val {
-					if debug {
-						log.Debug(fmt.Sprintf("Node %s: node attribute: %s doesn't match. Expected: %s, actual: %s. Skipping node...", node.Address, key, val, res))
-					}
-					skipNode = true
-					break
-				}
+	aggregationCycleTime, err := time.ParseDuration(context.String("aggregation-cycle-time"))
+	if err != nil {
+		return err
+	}
 
-			}
+	a.publishMeta = context.Bool("publish-node-meta")
 
-			if _, ok := detectorDCMap[nodeInfo.Datacenter]; !ok {
-				skipNode = true
-			}
+	if context.Bool("node-info-metrics") {
+		ttl, err := time.ParseDuration(context.String("node-info-metrics-ttl"))
+		if err != nil {
+			return err
+		}
+		nodeInfoMetric = newNodeInfoMetrics(ttl)
+	}
 
-			// If node attribute e.g. os.name=ubuntu is missing or not matching in the node info
-			// OR node is not in a DC where detector is running, Skip this node, and move onto next one.
-			if skipNode {
-				nodeHandleSkipCounter.With(prometheus.Labels{"dc": datacenter}).Inc()
-				continue
-			}
+	dataDir := getDataDir(context)
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
 
-			npdServer := fmt.Sprintf("http://%s%s", node.Address, detectorPort)
+	token, ok := os.LookupEnv("AGGREGATOR_ADMIN_TOKEN")
+	if !ok {
+		log.Info("AGGREGATOR_ADMIN_TOKEN is not set, admin API is disabled.")
+	} else if strings.TrimSpace(token) == "" {
+		return fmt.Errorf("AGGREGATOR_ADMIN_TOKEN is set but empty. Set a token, or unset it to disable the admin API")
+	}
+	adminToken = token
 
-			npdActive, err := isNpdServerActive(npdServer, authToken)
-			if err != nil {
-				log.Warning(fmt.Sprintf("NNPD detector server is not active, maybe node %s was ineligible when npd was deployed, skipping node.", node.Address))
-				if debug {
-					log.Debug(fmt.Sprintf("Error: %v\n", err))
-				}
-				nodeHandleErrorsCounter.With(prometheus.Labels{"dc": datacenter}).Inc()
-				continue
-			}
+	a.admin, err = loadAdminStore(adminStatePath(dataDir))
+	if err != nil {
+		return err
+	}
 
-			if !npdActive {
-				log.Warning(fmt.Sprintf("Node problem detector /v1/health on node %s is unhealthy, skipping node.", node.Address))
-				nodeHandleErrorsCounter.With(prometheus.Labels{"dc": datacenter}).Inc()
-				continue
-			}
+	a.store, err = openStateStore(stateStorePath(dataDir))
+	if err != nil {
+		return err
+	}
+	defer a.store.Close()
 
-			url := npdServer + "/v1/nodehealth/"
-			req, err := http.NewRequest("POST", url, nil)
-			if err != nil {
-				log.Warning(fmt.Sprintf("Error in building /v1/nodehealth/ HTTP request: %v, skipping node %s\n", err, node.Address))
-				nodeHandleErrorsCounter.With(prometheus.Labels{"dc": datacenter}).Inc()
-				continue
-			}
+	// records has the state of each node from previous aggregation cycles,
+	// including the ones from before an aggregator restart.
+	a.records, err = a.store.loadNodes()
+	if err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("Restored aggregator state for %d nodes.", len(a.records)))
 
-			if authToken != "" {
-				base64EncodedToken := base64.StdEncoding.EncodeToString([]byte(authToken))
-				req.Header.Set("Authorization", "Basic "+base64EncodedToken)
-			}
+	auditLogPath := context.String("audit-log")
+	if auditLogPath == "" {
+		auditLogPath = filepath.Join(dataDir, "audit.jsonl")
+	}
+	if auditLogPath != "off" {
+		a.auditLog, err = openAuditLog(auditLogPath, int64(context.Int("audit-log-max-size"))*1024*1024, context.Int("audit-log-max-files"))
+		if err != nil {
+			return err
+		}
+		defer a.auditLog.Close()
+	}
+	for nodeID, rec := range a.records {
+		a.status.restore(nodeID, a.nodePolicy(nodeID, nil), rec)
+	}
 
-			req.Header.Set("Content-Type", "application/json")
-			client := &http.Client{Timeout: time.Second * 5}
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Warning(fmt.Sprintf("Error in getting /v1/nodehealth/ HTTP response: %v, skipping node %s\n", err, node.Address))
-				nodeHandleErrorsCounter.With(prometheus.Labels{"dc": datacenter}).Inc()
-				resp.Body.Close()
-				continue
-			}
+	historyRetention, err := time.ParseDuration(context.String("history-retention"))
+	if err != nil {
+		return err
+	}
+	if historyRetention > 0 {
+		a.history, err = openHistoryStore(historyStorePath(dataDir), historyRetention, context.Int("history-max-transitions"))
+		if err != nil {
+			return err
+		}
+		defer a.history.Close()
+	}
 
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Warning(fmt.Sprintf("Error in reading /v1/nodehealth/ HTTP response: %v, skipping node %s\n", err, node.Address))
-				nodeHandleErrorsCounter.With(prometheus.Labels{"dc": datacenter}).Inc()
-				resp.Body.Close()
-				continue
-			}
+	incidentRetention, err := time.ParseDuration(context.String("incident-retention"))
+	if err != nil {
+		return err
+	}
+	a.incidents, err = newIncidentLedger(a.store)
+	if err != nil {
+		return err
+	}
 
-			resp.Body.Close()
+	if context.Bool("record") {
+		redact, err := parseRedact(context.StringSlice("record-redact"))
+		if err != nil {
+			return err
+		}
 
-			current := []types.HealthCheck{}
-			if err := json.Unmarshal(body, &current); err != nil {
-				log.Warning(fmt.Sprintf("Error in unmarshalling /v1/nodehealth/ HTTP response body: %v, skipping node %s\n", err, node.Address))
-				nodeHandleErrorsCounter.With(prometheus.Labels{"dc": datacenter}).Inc()
-				continue
-			}
+		recordDir := context.String("record-dir")
+		if recordDir == "" {
+			recordDir = filepath.Join(dataDir, "timeline")
+		}
+		// Without a key, pseudonyms only match within this run.
+		redactKey := []byte(os.Getenv("AGGREGATOR_RECORD_REDACT_KEY"))
+		rec, err := openRecorder(a, recordDir, int64(context.Int("record-max-size"))*1024*1024, context.Int("record-max-files"), redact, redactKey)
+		if err != nil {
+			return err
+		}
+		defer rec.Close()
+		log.Info(fmt.Sprintf("Recording aggregation cycles into %s.", recordDir))
+	}
 
-			var nodeHealth []types.HealthCheck
-			if m[node.ID] != nil {
-				nodeHealth = m[node.ID]
-			}
+	metricsExporter(a, context.String("prometheus-server-addr"), context.Int("prometheus-server-port"), context.App.Version)
 
-			// previous state map has the health check results from last aggregation cycle.
-			// This will make sure we don't toggle/untoggle a node unless there is a state change.
-			previous := make(map[string]types.HealthCheck)
-			for _, nh := range nodeHealth {
-				previous[nh.Type] = nh
-			}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go a.flipPause(sigs)
 
-			nodeHealthy := true
-			stateChanged := false
-			toggle := false
-
-			for _, curr := range current {
-				// Default CPU, memory and disk checks are represented with
-				// boolean (true/false). curr.Result = true for CPUUnderPressure
-				// or MemoryUnderPressure or DiskUsageHigh tells that the system
-				// is under CPU/memory/disk pressure and should be taken out of
-				// eligibility.
-				if curr.Result == "Unhealthy" || curr.Result == "true" {
-					log.Warning(fmt.Sprintf("Node %s: %s is %s: %s\n", node.Address, curr.Type, curr.Result, curr.Message))
-					nodeHealthy = false
-					healthCheckUnhealthyCounter.With(prometheus.Labels{"dc": datacenter, "check": curr.Type, "host": node.Address}).Inc()
-
-					// Even if one of the health checks are failing, node will not be taken out of the scheduling pool.
-					// Unless that health check is part of --enforce-health-check list.
-					// Set toggle=true if above is satisfied.
-					if _, ok := enforceHCMap[curr.Type]; ok {
-						log.Info(fmt.Sprintf("%s is in enforce health check list. Set node %s scheduling eligibility to false\n", curr.Type, node.Address))
-						toggle = true
-					} else {
-						log.Info(fmt.Sprintf("%s is not in enforce health check list. Node %s will be dry-runned and not taken out of scheduling pool\n", curr.Type, node.Address))
-					}
-				} else {
-					healthCheckHealthyCounter.With(prometheus.Labels{"dc": datacenter, "check": curr.Type}).Inc()
-					if debug {
-						log.Debug(fmt.Sprintf("Node %s: %s is %s: %s\n", node.Address, curr.Type, curr.Result, curr.Message))
-					}
-				}
+	// Aggregation cycle index
+	index := 0
 
-				prev, ok := previous[curr.Type]
-				if ok {
-					if prev.Result == curr.Result {
-						continue
-					} else {
-						stateChanged = true
-					}
-				}
-			}
+	// The history and the closed incidents are pruned every hour.
+	var lastPrune time.Time
 
-			// If toggle is true i.e we want to take the node out of the scheduling pool.
-			// We should only take the node out, if the available capacity stays above the threshold (--threshold-percentage)
-			// after taking this node out of the scheduling pool.
-			aboveThreshold := (float64(eligibleNodeCount)/float64(totalNodeCount))*100 > float64(thresholdPercentage)
-			toggle = toggle && aboveThreshold
+	for {
+		aggregatorCyclesTotalCounter.With(prometheus.Labels{"dc": a.datacenter}).Inc()
+		a.admin.expire(time.Now())
+		if a.admin.isPaused("") {
+			// Aggregator is paused. Wait for unpause.
+			log.Debug("Aggregator is paused, skipping aggregation cycle.")
+			time.Sleep(aggregationCycleTime)
+			continue
+		}
 
-			// This is the check for first aggregation cycle. No previous state exist at this point.
-			if len(previous) == 0 && !nodeHealthy && toggle {
-				eligibleNodeCount = toggleNodeEligibility(nodeHandle, node.ID, node.Address, false, eligibleNodeCount)
-			}
+		log.Info("Collect and aggregate nodes health")
+		startTime := time.Now()
 
-			// Second aggregation cycle onwards, previous state map will exist.
-			if stateChanged {
-				if nodeHealthy {
-					eligibleNodeCount = toggleNodeEligibility(nodeHandle, node.ID, node.Address, true, eligibleNodeCount)
-				} else if toggle {
-					eligibleNodeCount = toggleNodeEligibility(nodeHandle, node.ID, node.Address, false, eligibleNodeCount)
-				}
-			}
-			m[node.ID] = current
+		if _, err := a.runCycle(); err != nil {
+			log.Warning(fmt.Sprintf("Error in listing nomad nodes: %v\n", err))
+			time.Sleep(aggregationCycleTime)
+			continue
 		}
 
 		endTime := time.Now()
 		diff := endTime.Sub(startTime).Seconds()
 		log.Info(fmt.Sprintf("Aggregation cycle %d: processing time: %.2f seconds.", index, diff))
-		aggregatorProcessingTime.With(prometheus.Labels{"dc": datacenter}).Set(diff)
+		aggregatorProcessingTime.With(prometheus.Labels{"dc": a.datacenter}).Set(diff)
 
 		index++
 
-		time.Sleep(aggregationCycleTime)
-	}
-}
+		if time.Since(lastPrune) > time.Hour {
+			if a.history != nil {
+				removed, err := a.history.prune(time.Now())
+				if err != nil {
+					log.Warning(fmt.Sprintf("Error in pruning history: %v", err))
+				} else if removed > 0 {
+					log.Info(fmt.Sprintf("Pruned %d health check transitions from history.", removed))
+				}
+			}
 
-// getEligibleNodeCount return the count of eligible nodes.
-func getEligibleNodeCount(nodes []*api.NodeListStub) int {
-	eligibleNodeCount := 0
-	for _, node := range nodes {
-		if node.SchedulingEligibility == "eligible" {
-			eligibleNodeCount++
+			removed, err := a.incidents.prune(time.Now().Add(-incidentRetention))
+			if err != nil {
+				log.Warning(fmt.Sprintf("Error in pruning incidents: %v", err))
+			} else if removed > 0 {
+				log.Info(fmt.Sprintf("Pruned %d closed incidents.", removed))
+			}
+			lastPrune = time.Now()
 		}
+
+		time.Sleep(aggregationCycleTime)
 	}
-	return eligibleNodeCount
 }
 
-// Toggle Nomad node eligibility.
-func toggleNodeEligibility(nodeHandle *api.Nodes, nodeID, nodeAddress string, eligible bool, eligibleNodeCount int) int {
-	if _, err := nodeHandle.ToggleEligibility(nodeID, eligible, nil); err != nil {
-		log.Warning(fmt.Sprintf("Error in toggling node eligibility, skipping node %s\n", nodeAddress))
-		return eligibleNodeCount
+// skipReason returns why a node should not be checked, or an empty string
+// if the node should be checked.
+func (a *aggregator) skipReason(nodeInfo *api.Node, policy types.NodePolicy) string {
+	if reason := a.attributeMismatch(nodeInfo); reason != "" {
+		return reason
 	}
-	log.Info(fmt.Sprintf("Node %s scheduling eligibility changed to %t\n", nodeAddress, eligible))
 
-	if eligible {
-		eligibleNodeCount++
-	} else {
-		eligibleNodeCount--
+	if _, ok := a.detectorDCs[nodeInfo.Datacenter]; !ok {
+		return fmt.Sprintf("datacenter %s is not a detector datacenter", nodeInfo.Datacenter)
 	}
-	return eligibleNodeCount
-}
 
-// Check if Nomad node problem detector (nNPD) HTTP server is healthy and active.
-func isNpdServerActive(npdServer, authToken string) (bool, error) {
-	url := npdServer + "/v1/health/"
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return false, err
+	if a.admin.isPaused(nodeInfo.Datacenter) {
+		return fmt.Sprintf("aggregator is paused for datacenter %s", nodeInfo.Datacenter)
 	}
 
-	if authToken != "" {
-		base64EncodedToken := base64.StdEncoding.EncodeToString([]byte(authToken))
-		req.Header.Set("Authorization", "Basic "+base64EncodedToken)
+	if policy.Ignore {
+		return fmt.Sprintf("%s node meta is set", metaIgnore)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: time.Second * 5}
-	resp, err := client.Do(req)
-	if err != nil {
-		return false, err
+	if a.admin.nodeExcluded(nodeInfo.ID) {
+		return "node is excluded"
 	}
-	defer resp.Body.Close()
+	return ""
+}
 
-	if resp.StatusCode != 200 {
-		return false, nil
+// attributeMismatch returns why a node doesn't match --node-attribute, or
+// an empty string if it matches.
+func (a *aggregator) attributeMismatch(nodeInfo *api.Node) string {
+	for key, val := range a.nodeAttributes {
+		res, ok := nodeInfo.Attributes[key]
+		if !ok {
+			return fmt.Sprintf("node attribute: %s doesn't exist", key)
+		}
+
+		if res != val {
+			return fmt.Sprintf("node attribute: %s doesn't match. Expected: %s, actual: %s", key, val, res)
+		}
 	}
-	return true, nil
+	return ""
+}
+
+// isEnforced returns true if a failing health check should take the node
+// out of the scheduling pool.
+func (a *aggregator) isEnforced(policy types.NodePolicy, nodeID, check string) bool {
+	return policy.Enforces(check) && !a.admin.checkExcluded(nodeID, check)
 }
 
 // flipPause pauses and unpauses aggregator based on receiving SIGUSR1 signal.
-func flipPause(sigs chan os.Signal) {
+func (a *aggregator) flipPause(sigs chan os.Signal) {
 	for range sigs {
-		pause = !pause
+		pause, err := a.admin.flip()
+		if err != nil {
+			log.Warning(fmt.Sprintf("Error in saving admin state: %v", err))
+		}
 		if pause {
 			log.Info("Received signal SIGUSR1, pausing aggregator.")
 		} else {
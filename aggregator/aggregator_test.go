@@ -0,0 +1,1212 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestAggregator sets the empty admin state and node registry of a,
+// as newAggregator does.
+func newTestAggregator(a *aggregator) *aggregator {
+	if a.admin == nil {
+		a.admin = &adminStore{}
+	}
+	a.status = newNodeRegistry(a.isEnforced)
+	return a
+}
+
+// TestNodesEndpoint test the /v1/nodes, /v1/nodes/{id} and /v1/summary HTTP endpoints.
+func TestNodesEndpoint(t *testing.T) {
+	a := newTestAggregator(&aggregator{enforcedChecks: map[string]bool{"docker": true}})
+	policy := a.nodePolicy("node-1", nil)
+
+	now := time.Now()
+	rec1 := newNodeRecord()
+	rec1.observe([]types.HealthCheck{
+		{Type: "docker", Result: "Unhealthy", Message: "docker daemon is down"},
+		{Type: "ntp", Result: "Healthy"},
+	}, now)
+	a.status.update(&api.Node{ID: "node-1", Datacenter: "dc1", SchedulingEligibility: "eligible"}, "10.0.0.1", policy, rec1)
+	rec1.recordAction(false, "docker is Unhealthy: docker daemon is down", now)
+	a.status.recordAction("node-1", rec1)
+
+	rec2 := newNodeRecord()
+	rec2.observe([]types.HealthCheck{{Type: "docker", Result: "Healthy"}}, now)
+	a.status.update(&api.Node{ID: "node-2", Datacenter: "dc2", SchedulingEligibility: "eligible"}, "10.0.0.2", policy, rec2)
+
+	mux := http.NewServeMux()
+	a.registerAPIHandlers(mux)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/nodes", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	nodes := []types.NodeStatus{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, nodes, 2)
+	assert.Equal(t, "node-1", nodes[0].ID)
+	assert.False(t, nodes[0].Healthy)
+	assert.Equal(t, "ineligible", nodes[0].LastAction)
+	assert.True(t, nodes[0].Checks[0].Enforced, "docker should be enforced")
+	assert.Equal(t, 1, nodes[0].Checks[0].ConsecutiveFailures)
+	assert.False(t, nodes[0].Checks[1].Enforced, "ntp should not be enforced")
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/nodes/node-2", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	node := types.NodeStatus{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &node); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.0.0.2", node.Address)
+	assert.True(t, node.Healthy)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/nodes/node-3", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/summary", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	summary := types.Summary{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, summary.Nodes)
+	assert.Equal(t, 1, summary.Unhealthy)
+	assert.Equal(t, 1, summary.Cordoned)
+	assert.Equal(t, 1, summary.Checks["docker"].Unhealthy)
+	assert.Equal(t, 1, summary.Checks["docker"].Healthy)
+	assert.Equal(t, 1, summary.Datacenters["dc1"].Checks["docker"].Unhealthy)
+	assert.Equal(t, 1, summary.Datacenters["dc2"].Nodes)
+
+	// A released cordon shows up on the next update, without a new action.
+	instanceID = "aggregator-1"
+	defer func() { instanceID = "" }()
+	rec1.recordAction(false, "docker is Unhealthy: docker daemon is down", now)
+	a.status.recordAction("node-1", rec1)
+	status, _ := a.status.get("node-1")
+	assert.Equal(t, "aggregator-1", status.CordonOwner)
+	rec1.Cordoned, rec1.CordonOwner = false, ""
+	a.status.update(&api.Node{ID: "node-1", Datacenter: "dc1", SchedulingEligibility: "eligible"}, "10.0.0.1", policy, rec1)
+	status, _ = a.status.get("node-1")
+	assert.Equal(t, "", status.CordonOwner)
+
+	// Restored nodes keep their address and datacenter until they are polled again.
+	rec3 := newNodeRecord()
+	rec3.Address, rec3.Datacenter = "10.0.0.3", "dc2"
+	a.status.restore("node-3", policy, rec3)
+	status, _ = a.status.get("node-3")
+	assert.Equal(t, "10.0.0.3", status.Address)
+	assert.Equal(t, 2, a.status.summary().Datacenters["dc2"].Nodes)
+}
+
+// TestAdminEndpoints test the /v1/admin/ HTTP endpoints and the persistence of admin state.
+func TestAdminEndpoints(t *testing.T) {
+	// The file name is kept across releases, the state of older aggregators must load.
+	dir := t.TempDir()
+	path := adminStatePath(dir)
+	assert.Equal(t, filepath.Join(dir, "admin.json"), path)
+	store, err := loadAdminStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAggregator(&aggregator{admin: store})
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+
+	mux := http.NewServeMux()
+	a.registerAdminHandlers(mux)
+
+	do := func(method, url, body string, authorized bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if authorized {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(adminToken)))
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("POST", "/v1/admin/pause", "", false).Code)
+
+	assert.Equal(t, http.StatusOK, do("POST", "/v1/admin/pause?datacenter=dc2", "", true).Code)
+	assert.False(t, store.isPaused("dc1"))
+	assert.True(t, store.isPaused("dc2"))
+
+	assert.Equal(t, http.StatusOK, do("POST", "/v1/admin/exclusions", `{"node_id": "node-1", "ttl": "1h"}`, true).Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/v1/admin/exclusions", `{"check": "docker"}`, true).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/v1/admin/exclusions", `{}`, true).Code)
+	assert.True(t, store.nodeExcluded("node-1"))
+	assert.False(t, store.nodeExcluded("node-2"))
+	assert.True(t, store.checkExcluded("node-2", "docker"))
+	assert.False(t, store.checkExcluded("node-2", "ntp"))
+
+	// Admin state should survive a restart.
+	restored, err := loadAdminStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, restored.isPaused("dc2"))
+	assert.True(t, restored.nodeExcluded("node-1"))
+
+	// Expired exclusions should be removed.
+	store.expire(time.Now().Add(2 * time.Hour))
+	assert.False(t, store.nodeExcluded("node-1"))
+	assert.True(t, store.checkExcluded("node-1", "docker"))
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/v1/admin/exclusions?check=docker", "", true).Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/v1/admin/exclusions?check=docker", "", true).Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/v1/admin/resume?datacenter=dc2", "", true).Code)
+	assert.False(t, store.isPaused("dc2"))
+}
+
+// TestNodePolicy test merging --enforce-health-check with the npd.* node meta keys.
+func TestNodePolicy(t *testing.T) {
+	a := &aggregator{enforcedChecks: map[string]bool{"docker": true, "portworx": true}}
+
+	policy := a.nodePolicy("node-1", map[string]string{})
+	assert.False(t, policy.Ignore)
+	assert.Equal(t, []string{"docker", "portworx"}, policy.Enforce)
+	assert.Nil(t, policy.Overrides)
+
+	policy = a.nodePolicy("node-1", map[string]string{
+		metaEnforce:   "ntp, CPUUnderPressure,",
+		metaUnenforce: "portworx",
+	})
+	assert.Equal(t, []string{"CPUUnderPressure", "docker", "ntp"}, policy.Enforce)
+	assert.Equal(t, "portworx", policy.Overrides[metaUnenforce])
+
+	policy = a.nodePolicy("node-1", map[string]string{metaIgnore: "true"})
+	assert.True(t, policy.Ignore)
+
+	policy = a.nodePolicy("node-1", map[string]string{metaIgnore: "yes please"})
+	assert.False(t, policy.Ignore)
+}
+
+// TestNodeMetaUpdate test the dynamic node meta published for failing health checks.
+func TestNodeMetaUpdate(t *testing.T) {
+	checks := []types.HealthCheck{
+		{Type: "docker", Result: "Unhealthy"},
+		{Type: "DiskUsageHigh", Result: "false"},
+	}
+
+	update := nodeMetaUpdate(map[string]string{"npd.enforce": "docker"}, checks)
+	assert.Len(t, update, 2)
+	assert.Equal(t, "Unhealthy", *update["npd.problem.docker"])
+	assert.Equal(t, "false", *update["npd.healthy"])
+
+	// Nothing to update, if node meta is already up to date.
+	meta := map[string]string{"npd.problem.docker": "Unhealthy", "npd.healthy": "false"}
+	assert.Nil(t, nodeMetaUpdate(meta, checks))
+
+	// Resolved problems are removed.
+	checks[0].Result = "Healthy"
+	update = nodeMetaUpdate(meta, checks)
+	assert.Len(t, update, 2)
+	assert.Nil(t, update["npd.problem.docker"])
+	assert.Equal(t, "true", *update["npd.healthy"])
+}
+
+// TestStateStore test that the aggregator state survives a restart.
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instanceID = "aggregator-1"
+	defer func() { instanceID = "" }()
+
+	start := time.Now()
+	rec := newNodeRecord()
+	for i := 0; i < 3; i++ {
+		rec.observe([]types.HealthCheck{
+			{Type: "docker", Result: "Unhealthy"},
+			{Type: "ntp", Result: "Healthy"},
+		}, start.Add(time.Duration(i)*time.Minute))
+	}
+	rec.recordAction(false, "docker is Unhealthy", start)
+
+	assert.Nil(t, store.saveNode("node-1", rec))
+	assert.Nil(t, store.saveNode("node-2", newNodeRecord()))
+	assert.Nil(t, store.deleteNode("node-2"))
+	assert.Nil(t, store.Close())
+
+	store, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	records, err := store.loadNodes()
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+
+	restored := records["node-1"]
+	assert.True(t, restored.Cordoned)
+	assert.Equal(t, "aggregator-1", restored.CordonOwner)
+	assert.Equal(t, 3, restored.Failures["docker"])
+	assert.Equal(t, 0, restored.Failures["ntp"])
+	assert.True(t, restored.FailingSince["docker"].Equal(start))
+	assert.Len(t, restored.Checks, 2)
+
+	// Counters are reset once the health check recovers.
+	restored.observe([]types.HealthCheck{{Type: "docker", Result: "Healthy"}}, time.Now())
+	assert.Equal(t, 0, restored.Failures["docker"])
+	assert.True(t, restored.FailingSince["docker"].IsZero())
+}
+
+// TestAuditLog test writing, rotating and querying the audit log.
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditLog(path, 1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	for i := 0; i < 20; i++ {
+		action := "ineligible"
+		if i%2 == 1 {
+			action = "eligible"
+		}
+		a.audit(&types.AuditEvent{
+			NodeID: "node-" + strconv.Itoa(i%4),
+			Action: action,
+			Reason: "docker is Unhealthy: docker daemon is down",
+			Result: types.AuditResultSuccess,
+		})
+	}
+
+	_, err = os.Stat(path + ".1")
+	assert.Nil(t, err, "audit log should be rotated")
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only 2 rotated audit logs should be kept")
+
+	events, err := a.query(auditFilter{nodeID: "node-2"})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, events)
+	for _, e := range events {
+		assert.Equal(t, "node-2", e.NodeID)
+		assert.Equal(t, "ineligible", e.Action)
+	}
+
+	mux := http.NewServeMux()
+	newTestAggregator(&aggregator{auditLog: a}).registerAPIHandlers(mux)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/audit?action=eligible&limit=3", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	events = []types.AuditEvent{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, events, 3)
+	assert.Equal(t, "node-3", events[2].NodeID, "most recent events should be returned")
+
+	// A line longer than maxAuditLineSize is skipped, not failing the query.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"node_id":"` + strings.Repeat("x", maxAuditLineSize) + `"}` + "\n")
+	f.Close()
+	a.size += maxAuditLineSize + 16
+	a.audit(&types.AuditEvent{NodeID: "node-5", Action: "eligible", Result: types.AuditResultSuccess})
+
+	events, err = a.query(auditFilter{limit: 2})
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "node-5", events[1].NodeID)
+}
+
+// TestPlan test a dry run aggregation cycle against a fake Nomad API and detector.
+func TestPlan(t *testing.T) {
+	detector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/nodehealth/" {
+			json.NewEncoder(w).Encode([]types.HealthCheck{
+				{Type: "docker", Result: "Unhealthy", Message: "docker is down"},
+			})
+		}
+	}))
+	defer detector.Close()
+
+	toggled := false
+	nomad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/nodes":
+			json.NewEncoder(w).Encode([]*api.NodeListStub{
+				{ID: "node-1", Address: "127.0.0.1", Datacenter: "dc1", SchedulingEligibility: "eligible"},
+				{ID: "node-2", Address: "127.0.0.2", Datacenter: "dc1", SchedulingEligibility: "ineligible"},
+			})
+		case "/v1/node/node-1":
+			json.NewEncoder(w).Encode(&api.Node{ID: "node-1", Datacenter: "dc1"})
+		default:
+			toggled = true
+		}
+	}))
+	defer nomad.Close()
+
+	client, err := getNomadClient(nomad.URL)
+	assert.Nil(t, err)
+
+	a := newTestAggregator(&aggregator{
+		enforcedChecks:      map[string]bool{"docker": true},
+		detectorDCs:         map[string]bool{"dc1": true},
+		nodes:               &nomadCluster{client: client},
+		detector:            &httpDetector{port: detector.URL[strings.LastIndex(detector.URL, ":"):]},
+		actuator:            &nomadCluster{client: client},
+		records:             make(map[string]*nodeRecord),
+		thresholdPercentage: 10,
+		dryRun:              true,
+	})
+
+	results, err := a.runCycle()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.False(t, toggled)
+
+	report := newPlanReport(false, results)
+	assert.Equal(t, 1, report.Cordon)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, types.AuditResultPlanned, results[0].Event.Result)
+	assert.Equal(t, "docker is Unhealthy: docker is down", results[0].Event.Reason)
+	assert.Equal(t, "node is ineligible", results[1].Skipped)
+
+	var out strings.Builder
+	assert.Nil(t, writePlan(&out, "table", report))
+	assert.Contains(t, out.String(), "Plan: 1 to cordon, 0 to uncordon, 0 deferred by threshold, 0 not enforced, 1 skipped.")
+
+	// Below the threshold, the node is not taken out of the scheduling pool.
+	a.records = make(map[string]*nodeRecord)
+	a.thresholdPercentage = 90
+	results, err = a.runCycle()
+	assert.Nil(t, err)
+	assert.Equal(t, types.AuditResultBlocked, results[0].Event.Result)
+}
+
+// TestThreshold test the per scope threshold accounting, in nodes and capacity mode.
+func TestThreshold(t *testing.T) {
+	big := &api.NodeResources{Cpu: api.NodeCpuResources{CpuShares: 64000}, Memory: api.NodeMemoryResources{MemoryMB: 256000}}
+	small := &api.NodeResources{Cpu: api.NodeCpuResources{CpuShares: 4000}, Memory: api.NodeMemoryResources{MemoryMB: 16000}}
+	reserved := &api.NodeReservedResources{Cpu: api.NodeReservedCpuResources{CpuShares: 1000}, Memory: api.NodeReservedMemoryResources{MemoryMB: 1000}}
+
+	assert.Equal(t, resources{CPU: 3000, MemoryMB: 15000}, allocatable(small, reserved))
+	assert.Equal(t, resources{}, allocatable(nil, reserved))
+
+	stub := func(id, dc, pool, class, status string, r *api.NodeResources) *nodeStub {
+		return &nodeStub{
+			NodeListStub: api.NodeListStub{ID: id, Datacenter: dc, NodeClass: class, SchedulingEligibility: "eligible", Status: status, NodeResources: r},
+			NodePool:     pool,
+		}
+	}
+	nodes := []*nodeStub{
+		stub("big", "dc1", "default", "large", "ready", big),
+		stub("small-1", "dc1", "default", "", "ready", small),
+		stub("small-2", "dc1", "default", "", "ready", small),
+		stub("small-3", "dc1", "default", "", "ready", small),
+		stub("small-4", "dc1", "default", "", "ready", small),
+		stub("small-5", "dc1", "default", "", "down", small),
+		stub("dc2-1", "dc2", "batch", "", "ready", small),
+		stub("dc2-2", "dc2", "batch", "", "ready", small),
+	}
+
+	dims, err := parseThresholdScope([]string{scopeDatacenter, scopeNodeClass})
+	assert.Nil(t, err)
+
+	threshold := newThresholdAccounting(thresholdModeCapacity, 80, dims, nil)
+	for _, node := range nodes {
+		threshold.add(node, allocatable(node.NodeResources, node.ReservedResources))
+	}
+
+	// The only node of a class can't be taken out.
+	state := threshold.state("big")
+	assert.Equal(t, "datacenter=dc1,node_class=large", state.Scope)
+	assert.False(t, state.Above)
+
+	// Down nodes don't provide capacity: 4 of 5 small nodes are eligible.
+	state = threshold.state("small-1")
+	assert.Equal(t, "datacenter=dc1,node_class=", state.Scope)
+	assert.Equal(t, int64(16000), state.EligibleCPU)
+	assert.Equal(t, int64(20000), state.TotalCPU)
+	assert.False(t, state.Above)
+
+	threshold.toggled("small-5", true)
+	assert.True(t, threshold.state("small-1").Above)
+	threshold.toggled("small-1", false)
+	assert.False(t, threshold.state("small-2").Above)
+
+	// In nodes mode, scopes only account for their own nodes, and can be overridden.
+	dims, err = parseThresholdScope([]string{scopeDatacenter, scopeNodePool, scopeNodeClass})
+	assert.Nil(t, err)
+
+	_, err = parseThresholdOverride("os=linux:50", dims)
+	assert.NotNil(t, err)
+	_, err = parseThresholdOverride("datacenter=dc2:101", dims)
+	assert.NotNil(t, err)
+
+	dc2, err := parseThresholdOverride("datacenter=dc2:90", dims)
+	assert.Nil(t, err)
+	batch, err := parseThresholdOverride("datacenter=dc2,node_pool=batch:40", dims)
+	assert.Nil(t, err)
+
+	threshold = newThresholdAccounting(thresholdModeNodes, 80, dims, []thresholdOverride{batch, dc2})
+	for _, node := range nodes {
+		threshold.add(node, resources{})
+	}
+	state = threshold.state("small-1")
+	assert.Equal(t, "datacenter=dc1,node_pool=default,node_class=", state.Scope)
+	assert.Equal(t, 5, state.EligibleNodes)
+	assert.True(t, state.Above)
+
+	state = threshold.state("dc2-1")
+	assert.Equal(t, 40, state.Percentage)
+	assert.Equal(t, 2, state.TotalNodes)
+	assert.True(t, state.Above)
+
+	assert.False(t, threshold.state("unknown").Above)
+	assert.Equal(t, "node is out of threshold scope", thresholdError(threshold.state("unknown")))
+
+	// With a cluster scope, all nodes share the same threshold.
+	dims, err = parseThresholdScope([]string{scopeCluster})
+	assert.Nil(t, err)
+	threshold = newThresholdAccounting(thresholdModeNodes, 80, dims, nil)
+	for _, node := range nodes {
+		threshold.add(node, resources{})
+	}
+	state = threshold.state("big")
+	assert.Equal(t, scopeCluster, state.Scope)
+	assert.Equal(t, 8, state.EligibleNodes)
+}
+
+// TestCordonCandidates test that the worst nodes are cordoned first, when the threshold only allows some cordons.
+func TestCordonCandidates(t *testing.T) {
+	severities, err := parseCheckSeverity([]string{"kernel=10"})
+	assert.Nil(t, err)
+	a := newTestAggregator(&aggregator{checkSeverities: severities, dryRun: true})
+
+	_, err = parseCheckSeverity([]string{"kernel"})
+	assert.NotNil(t, err)
+
+	now := time.Now()
+	threshold := newThresholdAccounting(thresholdModeNodes, 50, nil, nil)
+	candidate := func(id string, since time.Duration, checks ...string) *cordonCandidate {
+		threshold.add(&nodeStub{NodeListStub: api.NodeListStub{ID: id, SchedulingEligibility: "eligible"}}, resources{})
+
+		rec := newNodeRecord()
+		event := &types.AuditEvent{NodeID: id, Action: eligibilityString(false)}
+		for _, check := range checks {
+			event.Checks = append(event.Checks, types.HealthCheck{Type: check, Result: "Unhealthy"})
+			rec.FailingSince[check] = now.Add(-since)
+		}
+		return a.newCordonCandidate(id, rec, event)
+	}
+
+	candidates := []*cordonCandidate{
+		candidate("node-1", time.Minute, "docker"),
+		candidate("node-2", time.Minute, "kernel"),
+		candidate("node-3", time.Minute, "docker", "disk"),
+		candidate("node-4", time.Hour, "docker"),
+	}
+
+	a.cordonCandidates(candidates, threshold)
+
+	var order []string
+	for _, c := range candidates {
+		order = append(order, c.nodeID)
+	}
+	assert.Equal(t, []string{"node-2", "node-3", "node-4", "node-1"}, order)
+	assert.Equal(t, 10, candidates[0].event.Severity)
+
+	// 4 eligible nodes, with a 50% threshold: only 2 nodes can be cordoned.
+	assert.Equal(t, types.AuditResultPlanned, candidates[0].event.Result)
+	assert.Equal(t, types.AuditResultPlanned, candidates[1].event.Result)
+	assert.Equal(t, types.AuditResultBlocked, candidates[2].event.Result)
+	assert.Equal(t, 3, candidates[2].event.Rank)
+	assert.True(t, candidates[2].rec.Deferred)
+	assert.True(t, candidates[3].rec.Deferred)
+}
+
+// TestDetectorUnreachable test the DetectorUnreachable health check, and the detector coverage.
+func TestDetectorUnreachable(t *testing.T) {
+	// Nothing listens on the detector port.
+	detector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	detectorPort := detector.URL[strings.LastIndex(detector.URL, ":"):]
+	detector.Close()
+
+	nomad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/nodes":
+			json.NewEncoder(w).Encode([]*api.NodeListStub{
+				{ID: "unreachable-1", Address: "127.0.0.1", Datacenter: "dc1", SchedulingEligibility: "eligible"},
+				{ID: "unreachable-2", Address: "127.0.0.1", Datacenter: "dc1", SchedulingEligibility: "eligible"},
+			})
+		case "/v1/node/unreachable-1", "/v1/node/unreachable-2":
+			json.NewEncoder(w).Encode(&api.Node{ID: strings.TrimPrefix(r.URL.Path, "/v1/node/"), Datacenter: "dc1", SchedulingEligibility: "eligible"})
+		}
+	}))
+	defer nomad.Close()
+
+	client, err := getNomadClient(nomad.URL)
+	assert.Nil(t, err)
+
+	a := newTestAggregator(&aggregator{
+		enforcedChecks:      map[string]bool{types.DetectorUnreachable: true},
+		detectorDCs:         map[string]bool{"dc1": true},
+		nodes:               &nomadCluster{client: client},
+		detector:            &httpDetector{port: detectorPort},
+		actuator:            &nomadCluster{client: client},
+		records:             make(map[string]*nodeRecord),
+		thresholdPercentage: 10,
+		unreachableCycles:   2,
+		dryRun:              true,
+	})
+
+	// The last health checks reported by the detector are kept while it is unreachable.
+	last := newNodeRecord()
+	last.observe([]types.HealthCheck{{Type: "docker", Result: "Unhealthy"}}, time.Now())
+	a.records["unreachable-1"] = last
+
+	results, err := a.runCycle()
+	assert.Nil(t, err)
+	assert.Contains(t, results[0].Skipped, "NNPD detector server is not active")
+	assert.Equal(t, 1, a.records["unreachable-1"].Detector.UnreachableCycles)
+
+	results, err = a.runCycle()
+	assert.Nil(t, err)
+	assert.Equal(t, "", results[0].Skipped)
+	assert.Equal(t, types.AuditResultPlanned, results[0].Event.Result)
+	assert.Equal(t, types.DetectorUnreachable, results[0].Event.Checks[0].Type)
+	assert.False(t, results[0].Event.Checks[0].FailingSince.IsZero())
+	assert.Equal(t, []types.HealthCheck{{Type: "docker", Result: "Unhealthy"}}, a.records["unreachable-1"].Checks)
+	status, _ := a.status.get("unreachable-1")
+	assert.Equal(t, "docker", status.Checks[0].Type)
+	assert.False(t, status.Detector.Reachable)
+
+	coverage := a.status.coverage()
+	var uncovered []string
+	for _, status := range coverage.Uncovered {
+		uncovered = append(uncovered, status.ID)
+	}
+	assert.Contains(t, uncovered, "unreachable-1")
+	assert.True(t, coverage.Uncovered[0].Detector.LastContact.IsZero())
+
+	// A reachable detector reports a healthy DetectorUnreachable health check.
+	rec := newNodeRecord()
+	rec.detectorReachable(time.Now())
+	assert.Equal(t, "Healthy", detectorCheck(rec, 2, time.Now()).Result)
+}
+
+// TestFlapDetection test flap detection and the quarantine backoff.
+func TestFlapDetection(t *testing.T) {
+	f := &flapPolicy{window: time.Hour, threshold: 2, base: 10 * time.Minute, max: time.Hour}
+	assert.Equal(t, 10*time.Minute, f.quarantinePeriod(0))
+	assert.Equal(t, 40*time.Minute, f.quarantinePeriod(2))
+	assert.Equal(t, time.Hour, f.quarantinePeriod(5))
+
+	rec := newNodeRecord()
+	now := time.Now()
+
+	// No transition on the first cycle.
+	assert.False(t, rec.observeFlaps(f, true, false, now))
+	assert.False(t, rec.observeFlaps(f, false, true, now.Add(time.Minute)))
+	assert.False(t, rec.observeFlaps(f, true, true, now.Add(2*time.Minute)))
+	assert.Equal(t, 2, len(rec.Transitions))
+
+	// Third transition within the window: quarantined.
+	assert.True(t, rec.observeFlaps(f, false, true, now.Add(3*time.Minute)))
+	assert.True(t, rec.quarantined(now.Add(4*time.Minute)))
+	assert.Equal(t, now.Add(13*time.Minute), rec.QuarantineUntil)
+
+	// Transitions during the quarantine don't extend it.
+	assert.False(t, rec.observeFlaps(f, true, true, now.Add(5*time.Minute)))
+	assert.True(t, rec.quarantineExpired(now.Add(13*time.Minute)))
+
+	// Transitions out of the window are forgotten.
+	rec.Quarantined = false
+	assert.False(t, rec.observeFlaps(f, false, true, now.Add(20*time.Minute)))
+	assert.False(t, rec.observeFlaps(f, true, true, now.Add(90*time.Minute)))
+	assert.Equal(t, 1, len(rec.Transitions))
+
+	// Flapping again: the quarantine doubles.
+	rec.observeFlaps(f, false, true, now.Add(91*time.Minute))
+	assert.True(t, rec.observeFlaps(f, true, true, now.Add(92*time.Minute)))
+	assert.Equal(t, now.Add(112*time.Minute), rec.QuarantineUntil)
+	assert.Equal(t, 2, rec.Quarantines)
+
+	// Stable for a whole window after the quarantine: the backoff is reset.
+	rec.Quarantined = false
+	rec.observeFlaps(f, true, true, now.Add(200*time.Minute))
+	assert.Equal(t, 0, rec.Quarantines)
+
+	// Flap detection is disabled.
+	rec = newNodeRecord()
+	f.threshold = 0
+	for i := 0; i < 10; i++ {
+		assert.False(t, rec.observeFlaps(f, i%2 == 0, true, now))
+	}
+}
+
+// TestMaintenanceWindows test maintenance windows, from the config file and the admin API.
+func TestMaintenanceWindows(t *testing.T) {
+	_, err := compileWindow(types.MaintenanceWindow{ID: "no-schedule"}, maintenanceSourceAdmin)
+	assert.NotNil(t, err)
+	_, err = compileWindow(types.MaintenanceWindow{ID: "bad-duration", Schedule: "0 2 * * *"}, maintenanceSourceAdmin)
+	assert.NotNil(t, err)
+
+	// Every day from 02:00 to 04:00 UTC, for docker on dc1.
+	nightly, err := compileWindow(types.MaintenanceWindow{
+		ID:          "nightly",
+		Schedule:    "0 2 * * *",
+		Duration:    "2h",
+		Datacenters: []string{"dc1"},
+		Checks:      []string{"docker"},
+	}, maintenanceSourceConfig)
+	assert.Nil(t, err)
+
+	day := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	assert.False(t, nightly.active(day.Add(time.Hour)))
+	assert.True(t, nightly.active(day.Add(2*time.Hour)))
+	assert.True(t, nightly.active(day.Add(3*time.Hour+59*time.Minute)))
+	assert.False(t, nightly.active(day.Add(4*time.Hour)))
+	assert.True(t, nightly.appliesTo("dc1", "gpu"))
+	assert.False(t, nightly.appliesTo("dc2", "gpu"))
+	assert.True(t, nightly.covers("docker"))
+	assert.False(t, nightly.covers("ntp"))
+
+	path := filepath.Join(t.TempDir(), "maintenance.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"windows": [{"id": "nightly", "schedule": "0 2 * * *", "duration": "2h"}]}`), 0644))
+	configWindows, err := loadMaintenanceConfig(path)
+	assert.Nil(t, err)
+
+	store, err := loadAdminStore(filepath.Join(t.TempDir(), "admin.json"))
+	assert.Nil(t, err)
+	a := newTestAggregator(&aggregator{admin: store, configWindows: configWindows})
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+
+	mux := http.NewServeMux()
+	a.registerAdminHandlers(mux)
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(adminToken)))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	now := time.Now().UTC()
+	patch := fmt.Sprintf(`{"id": "patch", "start": %q, "end": %q, "node_classes": ["gpu"]}`,
+		now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339))
+	assert.Equal(t, http.StatusOK, do("POST", "/v1/admin/maintenance", patch).Code)
+	assert.Equal(t, http.StatusConflict, do("POST", "/v1/admin/maintenance", `{"id": "nightly", "schedule": "0 3 * * *", "duration": "1h"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/v1/admin/maintenance", `{"id": "invalid", "schedule": "not a cron"}`).Code)
+
+	windows := a.nodeMaintenance(now, "dc1", "gpu")
+	assert.Equal(t, 1, len(windows))
+	assert.Equal(t, "patch", windows[0].ID)
+	assert.NotNil(t, maintenanceCovers(windows, "docker"))
+	assert.Equal(t, 0, len(a.nodeMaintenance(now, "dc1", "")))
+
+	rr := do("GET", "/v1/admin/maintenance", "")
+	statuses := []maintenanceWindowStatus{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &statuses))
+	assert.Equal(t, 2, len(statuses))
+	assert.Equal(t, maintenanceSourceConfig, statuses[0].Source)
+	assert.True(t, statuses[1].Active)
+
+	// Absolute windows are removed once over.
+	store.expire(now.Add(2 * time.Hour))
+	assert.Equal(t, 0, len(store.snapshot().MaintenanceWindows))
+	assert.Equal(t, 0, len(store.maintenanceWindows()))
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/v1/admin/maintenance?id=patch", "").Code)
+}
+
+// testTimeline is a timeline of 3 aggregation cycles: node-1 gets unhealthy, and
+// healthy again, and the detector of node-2 is unreachable.
+const testTimeline = `{"type": "nodes", "time": "2021-06-01T00:00:00Z", "nodes": [
+	{"ID": "node-1", "Address": "10.0.0.1", "Datacenter": "dc1", "SchedulingEligibility": "eligible"},
+	{"ID": "node-2", "Address": "10.0.0.2", "Datacenter": "dc1", "SchedulingEligibility": "eligible"}]}
+{"type": "node", "time": "2021-06-01T00:00:00Z", "node": {"ID": "node-1", "Datacenter": "dc1", "Meta": {"npd.enforce": "docker"}}}
+{"type": "node_health", "time": "2021-06-01T00:00:00Z", "node_id": "node-1", "address": "10.0.0.1", "health": [{"type": "docker", "result": "Healthy"}]}
+{"type": "node_health", "time": "2021-06-01T00:00:00Z", "node_id": "node-2", "address": "10.0.0.2", "error": "connection refused"}
+{"type": "nodes", "time": "2021-06-01T00:00:15Z", "nodes": [
+	{"ID": "node-1", "Address": "10.0.0.1", "Datacenter": "dc1", "SchedulingEligibility": "eligible"},
+	{"ID": "node-2", "Address": "10.0.0.2", "Datacenter": "dc1", "SchedulingEligibility": "eligible"}]}
+{"type": "node_health", "time": "2021-06-01T00:00:15Z", "node_id": "node-1", "address": "10.0.0.1", "health": [{"type": "docker", "result": "Unhealthy", "message": "docker is down"}]}
+{"type": "nodes", "time": "2021-06-01T00:00:30Z", "nodes": [
+	{"ID": "node-1", "Address": "10.0.0.1", "Datacenter": "dc1", "SchedulingEligibility": "eligible"},
+	{"ID": "node-2", "Address": "10.0.0.2", "Datacenter": "dc1", "SchedulingEligibility": "eligible"}]}
+{"type": "node_health", "time": "2021-06-01T00:00:30Z", "node_id": "node-1", "address": "10.0.0.1", "health": [{"type": "docker", "result": "Healthy"}]}
+`
+
+// TestSimulate test replaying a timeline through the aggregator decisions.
+func TestSimulate(t *testing.T) {
+	cycles, err := readTimeline(strings.NewReader(testTimeline))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(cycles))
+
+	_, err = readTimeline(strings.NewReader(`{"type": "node_health", "address": "10.0.0.1"}`))
+	assert.NotNil(t, err)
+
+	a := newTestAggregator(&aggregator{
+		detectorDCs:         map[string]bool{"dc1": true},
+		records:             make(map[string]*nodeRecord),
+		thresholdPercentage: 10,
+	})
+	actions := testutil.ToFloat64(actionsCounter.With(prometheus.Labels{"dc": a.datacenter, "action": eligibilityString(false), "outcome": types.AuditResultSuccess}))
+	report, err := runSimulation(a, cycles)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Cycles)
+
+	// Simulated actions are not counted in the metrics.
+	assert.Equal(t, actions, testutil.ToFloat64(actionsCounter.With(prometheus.Labels{"dc": a.datacenter, "action": eligibilityString(false), "outcome": types.AuditResultSuccess})))
+	assert.Equal(t, 1, report.Cordon)
+	assert.Equal(t, 1, report.Uncordon)
+	assert.Equal(t, 2, len(report.Events))
+
+	// The simulation clock follows the timeline.
+	assert.Equal(t, "node-1", report.Events[0].NodeID)
+	assert.Equal(t, eligibilityString(false), report.Events[0].Action)
+	assert.Equal(t, types.AuditResultSuccess, report.Events[0].Result)
+	assert.Equal(t, cycles[1].time, report.Events[0].Timestamp)
+	assert.Equal(t, eligibilityString(true), report.Events[1].Action)
+
+	var out strings.Builder
+	assert.Nil(t, writeSimulation(&out, "table", report))
+	assert.Contains(t, out.String(), "Simulation: 3 cycles, 1 cordons, 1 uncordons, 0 deferred by threshold, 0 not enforced.")
+}
+
+// TestRecorder test recording a timeline, with redacted fields and rotation.
+func TestRecorder(t *testing.T) {
+	cycles, err := readTimeline(strings.NewReader(testTimeline))
+	assert.Nil(t, err)
+
+	_, err = parseRedact([]string{"password"})
+	assert.NotNil(t, err)
+	redact, err := parseRedact([]string{redactMessage, redactAddress})
+	assert.Nil(t, err)
+
+	// Record a replay of the timeline, rotating the recording after every cycle.
+	r := newReplay()
+	a := newTestAggregator(&aggregator{
+		detectorDCs:         map[string]bool{"dc1": true},
+		nodes:               r,
+		detector:            r,
+		actuator:            r,
+		records:             make(map[string]*nodeRecord),
+		thresholdPercentage: 10,
+	})
+	dir := t.TempDir()
+	rec, err := openRecorder(a, dir, 1, 2, redact, []byte("key"))
+	assert.Nil(t, err)
+	for _, cycle := range cycles {
+		r.next(cycle)
+		_, err := a.runCycle()
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, rec.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "timeline-*.jsonl.gz"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+
+	var recorded []*timelineCycle
+	for _, file := range files {
+		c, err := readTimelineFile(file)
+		assert.Nil(t, err)
+		recorded = append(recorded, c...)
+	}
+	assert.Equal(t, 2, len(recorded))
+
+	// Addresses are replaced with a stable pseudonym, and messages are redacted.
+	address := rec.pseudonym("10.0.0.1")
+	assert.Equal(t, address, recorded[0].nodes[0].Address)
+	assert.Equal(t, "Unhealthy", recorded[0].health[address].Health[0].Result)
+	assert.Equal(t, "redacted", recorded[0].health[address].Health[0].Message)
+	assert.Equal(t, "node-1", recorded[0].health[address].NodeID)
+	assert.Equal(t, "no node health recorded", recorded[0].health[rec.pseudonym("10.0.0.2")].Error)
+
+	// Node info is recorded again in every file.
+	assert.Equal(t, "docker", recorded[1].infos["node-1"].Meta["npd.enforce"])
+}
+
+// TestRecorderRedaction test that no node address or name is left in a
+// timeline recorded with the address and name redacted.
+func TestRecorderRedaction(t *testing.T) {
+	timeline := `{"type": "nodes", "time": "2021-06-01T00:00:00Z", "nodes": [
+	{"ID": "node-1", "Address": "10.1.2.3", "Name": "worker-7.example.com", "Datacenter": "dc1", "SchedulingEligibility": "eligible",
+	 "NodeResources": {"Cpu": {"CpuShares": 4000}, "Networks": [{"Device": "eth0", "CIDR": "10.1.2.3/32", "IP": "10.1.2.3"}]}}]}
+{"type": "node", "time": "2021-06-01T00:00:00Z", "node": {"ID": "node-1", "Name": "worker-7.example.com", "Datacenter": "dc1", "HTTPAddr": "10.1.2.3:4646",
+	"Attributes": {"unique.network.ip-address": "10.1.2.3", "unique.hostname": "worker-7.example.com", "unique.platform.aws.local-ipv4": "10.1.2.3", "unique.platform.aws.local-hostname": "worker-7.example.com", "os.name": "ubuntu"},
+	"Links": {"consul": "dc1.worker-7.example.com"},
+	"Resources": {"Networks": [{"Device": "eth0", "CIDR": "10.1.2.3/32", "IP": "10.1.2.3"}]},
+	"NodeResources": {"Networks": [{"Device": "eth0", "CIDR": "10.1.2.3/32", "IP": "10.1.2.3"}]}}}
+{"type": "node_health", "time": "2021-06-01T00:00:00Z", "node_id": "node-1", "address": "10.1.2.3", "health": [{"type": "docker", "result": "Healthy"}]}
+`
+	cycles, err := readTimeline(strings.NewReader(timeline))
+	assert.Nil(t, err)
+	redact, err := parseRedact([]string{redactAddress, redactName})
+	assert.Nil(t, err)
+
+	r := newReplay()
+	a := newTestAggregator(&aggregator{
+		detectorDCs:         map[string]bool{"dc1": true},
+		nodes:               r,
+		detector:            r,
+		actuator:            r,
+		records:             make(map[string]*nodeRecord),
+		thresholdPercentage: 10,
+		thresholdMode:       thresholdModeCapacity,
+	})
+	dir := t.TempDir()
+	rec, err := openRecorder(a, dir, 0, 2, redact, nil)
+	assert.Nil(t, err)
+	r.next(cycles[0])
+	_, err = a.runCycle()
+	assert.Nil(t, err)
+	assert.Nil(t, rec.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "timeline-*.jsonl.gz"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	f, err := os.Open(files[0])
+	assert.Nil(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+
+	assert.Contains(t, string(data), rec.pseudonym("10.1.2.3"))
+	assert.Contains(t, string(data), "ubuntu")
+	assert.NotContains(t, string(data), "10.1.2.3")
+	assert.NotContains(t, string(data), "worker-7")
+
+	// Pseudonyms only match within a key.
+	other := &recorder{redactKey: []byte("key")}
+	assert.Equal(t, other.pseudonym("10.1.2.3"), (&recorder{redactKey: []byte("key")}).pseudonym("10.1.2.3"))
+	assert.NotEqual(t, other.pseudonym("10.1.2.3"), rec.pseudonym("10.1.2.3"))
+}
+
+// TestHistory test the health check history store, its queries and reports.
+func TestHistory(t *testing.T) {
+	h, err := openHistoryStore(filepath.Join(t.TempDir(), "history.db"), 24*time.Hour, 3)
+	assert.Nil(t, err)
+	defer h.Close()
+
+	now := time.Now()
+	start := now.Add(-2 * time.Hour)
+	healthy := map[string]types.HealthCheck{"docker": {Type: "docker", Result: "Healthy"}, "ntp": {Type: "ntp", Result: "Healthy"}}
+	unhealthy := []types.HealthCheck{{Type: "docker", Result: "Unhealthy", Message: "docker is down"}, {Type: "ntp", Result: "Healthy"}}
+
+	// node-1 docker fails for 10 minutes, twice. node-2 docker fails for 30 minutes.
+	node1 := nodeResult{NodeID: "node-1", NodeAddress: "10.0.0.1", Datacenter: "dc1"}
+	node2 := nodeResult{NodeID: "node-2", NodeAddress: "10.0.0.2", Datacenter: "dc1"}
+	failing := map[string]types.HealthCheck{"docker": unhealthy[0], "ntp": unhealthy[1]}
+	recovered := []types.HealthCheck{healthy["docker"], healthy["ntp"]}
+
+	transitions := checkTransitions(node1, healthy, unhealthy, start)
+	assert.Equal(t, 1, len(transitions))
+	assert.True(t, transitions[0].Failing)
+	assert.Equal(t, "Healthy", transitions[0].From)
+
+	// A health check failing when first observed is a transition, a passing one isn't.
+	first := checkTransitions(node1, map[string]types.HealthCheck{}, unhealthy, start)
+	assert.Equal(t, 1, len(first))
+	assert.Equal(t, "docker", first[0].Check)
+	assert.Equal(t, "", first[0].From)
+	assert.True(t, first[0].Failing)
+	assert.Equal(t, 0, len(checkTransitions(node1, map[string]types.HealthCheck{}, recovered, start)))
+
+	assert.Nil(t, h.record("node-1", transitions))
+	assert.Nil(t, h.record("node-1", checkTransitions(node1, failing, recovered, start.Add(10*time.Minute))))
+	assert.Nil(t, h.record("node-1", checkTransitions(node1, healthy, unhealthy, start.Add(20*time.Minute))))
+	assert.Nil(t, h.record("node-1", checkTransitions(node1, failing, recovered, start.Add(30*time.Minute))))
+	assert.Nil(t, h.record("node-2", checkTransitions(node2, healthy, unhealthy, start)))
+	assert.Nil(t, h.record("node-2", checkTransitions(node2, failing, recovered, start.Add(30*time.Minute))))
+	assert.Nil(t, h.record("node-2", []types.Transition{{Time: now.Add(-48 * time.Hour), NodeID: "node-2", Check: "ntp", To: "Unhealthy", Failing: true}}))
+
+	node1Transitions, err := h.transitions("node-1", now.Add(-defaultHistoryPeriod), now, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(node1Transitions))
+	assert.Equal(t, "docker is down", node1Transitions[0].Message)
+
+	flakiest, err := h.flakiest(now.Add(-defaultHistoryPeriod), now, 20)
+	assert.Nil(t, err)
+	assert.Equal(t, []types.CheckFlakiness{{Check: "docker", Transitions: 6, Nodes: 2}, {Check: "ntp", Transitions: 1, Nodes: 1}}, flakiest)
+
+	recoveries, err := h.recoveries(now.Add(-defaultHistoryPeriod), now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(recoveries))
+	assert.Equal(t, 3, recoveries[0].Recoveries)
+	assert.Equal(t, (50 * time.Minute / 3).Seconds(), recoveries[0].MeanTimeToRecoverSeconds)
+	assert.Equal(t, (30 * time.Minute).Seconds(), recoveries[0].MaxTimeToRecoverSeconds)
+
+	// The ntp transition is past the retention, and node-1 has more than 3 transitions.
+	removed, err := h.prune(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+
+	mux := http.NewServeMux()
+	newTestAggregator(&aggregator{history: h}).registerAPIHandlers(mux)
+
+	req := httptest.NewRequest("GET", "/v1/history/transitions?node_id=node-1&since=24h", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	table, err := newReportTable("transitions", rr.Body.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(table.Rows))
+	assert.Equal(t, "node-1", table.Rows[0][1])
+
+	req = httptest.NewRequest("GET", "/v1/history/flakiest?since=yesterday", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	req = httptest.NewRequest("GET", "/v1/history/mttr", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	table, err = newReportTable("mttr", rr.Body.Bytes())
+	assert.Nil(t, err)
+
+	var out strings.Builder
+	assert.Nil(t, writeReport(&out, "csv", table))
+	assert.Equal(t, "check,recoveries,mean_time_to_recover,max_time_to_recover\ndocker,2,20m0s,30m0s\n", out.String())
+	assert.Equal(t, "16m40.5s", secondsString(1000.5))
+
+	out.Reset()
+	assert.Nil(t, writeReport(&out, "html", table))
+	assert.Contains(t, out.String(), "<td>docker</td>")
+
+	// A health check still failing once its detector is reachable again is
+	// first observed again, but is not a new transition.
+	a := newTestAggregator(&aggregator{history: h})
+	node3 := nodeResult{NodeID: "node-3", NodeAddress: "10.0.0.3", Datacenter: "dc1"}
+	a.recordTransitions("node-3", checkTransitions(node3, healthy, unhealthy, now.Add(-time.Hour)))
+	unreachable := map[string]types.HealthCheck{types.DetectorUnreachable: {Type: types.DetectorUnreachable, Result: "true"}}
+	a.recordTransitions("node-3", checkTransitions(node3, unreachable, unhealthy, now.Add(-30*time.Minute)))
+	node3Transitions, err := h.transitions("node-3", now.Add(-defaultHistoryPeriod), now, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(node3Transitions))
+
+	// A health check which recovered in the history is a transition from its last result.
+	a.recordTransitions("node-3", checkTransitions(node3, failing, recovered, now.Add(-20*time.Minute)))
+	a.recordTransitions("node-3", checkTransitions(node3, unreachable, unhealthy, now.Add(-10*time.Minute)))
+	node3Transitions, err = h.transitions("node-3", now.Add(-defaultHistoryPeriod), now, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(node3Transitions))
+	assert.Equal(t, "Healthy", node3Transitions[2].From)
+}
+
+// TestIncidents test opening, closing, persisting and querying incidents.
+func TestIncidents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store, err := openStateStore(path)
+	assert.Nil(t, err)
+
+	l, err := newIncidentLedger(store)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	start := now.Add(-2 * time.Hour)
+	node1 := nodeResult{NodeID: "node-1", NodeAddress: "10.0.0.1", Datacenter: "dc1"}
+	node2 := nodeResult{NodeID: "node-2", NodeAddress: "10.0.0.2", Datacenter: "dc1"}
+	enforced := func(check string) bool { return check == "docker" }
+
+	// docker fails on node-1, 2 minutes before it is reported.
+	l.observe(node1, []types.HealthCheck{
+		{Type: "docker", Result: "Unhealthy", Message: "docker is down", LastRun: start.Add(-2 * time.Minute)},
+		{Type: "ntp", Result: "Healthy"},
+	}, enforced, start)
+	l.observe(node1, []types.HealthCheck{{Type: "docker", Result: "Unhealthy", Message: "docker is still down"}}, enforced, start.Add(time.Minute))
+	l.recordAction(&types.AuditEvent{NodeID: "node-1", Action: "ineligible", Result: types.AuditResultSuccess,
+		Checks: []types.HealthCheck{{Type: "docker", Result: "Unhealthy"}}}, start.Add(time.Minute))
+
+	// The detector is unreachable, which doesn't close the incident.
+	l.observe(node1, nil, enforced, start.Add(5*time.Minute))
+
+	// docker recovers after 10 minutes, and node-1 is made eligible again.
+	l.observe(node1, []types.HealthCheck{{Type: "docker", Result: "Healthy"}}, enforced, start.Add(10*time.Minute))
+	l.recordAction(&types.AuditEvent{NodeID: "node-1", Action: "eligible", Result: types.AuditResultSuccess}, start.Add(10*time.Minute))
+
+	// kernel fails on node-1, and is removed from the detector config.
+	l.observe(node1, []types.HealthCheck{{Type: "docker", Result: "Healthy"}, {Type: "kernel", Result: "Unhealthy"}}, enforced, start.Add(11*time.Minute))
+	l.observe(node1, []types.HealthCheck{{Type: "docker", Result: "Healthy"}}, enforced, start.Add(12*time.Minute))
+
+	// ntp fails on node-2, which leaves the cluster.
+	l.observe(node2, []types.HealthCheck{{Type: "ntp", Result: "Unhealthy"}}, enforced, start.Add(20*time.Minute))
+	l.closeNode("node-2", "node left the cluster", start.Add(50*time.Minute))
+
+	// docker fails on node-2 since 5 minutes before it is reported, and is still failing.
+	l.observe(node2, []types.HealthCheck{{Type: "docker", Result: "Unhealthy", LastRun: now.Add(-time.Hour),
+		FailingSince: now.Add(-time.Hour - 5*time.Minute)}}, enforced, now.Add(-time.Hour))
+
+	open, err := l.list(incidentFilter{state: "open"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(open))
+	assert.Equal(t, "node-2", open[0].NodeID)
+	assert.True(t, open[0].Enforced)
+	assert.Equal(t, time.Hour.Seconds(), open[0].DurationSeconds)
+	assert.True(t, open[0].StartedAt.Equal(now.Add(-time.Hour-5*time.Minute)))
+
+	closed, err := l.list(incidentFilter{state: "closed", nodeID: "node-1"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(closed))
+	assert.Equal(t, "kernel", closed[1].Check)
+	assert.Equal(t, "health check is no longer reported", closed[1].CloseReason)
+	inc := closed[0]
+	assert.Equal(t, "docker", inc.Check)
+	assert.False(t, inc.Open)
+	assert.Equal(t, "docker is down", inc.FirstMessage)
+	assert.Equal(t, "docker is still down", inc.LastMessage)
+	assert.Equal(t, "health check is passing", inc.CloseReason)
+	assert.Equal(t, (10 * time.Minute).Seconds(), inc.DurationSeconds)
+	assert.Equal(t, 2, len(inc.Actions))
+	assert.Equal(t, "ineligible", inc.Actions[0].Action)
+	assert.Equal(t, "eligible", inc.Actions[1].Action)
+
+	slo, err := l.slo(start.Add(-time.Hour), now)
+	assert.Nil(t, err)
+	assert.Equal(t, []types.IncidentSLO{
+		{Check: "docker", Incidents: 1, MeanTimeToDetectSeconds: 120, P95TimeToDetectSeconds: 120, MeanTimeToRecoverSeconds: 600, P95TimeToRecoverSeconds: 600},
+		{Check: "kernel", Incidents: 1, MeanTimeToRecoverSeconds: 60, P95TimeToRecoverSeconds: 60},
+		{Check: "ntp", Incidents: 1, MeanTimeToRecoverSeconds: 1800, P95TimeToRecoverSeconds: 1800},
+	}, slo)
+
+	// Open incidents are restored from the state store.
+	assert.Nil(t, store.Close())
+	store, err = openStateStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+	l, err = newIncidentLedger(store)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(l.open))
+
+	mux := http.NewServeMux()
+	newTestAggregator(&aggregator{incidents: l}).registerAPIHandlers(mux)
+
+	req := httptest.NewRequest("GET", "/v1/incidents?state=all&check=docker", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var listed []types.Incident
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &listed))
+	assert.Equal(t, 2, len(listed))
+
+	req = httptest.NewRequest("GET", "/v1/incidents?state=resolved", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	req = httptest.NewRequest("GET", "/v1/incidents/slo", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &slo))
+	assert.Equal(t, 3, len(slo))
+
+	// Closed incidents are pruned, open incidents are kept.
+	removed, err := l.prune(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, removed)
+	all, err := l.list(incidentFilter{state: "all"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(all))
+}
+
+// TestMetrics test the node health, action, poll latency and node info metrics.
+func TestMetrics(t *testing.T) {
+	cycles, err := readTimeline(strings.NewReader(testTimeline))
+	assert.Nil(t, err)
+
+	nodeInfoMetric = newNodeInfoMetrics(10 * time.Minute)
+	defer func() { nodeInfoMetric = nil }()
+
+	// Replay the timeline through the live cycle: simulations are not
+	// counted in the metrics.
+	r := newReplay()
+	var now time.Time
+	a := newTestAggregator(&aggregator{
+		detectorDCs:         map[string]bool{"dc1": true},
+		datacenter:          "metrics",
+		nodes:               r,
+		detector:            r,
+		actuator:            r,
+		clock:               func() time.Time { return now },
+		records:             make(map[string]*nodeRecord),
+		thresholdPercentage: 10,
+	})
+	for _, cycle := range cycles[:2] {
+		now = cycle.time
+		r.next(cycle)
+		_, err := a.runCycle()
+		assert.Nil(t, err)
+	}
+
+	dc := prometheus.Labels{"dc": "metrics"}
+	assert.Equal(t, 0.0, testutil.ToFloat64(healthyNodesGauge.With(dc)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(unhealthyNodesGauge.With(dc)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(checkFailingNodesGauge.With(prometheus.Labels{"dc": "metrics", "datacenter": "dc1", "check": "docker"})))
+	assert.Equal(t, 1.0, testutil.ToFloat64(actionsCounter.With(prometheus.Labels{"dc": "metrics", "action": "ineligible", "outcome": "success"})))
+
+	polls := &dto.Metric{}
+	assert.Nil(t, nodePollDuration.With(prometheus.Labels{"dc": "metrics", "outcome": "error"}).(prometheus.Histogram).Write(polls))
+	assert.Equal(t, uint64(2), polls.Histogram.GetSampleCount())
+
+	// node-2 was never checked, node-1 has a single series with its latest health.
+	assert.Equal(t, 1, testutil.CollectAndCount(nodeInfoGauge))
+	assert.Equal(t, 1.0, testutil.ToFloat64(nodeInfoGauge.With(prometheus.Labels{"dc": "metrics", "node_id": "node-1", "address": "10.0.0.1",
+		"datacenter": "dc1", "eligibility": "ineligible", "healthy": "false", "failing_checks": "docker"})))
+
+	assert.Equal(t, 1, nodeInfoMetric.expire(cycles[1].time.Add(time.Hour)))
+	assert.Equal(t, 0, testutil.CollectAndCount(nodeInfoGauge))
+
+	assert.Equal(t, 5, headroomNodes(&thresholdScope{percentage: 50, eligibleNodes: 10, totalNodes: 10}))
+	assert.Equal(t, 0, headroomNodes(&thresholdScope{percentage: 50, eligibleNodes: 4, totalNodes: 10}))
+	assert.Equal(t, 0, headroomNodes(&thresholdScope{percentage: 50}))
+}
@@ -0,0 +1,336 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// nodeRegistry holds the latest known state of every node the aggregator
+// has reached out to. It is written by the aggregation loop and read by
+// the HTTP API handlers, so all access goes through the embedded lock.
+type nodeRegistry struct {
+	sync.RWMutex
+	nodes map[string]*types.NodeStatus
+
+	// enforced returns true if a failing health check of the node is enforced.
+	enforced func(policy types.NodePolicy, nodeID, check string) bool
+}
+
+func newNodeRegistry(enforced func(policy types.NodePolicy, nodeID, check string) bool) *nodeRegistry {
+	return &nodeRegistry{
+		nodes:    make(map[string]*types.NodeStatus),
+		enforced: enforced,
+	}
+}
+
+// update records the latest health checks of a node.
+func (r *nodeRegistry) update(nodeInfo *api.Node, address string, policy types.NodePolicy, rec *nodeRecord) {
+	r.Lock()
+	defer r.Unlock()
+
+	status := r.node(nodeInfo, address, policy)
+	status.Skipped = ""
+	status.LastSeen = time.Now()
+	status.Detector = rec.Detector
+	status.Transitions = len(rec.Transitions)
+	status.QuarantinedUntil = time.Time{}
+	if rec.Quarantined {
+		status.QuarantinedUntil = rec.QuarantineUntil
+	}
+	r.setChecks(status, policy, rec)
+	setAction(status, rec)
+}
+
+// restore records the persisted state of a node at startup, until the
+// node is reached out to again.
+func (r *nodeRegistry) restore(nodeID string, policy types.NodePolicy, rec *nodeRecord) {
+	r.Lock()
+	defer r.Unlock()
+
+	status := &types.NodeStatus{
+		ID:         nodeID,
+		Address:    rec.Address,
+		Datacenter: rec.Datacenter,
+		Detector:   rec.Detector,
+	}
+	r.setChecks(status, policy, rec)
+	setAction(status, rec)
+	r.nodes[nodeID] = status
+}
+
+func (r *nodeRegistry) setChecks(status *types.NodeStatus, policy types.NodePolicy, rec *nodeRecord) {
+	status.Healthy = true
+	status.Checks = make([]types.CheckStatus, 0, len(rec.Checks))
+	for _, hc := range rec.Checks {
+		if hc.Failed() {
+			status.Healthy = false
+		}
+		status.Checks = append(status.Checks, types.CheckStatus{
+			HealthCheck:         hc,
+			Enforced:            r.enforced(policy, status.ID, hc.Type),
+			ConsecutiveFailures: rec.Failures[hc.Type],
+			FailingSince:        rec.FailingSince[hc.Type],
+		})
+	}
+	sort.Slice(status.Checks, func(i, j int) bool {
+		return status.Checks[i].Type < status.Checks[j].Type
+	})
+}
+
+func setAction(status *types.NodeStatus, rec *nodeRecord) {
+	status.CordonOwner = rec.CordonOwner
+	status.LastAction = rec.LastAction
+	status.LastActionTime = rec.LastActionTime
+	status.Reason = rec.Reason
+}
+
+// skip records that a node was not reached out to, and why.
+func (r *nodeRegistry) skip(nodeInfo *api.Node, address string, policy types.NodePolicy, reason string) {
+	r.Lock()
+	defer r.Unlock()
+
+	status := r.node(nodeInfo, address, policy)
+	status.Skipped = reason
+}
+
+// node returns the status of a node, refreshed from the node info.
+// Caller must hold the lock.
+func (r *nodeRegistry) node(nodeInfo *api.Node, address string, policy types.NodePolicy) *types.NodeStatus {
+	status, ok := r.nodes[nodeInfo.ID]
+	if !ok {
+		status = &types.NodeStatus{ID: nodeInfo.ID}
+		r.nodes[nodeInfo.ID] = status
+	}
+
+	status.Address = address
+	status.Datacenter = nodeInfo.Datacenter
+	status.NodeClass = nodeInfo.NodeClass
+	status.Eligibility = nodeInfo.SchedulingEligibility
+	status.Policy = policy
+	return status
+}
+
+// recordAction records an eligibility change made by the aggregator.
+func (r *nodeRegistry) recordAction(nodeID string, rec *nodeRecord) {
+	r.Lock()
+	defer r.Unlock()
+
+	status, ok := r.nodes[nodeID]
+	if !ok {
+		return
+	}
+
+	setAction(status, rec)
+	status.Eligibility = rec.LastAction
+}
+
+// setEligibility refreshes the scheduling eligibility of a node which
+// was not polled during this aggregation cycle.
+func (r *nodeRegistry) setEligibility(nodeID, eligibility string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if status, ok := r.nodes[nodeID]; ok {
+		status.Eligibility = eligibility
+	}
+}
+
+// prune removes nodes which are no longer part of the cluster.
+func (r *nodeRegistry) prune(nodes []*api.NodeListStub) {
+	present := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		present[node.ID] = true
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for id := range r.nodes {
+		if !present[id] {
+			delete(r.nodes, id)
+		}
+	}
+}
+
+// list returns a copy of all the known nodes, sorted by node ID.
+func (r *nodeRegistry) list() []types.NodeStatus {
+	r.RLock()
+	defer r.RUnlock()
+
+	result := make([]types.NodeStatus, 0, len(r.nodes))
+	for _, status := range r.nodes {
+		result = append(result, copyNodeStatus(status))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// get returns a copy of a single node.
+func (r *nodeRegistry) get(nodeID string) (types.NodeStatus, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	status, ok := r.nodes[nodeID]
+	if !ok {
+		return types.NodeStatus{}, false
+	}
+	return copyNodeStatus(status), true
+}
+
+// summary returns the cluster wide node and health check counts.
+func (r *nodeRegistry) summary() *types.Summary {
+	summary := &types.Summary{
+		Checks:      make(map[string]*types.CheckSummary),
+		Datacenters: make(map[string]*types.DatacenterSummary),
+	}
+
+	for _, status := range r.list() {
+		dc, ok := summary.Datacenters[status.Datacenter]
+		if !ok {
+			dc = &types.DatacenterSummary{Checks: make(map[string]*types.CheckSummary)}
+			summary.Datacenters[status.Datacenter] = dc
+		}
+
+		summary.Nodes++
+		dc.Nodes++
+		if status.Skipped != "" {
+			summary.Skipped++
+			dc.Skipped++
+		} else if status.Healthy {
+			summary.Healthy++
+			dc.Healthy++
+		} else {
+			summary.Unhealthy++
+			dc.Unhealthy++
+		}
+
+		if status.Eligibility == "ineligible" {
+			summary.Cordoned++
+			dc.Cordoned++
+		}
+
+		for _, check := range status.Checks {
+			addCheckSummary(summary.Checks, check)
+			addCheckSummary(dc.Checks, check)
+		}
+	}
+	return summary
+}
+
+func addCheckSummary(checks map[string]*types.CheckSummary, check types.CheckStatus) {
+	cs, ok := checks[check.Type]
+	if !ok {
+		cs = &types.CheckSummary{Enforced: check.Enforced}
+		checks[check.Type] = cs
+	}
+
+	if check.Failed() {
+		cs.Unhealthy++
+	} else {
+		cs.Healthy++
+	}
+}
+
+func copyNodeStatus(status *types.NodeStatus) types.NodeStatus {
+	c := *status
+	c.Checks = append([]types.CheckStatus(nil), status.Checks...)
+	c.Policy.Enforce = append([]string(nil), status.Policy.Enforce...)
+	return c
+}
+
+func eligibilityString(eligible bool) string {
+	if eligible {
+		return "eligible"
+	}
+	return "ineligible"
+}
+
+// registerAPIHandlers adds the read only aggregator HTTP API to mux.
+func (a *aggregator) registerAPIHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/nodes", a.nodesHandler)
+	mux.HandleFunc("/v1/nodes/", a.nodeHandler)
+	mux.HandleFunc("/v1/summary", a.summaryHandler)
+	mux.HandleFunc("/v1/audit", a.auditHandler)
+	mux.HandleFunc("/v1/coverage", a.coverageHandler)
+	mux.HandleFunc("/v1/history/", a.historyHandler)
+	mux.HandleFunc("/v1/incidents", a.incidentsHandler)
+	mux.HandleFunc("/v1/incidents/", a.incidentsHandler)
+}
+
+// nodesHandler serves /v1/nodes, which lists every known node.
+func (a *aggregator) nodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.status.list())
+}
+
+// nodeHandler serves /v1/nodes/{id}, which returns a single node.
+func (a *aggregator) nodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	nodeID := strings.TrimPrefix(r.URL.Path, "/v1/nodes/")
+	if nodeID == "" {
+		writeJSON(w, http.StatusOK, a.status.list())
+		return
+	}
+
+	status, ok := a.status.get(nodeID)
+	if !ok {
+		http.Error(w, "node not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// summaryHandler serves /v1/summary, which returns cluster wide counts.
+func (a *aggregator) summaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.status.summary())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	respJSON, err := json.Marshal(v)
+	if err != nil {
+		log.Warning("Error in marshalling HTTP response: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(respJSON)
+}
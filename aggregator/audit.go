@@ -0,0 +1,324 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// auditLog is an append-only JSONL log of every eligibility decision made
+// by the aggregator. When the log grows above maxSize bytes, it is rotated
+// to <path>.1, <path>.1 to <path>.2 and so on, keeping at most maxFiles
+// rotated files.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// openAuditLog opens (or creates) the audit log at path for appending.
+func openAuditLog(path string, maxSize int64, maxFiles int) (*auditLog, error) {
+	a := &auditLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error in opening audit log %s: %v", a.path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// write appends an event to the audit log.
+func (a *auditLog) write(event *types.AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size+int64(len(data)) > a.maxSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// rotate shifts the rotated files by one, and starts a new log.
+// Caller must hold the lock.
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(a.rotatedPath(a.maxFiles))
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		os.Rename(a.rotatedPath(i), a.rotatedPath(i+1))
+	}
+
+	if a.maxFiles > 0 {
+		if err := os.Rename(a.path, a.rotatedPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *auditLog) rotatedPath(i int) string {
+	return a.path + "." + strconv.Itoa(i)
+}
+
+// auditFilter selects events when querying the audit log.
+type auditFilter struct {
+	nodeID string
+	action string
+	since  time.Time
+	limit  int
+}
+
+func (f *auditFilter) match(event *types.AuditEvent) bool {
+	if f.nodeID != "" && event.NodeID != f.nodeID {
+		return false
+	}
+	if f.action != "" && event.Action != f.action {
+		return false
+	}
+	return f.since.IsZero() || !event.Timestamp.Before(f.since)
+}
+
+// maxAuditLineSize is the size of the longest audit log line which is read.
+// Longer lines are skipped.
+const maxAuditLineSize = 1024 * 1024
+
+// query returns the events matching the filter, oldest first. If more
+// than limit events match, only the most recent ones are returned.
+// The lock is only held to open the files, so that a query doesn't block
+// the audit log writes. Files are read newest first, until limit events
+// are found.
+func (a *auditLog) query(filter auditFilter) ([]types.AuditEvent, error) {
+	files, size, err := a.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var result []types.AuditEvent
+	for i, f := range files {
+		var r io.Reader = f
+		if i == 0 {
+			// Events written after the snapshot are left out.
+			r = io.LimitReader(f, size)
+		}
+
+		limit := 0
+		if filter.limit > 0 {
+			limit = filter.limit - len(result)
+		}
+		events, err := readAuditEvents(r, filter, limit)
+		if err != nil {
+			return nil, err
+		}
+		result = append(events, result...)
+		if filter.limit > 0 && len(result) >= filter.limit {
+			break
+		}
+	}
+
+	if result == nil {
+		result = []types.AuditEvent{}
+	}
+	return result, nil
+}
+
+// snapshot opens the audit log and its rotated files, newest first, and
+// returns the size of the audit log. Open files are not affected by a
+// later rotation.
+func (a *auditLog) snapshot() ([]*os.File, int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var files []*os.File
+	for i := 0; i <= a.maxFiles; i++ {
+		path := a.path
+		if i > 0 {
+			path = a.rotatedPath(i)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, 0, err
+		}
+		files = append(files, f)
+	}
+	return files, a.size, nil
+}
+
+// readAuditEvents returns the events matching the filter, oldest first. If
+// limit is set, only the limit most recent ones are kept.
+func readAuditEvents(r io.Reader, filter auditFilter, limit int) ([]types.AuditEvent, error) {
+	events := []types.AuditEvent{}
+	reader := bufio.NewReaderSize(r, maxAuditLineSize)
+	tooLong := false
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Skip the rest of a line longer than maxAuditLineSize.
+			tooLong = true
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if len(line) > 0 && !tooLong {
+			event := types.AuditEvent{}
+			// Skip partially written lines e.g. after a crash.
+			if json.Unmarshal(line, &event) == nil && filter.match(&event) {
+				events = append(events, event)
+				if limit > 0 && len(events) > limit {
+					events = events[1:]
+				}
+			}
+		}
+		tooLong = false
+
+		if err == io.EOF {
+			return events, nil
+		}
+	}
+}
+
+// Close closes the audit log.
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// audit writes an event to the audit log, if enabled (a is not nil).
+func (a *auditLog) audit(event *types.AuditEvent) {
+	if a == nil {
+		return
+	}
+
+	event.Timestamp = time.Now()
+	event.Instance = instanceID
+	if err := a.write(event); err != nil {
+		log.Warning(fmt.Sprintf("Error in writing audit log: %v", err))
+	}
+}
+
+// auditHandler serves /v1/audit, which returns the audit log events.
+// Events can be filtered with the node_id, action, since (RFC3339) and
+// limit query parameters.
+func (a *aggregator) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.auditLog == nil {
+		http.Error(w, "audit log is disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := auditFilter{
+		nodeID: query.Get("node_id"),
+		action: query.Get("action"),
+		limit:  100,
+	}
+
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid since: %v", err), http.StatusBadRequest)
+			return
+		}
+		filter.since = t
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid limit: %v", err), http.StatusBadRequest)
+			return
+		}
+		filter.limit = l
+	}
+
+	events, err := a.auditLog.query(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
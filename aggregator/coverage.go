@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+// detectorReachable records that the detector of a node answered.
+func (rec *nodeRecord) detectorReachable(now time.Time) {
+	rec.Detector = types.DetectorStatus{
+		Reachable:   true,
+		LastContact: now,
+	}
+}
+
+// detectorUnreachable records that the detector of a node didn't answer.
+func (rec *nodeRecord) detectorUnreachable(err error, now time.Time) {
+	if rec.Detector.Reachable || rec.Detector.UnreachableSince.IsZero() {
+		rec.Detector.UnreachableSince = now
+	}
+	rec.Detector.Reachable = false
+	rec.Detector.UnreachableCycles++
+	rec.Detector.Error = err.Error()
+}
+
+// detectorCheck returns the DetectorUnreachable health check of a node.
+// It is failing once the detector has been unreachable for the given
+// number of consecutive cycles. It is derived from the detector
+// reachability of the node record, and never recorded with its health
+// checks.
+func detectorCheck(rec *nodeRecord, cycles int, now time.Time) types.HealthCheck {
+	hc := types.HealthCheck{
+		Type:    types.DetectorUnreachable,
+		Result:  "Healthy",
+		LastRun: now,
+	}
+
+	if !rec.Detector.Reachable && rec.Detector.UnreachableCycles >= cycles {
+		hc.Result = "Unhealthy"
+		hc.FailingSince = rec.Detector.UnreachableSince
+		hc.Message = fmt.Sprintf("detector unreachable for %d cycles since %s: %s",
+			rec.Detector.UnreachableCycles, rec.Detector.UnreachableSince.Format(time.RFC3339), rec.Detector.Error)
+	}
+	return hc
+}
+
+// unreachable records that the detector of a node is not answering.
+func (r *nodeRegistry) unreachable(nodeInfo *api.Node, address string, policy types.NodePolicy, rec *nodeRecord, reason string) {
+	r.Lock()
+	defer r.Unlock()
+
+	status := r.node(nodeInfo, address, policy)
+	status.Skipped = reason
+	status.Detector = rec.Detector
+	setAction(status, rec)
+}
+
+// coverage returns the eligible nodes without a detector answering.
+// Only nodes the aggregator reached out to are accounted.
+func (r *nodeRegistry) coverage() *types.Coverage {
+	coverage := &types.Coverage{Uncovered: []types.NodeStatus{}}
+	for _, status := range r.list() {
+		if status.Eligibility != eligibilityString(true) || (status.Detector.LastContact.IsZero() && status.Detector.Error == "") {
+			continue
+		}
+
+		coverage.Nodes++
+		if status.Detector.Reachable {
+			coverage.Covered++
+		} else {
+			coverage.Uncovered = append(coverage.Uncovered, status)
+		}
+	}
+	return coverage
+}
+
+// coverageHandler serves /v1/coverage, which returns the eligible nodes
+// without a detector answering.
+func (a *aggregator) coverageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.status.coverage())
+}
@@ -0,0 +1,673 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// nodeSource lists the nodes of the cluster, and returns their info.
+type nodeSource interface {
+	// listNodes returns the nodes of the cluster. With resources set,
+	// the node resources are included in the node list (Nomad 1.0+).
+	listNodes(resources bool) ([]*nodeStub, error)
+	nodeInfo(nodeID string) (*api.Node, error)
+}
+
+// detectorClient returns the node health reported by the detector
+// running on a node.
+type detectorClient interface {
+	nodeHealth(address string) ([]types.HealthCheck, error)
+}
+
+// actuator applies the aggregator decisions to the nodes.
+type actuator interface {
+	toggleEligibility(nodeID string, eligible bool) error
+	publishNodeMeta(nodeInfo *api.Node, address string, checks []types.HealthCheck) error
+}
+
+// aggregator holds the configuration and the node state shared by the
+// aggregation cycles. With dryRun set, a cycle makes the same decisions
+// as the live loop, but doesn't change node eligibility or persist state.
+// With simulated set, the cycles replay a timeline (see simulate.go) and
+// don't count actions, quarantines or incidents in the metrics, which are
+// those of the live loop.
+//
+// The decisions only depend on the nodes, the node health and the clock,
+// so that they can be replayed offline (see simulate.go). Every aggregator
+// has its own admin state, node registry, audit log, history and incidents,
+// so that plan and simulate don't share state with the live loop.
+type aggregator struct {
+	nodes               nodeSource
+	detector            detectorClient
+	actuator            actuator
+	clock               func() time.Time
+	store               *stateStore
+	records             map[string]*nodeRecord
+	datacenter          string
+	thresholdPercentage int
+	thresholdMode       string
+	thresholdScope      []string
+	thresholdOverrides  []thresholdOverride
+	unreachableCycles   int
+	flap                flapPolicy
+	publishMeta         bool
+	dryRun              bool
+	simulated           bool
+
+	enforcedChecks  map[string]bool   // --enforce-health-check
+	checkSeverities map[string]int    // --check-severity
+	detectorDCs     map[string]bool   // --detector-datacenter and $NOMAD_DC
+	nodeAttributes  map[string]string // --node-attribute
+	configWindows   []*maintenanceWindow
+
+	admin     *adminStore
+	status    *nodeRegistry
+	auditLog  *auditLog
+	history   *historyStore
+	incidents *incidentLedger
+}
+
+// nodeResult is the outcome of an aggregation cycle for a single node.
+// Skipped is set when the node health was not checked, and Event is set
+// when an eligibility decision was made.
+type nodeResult struct {
+	NodeID      string            `json:"node_id"`
+	NodeAddress string            `json:"node_address"`
+	Datacenter  string            `json:"datacenter,omitempty"`
+	Skipped     string            `json:"skipped,omitempty"`
+	Event       *types.AuditEvent `json:"event,omitempty"`
+
+	candidate *cordonCandidate
+
+	// eligibility of the node at the start of the cycle, and its health
+	// checks, if they were checked.
+	eligibility string
+	checks      []types.HealthCheck
+}
+
+// now returns the current time of the aggregator clock.
+func (a *aggregator) now() time.Time {
+	if a.clock != nil {
+		return a.clock()
+	}
+	return time.Now()
+}
+
+// runCycle runs a single aggregation cycle over all the nodes in the cluster.
+func (a *aggregator) runCycle() ([]nodeResult, error) {
+	stubs, err := a.nodes.listNodes(a.thresholdMode == thresholdModeCapacity)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*api.NodeListStub, 0, len(stubs))
+	for _, stub := range stubs {
+		nodes = append(nodes, &stub.NodeListStub)
+	}
+
+	eligibleNodeCount := getEligibleNodeCount(nodes)
+	eligibleNodesGauge.With(prometheus.Labels{"dc": a.datacenter}).Set(float64(eligibleNodeCount))
+	nodesTotalGauge.With(prometheus.Labels{"dc": a.datacenter}).Set(float64(len(nodes)))
+
+	log.Info(fmt.Sprintf("Eligible Nodes: %d, Total Nodes: %d", eligibleNodeCount, len(nodes)))
+
+	// infos caches the node info during the aggregation cycle.
+	infos := make(map[string]*api.Node)
+
+	threshold := a.newThreshold(stubs, infos)
+	threshold.updateMetrics(a.datacenter)
+	for _, key := range threshold.scopeKeys() {
+		scope := threshold.scopes[key]
+		log.Info(fmt.Sprintf("Scope %s: Eligible Nodes: %d, Total Nodes: %d, Threshold: %d%%", key, scope.eligibleNodes, scope.totalNodes, scope.percentage))
+	}
+
+	a.status.prune(nodes)
+	a.pruneRecords(nodes)
+
+	results := make([]nodeResult, 0, len(nodes))
+	var candidates []*cordonCandidate
+	for _, node := range nodes {
+		result := a.processNode(node, infos, threshold)
+		if result.Skipped != "" {
+			log.Debug(fmt.Sprintf("Node %s: %s, skipping node.", node.Address, result.Skipped))
+		}
+		if result.candidate != nil {
+			candidates = append(candidates, result.candidate)
+		}
+		results = append(results, result)
+	}
+
+	a.cordonCandidates(candidates, threshold)
+	a.updateHealthMetrics(results)
+
+	maintenanceWindowsGauge.With(prometheus.Labels{"dc": a.datacenter}).Set(float64(a.activeMaintenanceWindows(a.now())))
+
+	quarantined := 0
+	for _, rec := range a.records {
+		if rec.quarantined(a.now()) {
+			quarantined++
+		}
+	}
+	nodesQuarantinedGauge.With(prometheus.Labels{"dc": a.datacenter}).Set(float64(quarantined))
+
+	if a.incidents != nil && !a.dryRun && !a.simulated {
+		a.incidents.updateMetrics(a.datacenter)
+	}
+
+	coverage := a.status.coverage()
+	detectorUnreachableGauge.With(prometheus.Labels{"dc": a.datacenter}).Set(float64(len(coverage.Uncovered)))
+	return results, nil
+}
+
+// newThreshold returns the threshold accounting of the nodes. Only nodes
+// in a detector datacenter, and matching --node-attribute are accounted.
+// In capacity mode, the node resources are read from the node info if the
+// Nomad servers don't include them in the node list.
+func (a *aggregator) newThreshold(nodes []*nodeStub, infos map[string]*api.Node) *thresholdAccounting {
+	threshold := newThresholdAccounting(a.thresholdMode, a.thresholdPercentage, a.thresholdScope, a.thresholdOverrides)
+	for _, node := range nodes {
+		if _, ok := a.detectorDCs[node.Datacenter]; !ok {
+			continue
+		}
+
+		r := allocatable(node.NodeResources, node.ReservedResources)
+		needResources := a.thresholdMode == thresholdModeCapacity && node.NodeResources == nil
+		if len(a.nodeAttributes) > 0 || needResources {
+			nodeInfo, err := a.nodeInfo(node.ID, infos)
+			if err != nil {
+				log.Warning(fmt.Sprintf("Error in getting node info: %v. Node %s is not accounted in threshold.\n", err, node.Address))
+				nodeHandleErrorsCounter.With(prometheus.Labels{"dc": a.datacenter}).Inc()
+				continue
+			}
+
+			if a.attributeMismatch(nodeInfo) != "" {
+				continue
+			}
+
+			if needResources {
+				r = allocatable(nodeInfo.NodeResources, nodeInfo.ReservedResources)
+			}
+		}
+		threshold.add(node, r)
+	}
+	return threshold
+}
+
+// nodeInfo returns the node info, cached for the aggregation cycle.
+func (a *aggregator) nodeInfo(nodeID string, infos map[string]*api.Node) (*api.Node, error) {
+	if nodeInfo, ok := infos[nodeID]; ok {
+		return nodeInfo, nil
+	}
+
+	nodeInfo, err := a.nodes.nodeInfo(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	infos[nodeID] = nodeInfo
+	return nodeInfo, nil
+}
+
+// processNode checks the health of a single node, and decides if the node
+// should be taken out of (or put back into) the scheduling pool.
+func (a *aggregator) processNode(node *api.NodeListStub, infos map[string]*api.Node, threshold *thresholdAccounting) nodeResult {
+	result := nodeResult{
+		NodeID:      node.ID,
+		NodeAddress: node.Address,
+		Datacenter:  node.Datacenter,
+		eligibility: node.SchedulingEligibility,
+	}
+
+	rec, ok := a.records[node.ID]
+	if !ok {
+		rec = newNodeRecord()
+		a.records[node.ID] = rec
+	}
+	rec.Address, rec.Datacenter = node.Address, node.Datacenter
+
+	// Node was made eligible by someone else, after the aggregator cordoned it.
+	if rec.Cordoned && node.SchedulingEligibility == "eligible" {
+		log.Info(fmt.Sprintf("Node %s was cordoned by aggregator, but is eligible again. Releasing ownership.", node.Address))
+		rec.Cordoned = false
+		rec.CordonOwner = ""
+		a.saveRecord(node.ID, rec)
+	}
+
+	// Skip ineligible nodes, unless they were cordoned by the aggregator.
+	// Those are still checked, so they can be made eligible again once healthy.
+	if node.SchedulingEligibility == "ineligible" && !rec.Cordoned {
+		a.status.setEligibility(node.ID, node.SchedulingEligibility)
+		result.Skipped = "node is ineligible"
+		return result
+	}
+
+	nodeInfo, err := a.nodeInfo(node.ID, infos)
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in getting node info: %v. Skipping node: %s\n", err, node.Address))
+		nodeHandleErrorsCounter.With(prometheus.Labels{"dc": a.datacenter}).Inc()
+		result.Skipped = fmt.Sprintf("error in getting node info: %v", err)
+		return result
+	}
+
+	policy := a.nodePolicy(node.ID, nodeInfo.Meta)
+
+	// If node attribute e.g. os.name=ubuntu is missing or not matching in the node info
+	// OR node is not in a DC where detector is running
+	// OR aggregator is paused for the node DC, or the node is excluded or ignored, Skip this node, and move onto next one.
+	if reason := a.skipReason(nodeInfo, policy); reason != "" {
+		if policy.Ignore {
+			a.status.skip(nodeInfo, node.Address, policy, reason)
+		}
+		nodeHandleSkipCounter.With(prometheus.Labels{"dc": a.datacenter}).Inc()
+		result.Skipped = reason
+		return result
+	}
+
+	// previous state map has the health check results from last aggregation cycle.
+	// This will make sure we don't toggle/untoggle a node unless there is a state change.
+	// The DetectorUnreachable health check is not recorded with them, its
+	// previous result comes from the detector reachability.
+	previous := make(map[string]types.HealthCheck)
+	for _, nh := range rec.Checks {
+		previous[nh.Type] = nh
+	}
+	if a.unreachableCycles > 0 && (!rec.Detector.LastContact.IsZero() || rec.Detector.UnreachableCycles > 0) {
+		previous[types.DetectorUnreachable] = detectorCheck(rec, a.unreachableCycles, a.now())
+	}
+
+	pollStart := time.Now()
+	checks, err := a.detector.nodeHealth(node.Address)
+	nodePollDuration.With(prometheus.Labels{"dc": a.datacenter, "outcome": outcome(err)}).Observe(time.Since(pollStart).Seconds())
+
+	// current are the health checks the node is evaluated with.
+	var current []types.HealthCheck
+	if err != nil {
+		nodeHandleErrorsCounter.With(prometheus.Labels{"dc": a.datacenter}).Inc()
+		rec.detectorUnreachable(err, a.now())
+
+		// Once the detector has been unreachable for --detector-unreachable-cycles,
+		// the node is evaluated with the DetectorUnreachable health check only.
+		// The last health checks reported by the detector are kept.
+		if a.unreachableCycles <= 0 || rec.Detector.UnreachableCycles < a.unreachableCycles {
+			log.Warning(fmt.Sprintf("Node %s: %v, skipping node.", node.Address, err))
+			result.Skipped = err.Error()
+			a.status.unreachable(nodeInfo, node.Address, policy, rec, result.Skipped)
+			a.saveRecord(node.ID, rec)
+			return result
+		}
+
+		log.Warning(fmt.Sprintf("Node %s: %v, detector unreachable for %d cycles.", node.Address, err, rec.Detector.UnreachableCycles))
+		current = []types.HealthCheck{detectorCheck(rec, a.unreachableCycles, a.now())}
+	} else {
+		rec.detectorReachable(a.now())
+		rec.observe(checks, a.now())
+		current = checks
+		if a.unreachableCycles > 0 {
+			current = append(checks[:len(checks):len(checks)], detectorCheck(rec, a.unreachableCycles, a.now()))
+		}
+	}
+
+	result.checks = current
+	a.recordTransitions(node.ID, checkTransitions(result, previous, current, a.now()))
+	a.observeIncidents(result, current, policy)
+	a.status.update(nodeInfo, node.Address, policy, rec)
+
+	if a.publishMeta && !a.dryRun {
+		err := a.actuator.publishNodeMeta(nodeInfo, node.Address, current)
+		if err != nil {
+			log.Warning(fmt.Sprintf("Node %s: %v\n", node.Address, err))
+			nodeHandleErrorsCounter.With(prometheus.Labels{"dc": a.datacenter}).Inc()
+		}
+		if !a.simulated {
+			actionsCounter.With(prometheus.Labels{"dc": a.datacenter, "action": "publish_meta", "outcome": outcome(err)}).Inc()
+		}
+	}
+
+	nodeHealthy := true
+	stateChanged := false
+	toggle := false
+	var reasons []string
+
+	// During a maintenance window, enforcement is alert-only.
+	now := a.now()
+	windows := a.nodeMaintenance(now, nodeInfo.Datacenter, nodeInfo.NodeClass)
+	var maintenanceReasons []string
+
+	// Failing health checks which are enforced, and the ones which are dry-runned.
+	var enforcedChecks, dryRunChecks []types.HealthCheck
+
+	for _, curr := range current {
+		// Default CPU, memory and disk checks are represented with
+		// boolean (true/false). curr.Result = true for CPUUnderPressure
+		// or MemoryUnderPressure or DiskUsageHigh tells that the system
+		// is under CPU/memory/disk pressure and should be taken out of
+		// eligibility.
+		if curr.Failed() {
+			log.Warning(fmt.Sprintf("Node %s: %s is %s: %s\n", node.Address, curr.Type, curr.Result, curr.Message))
+			nodeHealthy = false
+
+			// Even if one of the health checks are failing, node will not be taken out of the scheduling pool.
+			// Unless that health check is part of --enforce-health-check list.
+			// Set toggle=true if above is satisfied.
+			if w := maintenanceCovers(windows, curr.Type); w != nil && a.isEnforced(policy, node.ID, curr.Type) {
+				log.Info(fmt.Sprintf("%s is alert-only during maintenance window %s. Node %s will be dry-runned and not taken out of scheduling pool\n", curr.Type, w.ID, node.Address))
+				maintenanceReasons = append(maintenanceReasons, fmt.Sprintf("%s is alert-only during maintenance window %s", curr.Type, w.ID))
+				dryRunChecks = append(dryRunChecks, curr)
+			} else if a.isEnforced(policy, node.ID, curr.Type) {
+				log.Info(fmt.Sprintf("%s is in enforce health check list. Set node %s scheduling eligibility to false\n", curr.Type, node.Address))
+				toggle = true
+				reasons = append(reasons, fmt.Sprintf("%s is %s: %s", curr.Type, curr.Result, strings.TrimSpace(curr.Message)))
+				enforcedChecks = append(enforcedChecks, curr)
+			} else {
+				log.Info(fmt.Sprintf("%s is not in enforce health check list. Node %s will be dry-runned and not taken out of scheduling pool\n", curr.Type, node.Address))
+				dryRunChecks = append(dryRunChecks, curr)
+			}
+		} else {
+			log.Debug(fmt.Sprintf("Node %s: %s is %s: %s\n", node.Address, curr.Type, curr.Result, curr.Message))
+		}
+
+		if prev, ok := previous[curr.Type]; ok && prev.Result != curr.Result {
+			stateChanged = true
+		}
+	}
+
+	// First aggregation cycle has no previous state. Second aggregation cycle onwards,
+	// previous state map will exist, and the node is only toggled on a state change.
+	firstCycle := len(previous) == 0
+
+	// Flapping nodes are held out of the scheduling pool until their quarantine is over.
+	newQuarantine := rec.observeFlaps(&a.flap, toggle, !firstCycle, now)
+	if newQuarantine {
+		if !a.simulated {
+			nodeQuarantinesCounter.With(prometheus.Labels{"dc": a.datacenter}).Inc()
+		}
+		log.Warning(fmt.Sprintf("Node %s is flapping, quarantined until %s.", node.Address, rec.QuarantineUntil.Format(time.RFC3339)))
+	}
+	quarantined := rec.quarantined(now)
+
+	// A maintenance window covering all health checks of the node doesn't hold flapping nodes either.
+	if maintenanceCovers(windows, "") != nil {
+		quarantined = false
+	}
+	if quarantined && !toggle {
+		reasons = append(reasons, fmt.Sprintf("node is flapping, quarantined until %s", rec.QuarantineUntil.Format(time.RFC3339)))
+	}
+
+	// A node cordoned by the aggregator is already out of the scheduling pool.
+	toggle = (toggle || quarantined) && !rec.Cordoned
+
+	event := &types.AuditEvent{
+		NodeID:      node.ID,
+		NodeAddress: node.Address,
+		Datacenter:  nodeInfo.Datacenter,
+		Threshold:   threshold.state(node.ID),
+		Flapping:    quarantined,
+	}
+	if rec.Quarantined {
+		event.QuarantinedUntil = rec.QuarantineUntil
+	}
+
+	switch {
+	case len(windows) > 0 && rec.Cordoned:
+		// Nodes cordoned before the maintenance window are left alone until it's over.
+		log.Debug(fmt.Sprintf("Node %s: maintenance window in progress, node is left cordoned.", node.Address))
+	case stateChanged && nodeHealthy && rec.Cordoned && quarantined:
+		event.Action = eligibilityString(true)
+		event.Reason = "all health checks are healthy"
+		event.Result = types.AuditResultBlocked
+		event.Error = "node is quarantined for flapping"
+		a.audit(event)
+	case (stateChanged || rec.quarantineExpired(now)) && nodeHealthy && rec.Cordoned:
+		// Only nodes cordoned by the aggregator are made eligible again.
+		event.Action = eligibilityString(true)
+		event.Reason = "all health checks are healthy"
+		if rec.quarantineExpired(now) {
+			event.Reason = "quarantine is over, all health checks are healthy"
+		}
+		a.toggleNodeEligibility(rec, event, threshold)
+	case (firstCycle || stateChanged || rec.Deferred || newQuarantine) && toggle:
+		// Nodes are cordoned once all candidates are ranked, see cordonCandidates.
+		event.Action = eligibilityString(false)
+		event.Reason = strings.Join(reasons, "; ")
+		event.Checks = enforcedChecks
+		result.candidate = a.newCordonCandidate(node.ID, rec, event)
+	case (firstCycle || stateChanged) && !nodeHealthy && !rec.Cordoned && len(enforcedChecks) == 0:
+		event.Action = eligibilityString(false)
+		event.Reason = "health checks are not enforced"
+		if len(maintenanceReasons) > 0 {
+			event.Reason = strings.Join(maintenanceReasons, "; ")
+		}
+		event.Checks = dryRunChecks
+		event.DryRun = true
+		event.Result = types.AuditResultDryRun
+		a.audit(event)
+	}
+
+	if !toggle {
+		rec.Deferred = false
+	}
+	if rec.quarantineExpired(now) {
+		rec.Quarantined = false
+	}
+
+	if event.Action != "" {
+		result.Event = event
+	}
+	if result.candidate == nil {
+		a.saveRecord(node.ID, rec)
+	}
+	return result
+}
+
+// cordonCandidates takes the cordon candidates out of the scheduling pool,
+// worst first, as long as the threshold of their scope allows it. The
+// other candidates are deferred to the next aggregation cycle.
+func (a *aggregator) cordonCandidates(candidates []*cordonCandidate, threshold *thresholdAccounting) {
+	rankCandidates(candidates)
+
+	deferred := 0
+	for _, c := range candidates {
+		// We should only take the node out, if the available capacity stays above the threshold (--threshold-percentage)
+		// after taking this node out of the scheduling pool.
+		c.event.Threshold = threshold.state(c.nodeID)
+		if c.event.Threshold.Above {
+			a.toggleNodeEligibility(c.rec, c.event, threshold)
+		} else {
+			deferred++
+			c.event.Result = types.AuditResultBlocked
+			c.event.Error = thresholdError(c.event.Threshold)
+			log.Warning(fmt.Sprintf("Node %s: %s (--threshold-percentage %d%%), node will not be taken out of scheduling pool. Deferred with rank %d.", c.event.NodeAddress, c.event.Error, c.event.Threshold.Percentage, c.event.Rank))
+
+			// Only audit the first time a node is deferred.
+			if !c.rec.Deferred {
+				a.audit(c.event)
+			}
+			c.rec.Deferred = true
+		}
+		a.saveRecord(c.nodeID, c.rec)
+	}
+
+	if !a.dryRun {
+		cordonCandidatesGauge.With(prometheus.Labels{"dc": a.datacenter}).Set(float64(len(candidates)))
+		deferredCordonsGauge.With(prometheus.Labels{"dc": a.datacenter}).Set(float64(deferred))
+	}
+}
+
+// updateHealthMetrics exports the number of healthy and unhealthy nodes,
+// and the number of nodes where each health check is failing, of the
+// nodes checked in the cycle. With --node-info-metrics, the health of
+// every node is exported as well.
+func (a *aggregator) updateHealthMetrics(results []nodeResult) {
+	healthy, unhealthy := 0, 0
+	failing := make(map[[2]string]int)
+	now := a.now()
+	for _, result := range results {
+		if result.checks == nil {
+			continue
+		}
+
+		var failed []string
+		for _, hc := range result.checks {
+			if hc.Failed() {
+				failing[[2]string{result.Datacenter, hc.Type}]++
+				failed = append(failed, hc.Type)
+			}
+		}
+		if len(failed) == 0 {
+			healthy++
+		} else {
+			unhealthy++
+		}
+
+		if nodeInfoMetric != nil && !a.dryRun && !a.simulated {
+			eligibility := result.eligibility
+			if result.Event != nil && result.Event.Result == types.AuditResultSuccess {
+				eligibility = result.Event.Action
+			}
+			sort.Strings(failed)
+			nodeInfoMetric.set(result.NodeID, prometheus.Labels{
+				"dc":             a.datacenter,
+				"node_id":        result.NodeID,
+				"address":        result.NodeAddress,
+				"datacenter":     result.Datacenter,
+				"eligibility":    eligibility,
+				"healthy":        strconv.FormatBool(len(failed) == 0),
+				"failing_checks": strings.Join(failed, ","),
+			}, now)
+		}
+	}
+
+	healthyNodesGauge.With(prometheus.Labels{"dc": a.datacenter}).Set(float64(healthy))
+	unhealthyNodesGauge.With(prometheus.Labels{"dc": a.datacenter}).Set(float64(unhealthy))
+	checkFailingNodesGauge.Reset()
+	for key, count := range failing {
+		checkFailingNodesGauge.With(prometheus.Labels{"dc": a.datacenter, "datacenter": key[0], "check": key[1]}).Set(float64(count))
+	}
+
+	if nodeInfoMetric != nil && !a.dryRun && !a.simulated {
+		if removed := nodeInfoMetric.expire(now); removed > 0 {
+			log.Debug(fmt.Sprintf("Removed the node info metric of %d nodes.", removed))
+		}
+	}
+}
+
+// outcome is the outcome label of an operation.
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// getEligibleNodeCount return the count of eligible nodes.
+func getEligibleNodeCount(nodes []*api.NodeListStub) int {
+	eligibleNodeCount := 0
+	for _, node := range nodes {
+		if node.SchedulingEligibility == "eligible" {
+			eligibleNodeCount++
+		}
+	}
+	return eligibleNodeCount
+}
+
+// toggleNodeEligibility toggles Nomad node eligibility, and records the
+// decision in the audit log. In dry run, the decision is only recorded in
+// the event, and the node is left untouched.
+func (a *aggregator) toggleNodeEligibility(rec *nodeRecord, event *types.AuditEvent, threshold *thresholdAccounting) {
+	eligible := event.Action == eligibilityString(true)
+	if a.dryRun {
+		event.Result = types.AuditResultPlanned
+	} else {
+		if err := a.actuator.toggleEligibility(event.NodeID, eligible); err != nil {
+			log.Warning(fmt.Sprintf("Error in toggling node eligibility: %v, skipping node %s\n", err, event.NodeAddress))
+			event.Result = types.AuditResultError
+			event.Error = err.Error()
+			a.audit(event)
+			return
+		}
+		log.Info(fmt.Sprintf("Node %s scheduling eligibility changed to %t: %s\n", event.NodeAddress, eligible, event.Reason))
+		rec.recordAction(eligible, event.Reason, a.now())
+		a.status.recordAction(event.NodeID, rec)
+		event.Result = types.AuditResultSuccess
+		a.audit(event)
+	}
+
+	threshold.toggled(event.NodeID, eligible)
+}
+
+// audit writes an event to the audit log, records it in the incidents of
+// the node, and counts it, unless running in dry run. Simulated events are
+// not counted.
+func (a *aggregator) audit(event *types.AuditEvent) {
+	if !a.dryRun {
+		if !a.simulated {
+			actionsCounter.With(prometheus.Labels{"dc": a.datacenter, "action": event.Action, "outcome": event.Result}).Inc()
+		}
+		a.auditLog.audit(event)
+		if a.incidents != nil {
+			a.incidents.recordAction(event, a.now())
+		}
+	}
+}
+
+// saveRecord persists the state of a node. The aggregator keeps running
+// if the state can't be persisted, it only loses it on restart.
+func (a *aggregator) saveRecord(nodeID string, rec *nodeRecord) {
+	if a.store == nil || a.dryRun {
+		return
+	}
+	if err := a.store.saveNode(nodeID, rec); err != nil {
+		log.Warning(fmt.Sprintf("Error in saving aggregator state for node %s: %v", nodeID, err))
+	}
+}
+
+// pruneRecords removes the state of nodes which are no longer part of the cluster.
+func (a *aggregator) pruneRecords(nodes []*api.NodeListStub) {
+	present := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		present[node.ID] = true
+	}
+
+	for nodeID := range a.records {
+		if present[nodeID] {
+			continue
+		}
+		delete(a.records, nodeID)
+		if a.dryRun {
+			continue
+		}
+		if a.incidents != nil {
+			a.incidents.closeNode(nodeID, "node left the cluster", a.now())
+		}
+		if a.store == nil {
+			continue
+		}
+		if err := a.store.deleteNode(nodeID); err != nil {
+			log.Warning(fmt.Sprintf("Error in deleting aggregator state for node %s: %v", nodeID, err))
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"time"
+)
+
+// flapPolicy detects nodes flapping between healthy and unhealthy, and
+// holds them ineligible for a quarantine period. The quarantine period
+// doubles with every quarantine, from base up to max, and is reset once
+// the node has been stable for a whole window after its last quarantine.
+type flapPolicy struct {
+	window    time.Duration
+	threshold int
+	base      time.Duration
+	max       time.Duration
+}
+
+// enabled returns true if flap detection is enabled (--flap-threshold > 0).
+func (f *flapPolicy) enabled() bool {
+	return f.threshold > 0 && f.window > 0
+}
+
+// quarantinePeriod returns the quarantine period of the nth quarantine
+// of a node, starting at 0.
+func (f *flapPolicy) quarantinePeriod(n int) time.Duration {
+	period := f.base
+	for i := 0; i < n && period < f.max; i++ {
+		period *= 2
+	}
+	if f.max > 0 && period > f.max {
+		period = f.max
+	}
+	return period
+}
+
+// observeFlaps records a transition of the node between failing and
+// passing its enforced health checks, and returns true if the node starts
+// a new quarantine. known is false when there is no previous state to
+// compare with e.g. on the first aggregation cycle.
+func (rec *nodeRecord) observeFlaps(f *flapPolicy, failing, known bool, now time.Time) bool {
+	if !f.enabled() {
+		return false
+	}
+
+	if known && failing != rec.EnforcedFailing {
+		rec.Transitions = append(rec.Transitions, now)
+	}
+	rec.EnforcedFailing = failing
+
+	// Only keep the transitions in the sliding window.
+	i := 0
+	for i < len(rec.Transitions) && now.Sub(rec.Transitions[i]) > f.window {
+		i++
+	}
+	rec.Transitions = rec.Transitions[i:]
+
+	if rec.quarantined(now) {
+		return false
+	}
+
+	if len(rec.Transitions) > f.threshold {
+		rec.Quarantined = true
+		rec.QuarantineUntil = now.Add(f.quarantinePeriod(rec.Quarantines))
+		rec.Quarantines++
+		rec.Transitions = nil
+		return true
+	}
+
+	// Reset the backoff once the node has been stable for a whole window.
+	if rec.Quarantines > 0 && len(rec.Transitions) == 0 && now.Sub(rec.QuarantineUntil) > f.window {
+		rec.Quarantines = 0
+	}
+	return false
+}
+
+// quarantined returns true if the node is held ineligible for flapping.
+func (rec *nodeRecord) quarantined(now time.Time) bool {
+	return rec.Quarantined && now.Before(rec.QuarantineUntil)
+}
+
+// quarantineExpired returns true if the node quarantine is over, but the
+// node was not released yet.
+func (rec *nodeRecord) quarantineExpired(now time.Time) bool {
+	return rec.Quarantined && !now.Before(rec.QuarantineUntil)
+}
@@ -0,0 +1,517 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// defaultHistoryPeriod is the period of the history queries without since.
+const defaultHistoryPeriod = 7 * 24 * time.Hour
+
+var transitionsBucket = []byte("transitions")
+
+// historyStore keeps the health check transitions of every node in an
+// embedded bolt database, located in the aggregator --data-dir.
+//
+// Transitions are stored in a bucket per node, keyed by time and health
+// check, so that the transitions of a node in a period of time are read
+// with a single cursor seek. Transitions older than retention, and the
+// oldest transitions of nodes with more than maxNodeTransitions, are
+// removed by prune.
+type historyStore struct {
+	db                 *bolt.DB
+	retention          time.Duration
+	maxNodeTransitions int
+}
+
+// historyStorePath returns the location of the history database in dataDir.
+func historyStorePath(dataDir string) string {
+	return filepath.Join(dataDir, "history.db")
+}
+
+// openHistoryStore opens (or creates) the history database at path.
+func openHistoryStore(path string, retention time.Duration, maxNodeTransitions int) (*historyStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error in opening aggregator history %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(transitionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &historyStore{
+		db:                 db,
+		retention:          retention,
+		maxNodeTransitions: maxNodeTransitions,
+	}, nil
+}
+
+// timeKey is the big endian encoding of t, so that keys sort by time.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// record stores the transitions of a node.
+func (h *historyStore) record(nodeID string, transitions []types.Transition) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(transitionsBucket).CreateBucketIfNotExists([]byte(nodeID))
+		if err != nil {
+			return err
+		}
+
+		for _, t := range transitions {
+			data, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(append(timeKey(t.Time), t.Check...), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// prune removes the transitions older than the retention, and the oldest
+// transitions of nodes above maxNodeTransitions. It returns the number
+// of removed transitions.
+func (h *historyStore) prune(now time.Time) (int, error) {
+	removed := 0
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(transitionsBucket)
+
+		var nodes [][]byte
+		if err := root.ForEach(func(k, v []byte) error {
+			nodes = append(nodes, append([]byte(nil), k...))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		cutoff := timeKey(now.Add(-h.retention))
+		for _, nodeID := range nodes {
+			bucket := root.Bucket(nodeID)
+			if bucket == nil {
+				continue
+			}
+
+			count := bucket.Stats().KeyN
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.First() {
+				expired := h.retention > 0 && bytes.Compare(k[:8], cutoff) < 0
+				if !expired && (h.maxNodeTransitions <= 0 || count <= h.maxNodeTransitions) {
+					break
+				}
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				count--
+				removed++
+			}
+
+			if count == 0 {
+				if err := root.DeleteBucket(nodeID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// forEach calls fn with the transitions between since and until, in time
+// order for each node. With nodeID set, only the transitions of that node
+// are read.
+func (h *historyStore) forEach(nodeID string, since, until time.Time, fn func(t types.Transition)) error {
+	return h.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(transitionsBucket)
+
+		read := func(bucket *bolt.Bucket) error {
+			from, to := timeKey(since), timeKey(until)
+			c := bucket.Cursor()
+			for k, v := c.Seek(from); k != nil && bytes.Compare(k[:8], to) < 0; k, v = c.Next() {
+				t := types.Transition{}
+				if err := json.Unmarshal(v, &t); err != nil {
+					continue
+				}
+				fn(t)
+			}
+			return nil
+		}
+
+		if nodeID != "" {
+			bucket := root.Bucket([]byte(nodeID))
+			if bucket == nil {
+				return nil
+			}
+			return read(bucket)
+		}
+
+		return root.ForEach(func(k, v []byte) error {
+			if bucket := root.Bucket(k); bucket != nil {
+				return read(bucket)
+			}
+			return nil
+		})
+	})
+}
+
+// transitions returns the transitions between since and until, of a
+// single node or of all nodes, most recent last. If more than limit
+// transitions match, only the most recent ones are returned.
+func (h *historyStore) transitions(nodeID string, since, until time.Time, limit int) ([]types.Transition, error) {
+	result := []types.Transition{}
+	err := h.forEach(nodeID, since, until, func(t types.Transition) {
+		result = append(result, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result, nil
+}
+
+// flakiest returns the health checks with the most transitions between
+// since and until, across all nodes, most transitions first.
+func (h *historyStore) flakiest(since, until time.Time, limit int) ([]types.CheckFlakiness, error) {
+	counts := make(map[string]*types.CheckFlakiness)
+	nodes := make(map[string]map[string]bool)
+	err := h.forEach("", since, until, func(t types.Transition) {
+		cf, ok := counts[t.Check]
+		if !ok {
+			cf = &types.CheckFlakiness{Check: t.Check}
+			counts[t.Check] = cf
+			nodes[t.Check] = make(map[string]bool)
+		}
+		cf.Transitions++
+		nodes[t.Check][t.NodeID] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []types.CheckFlakiness{}
+	for check, cf := range counts {
+		cf.Nodes = len(nodes[check])
+		result = append(result, *cf)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Transitions != result[j].Transitions {
+			return result[i].Transitions > result[j].Transitions
+		}
+		return result[i].Check < result[j].Check
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// recoveries returns the mean and max time nodes took to recover from
+// each failing health check, for the failures which started and recovered
+// between since and until, slowest first.
+func (h *historyStore) recoveries(since, until time.Time) ([]types.CheckRecovery, error) {
+	type recovery struct {
+		count int
+		total time.Duration
+		max   time.Duration
+	}
+
+	recoveries := make(map[string]*recovery)
+	failingSince := make(map[string]time.Time)
+	err := h.forEach("", since, until, func(t types.Transition) {
+		key := t.NodeID + "/" + t.Check
+		if t.Failing {
+			if _, ok := failingSince[key]; !ok {
+				failingSince[key] = t.Time
+			}
+			return
+		}
+
+		start, ok := failingSince[key]
+		if !ok {
+			return
+		}
+		delete(failingSince, key)
+
+		r, ok := recoveries[t.Check]
+		if !ok {
+			r = &recovery{}
+			recoveries[t.Check] = r
+		}
+		d := t.Time.Sub(start)
+		r.count++
+		r.total += d
+		if d > r.max {
+			r.max = d
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []types.CheckRecovery{}
+	for check, r := range recoveries {
+		result = append(result, types.CheckRecovery{
+			Check:                    check,
+			Recoveries:               r.count,
+			MeanTimeToRecoverSeconds: (r.total / time.Duration(r.count)).Seconds(),
+			MaxTimeToRecoverSeconds:  r.max.Seconds(),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].MeanTimeToRecoverSeconds != result[j].MeanTimeToRecoverSeconds {
+			return result[i].MeanTimeToRecoverSeconds > result[j].MeanTimeToRecoverSeconds
+		}
+		return result[i].Check < result[j].Check
+	})
+	return result, nil
+}
+
+// Close closes the history database.
+func (h *historyStore) Close() error {
+	return h.db.Close()
+}
+
+// checkTransitions returns the health checks of a node which changed
+// since the previous aggregation cycle. The first observation of a health
+// check is a transition when it is failing, so that health checks which
+// are already failing (e.g. at startup) are accounted in the time to
+// recover.
+func checkTransitions(status nodeResult, previous map[string]types.HealthCheck, current []types.HealthCheck, now time.Time) []types.Transition {
+	var transitions []types.Transition
+	for _, curr := range current {
+		prev, ok := previous[curr.Type]
+		if ok && prev.Result == curr.Result || !ok && !curr.Failed() {
+			continue
+		}
+
+		transitions = append(transitions, types.Transition{
+			Time:        now,
+			NodeID:      status.NodeID,
+			NodeAddress: status.NodeAddress,
+			Datacenter:  status.Datacenter,
+			Check:       curr.Type,
+			From:        prev.Result,
+			To:          curr.Result,
+			Failing:     curr.Failed(),
+			Message:     curr.Message,
+		})
+	}
+	return transitions
+}
+
+// lastTransitions returns the most recent transition of every health
+// check of a node.
+func (h *historyStore) lastTransitions(nodeID string) (map[string]types.Transition, error) {
+	last := make(map[string]types.Transition)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(transitionsBucket).Bucket([]byte(nodeID))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			t := types.Transition{}
+			if err := json.Unmarshal(v, &t); err != nil {
+				continue
+			}
+			if _, ok := last[t.Check]; !ok {
+				last[t.Check] = t
+			}
+		}
+		return nil
+	})
+	return last, err
+}
+
+// continueTransitions checks the first observations of the health checks
+// of a node against its history: a health check first observed failing
+// after a restart, or after its detector was unreachable, is only a
+// transition if its last transition in the history is not to the same
+// result.
+func (h *historyStore) continueTransitions(nodeID string, transitions []types.Transition) ([]types.Transition, error) {
+	firstObserved := false
+	for _, t := range transitions {
+		if t.From == "" {
+			firstObserved = true
+		}
+	}
+	if !firstObserved {
+		return transitions, nil
+	}
+
+	last, err := h.lastTransitions(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	var result []types.Transition
+	for _, t := range transitions {
+		if prev, ok := last[t.Check]; ok && t.From == "" {
+			if prev.To == t.To {
+				continue
+			}
+			t.From = prev.To
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// recordTransitions stores the transitions of a node in the history,
+// unless running in dry run. The aggregator keeps running if they can't
+// be stored.
+func (a *aggregator) recordTransitions(nodeID string, transitions []types.Transition) {
+	if a.history == nil || a.dryRun || len(transitions) == 0 {
+		return
+	}
+	transitions, err := a.history.continueTransitions(nodeID, transitions)
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in reading history for node %s: %v", nodeID, err))
+		return
+	}
+	if len(transitions) == 0 {
+		return
+	}
+	if err := a.history.record(nodeID, transitions); err != nil {
+		log.Warning(fmt.Sprintf("Error in recording history for node %s: %v", nodeID, err))
+	}
+}
+
+// parseSince parses the since and until query parameters, formatted as
+// RFC3339 or as a duration before now e.g. 168h.
+func parseSince(value string, now time.Time, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// historyPeriod returns the since and until query parameters of a
+// history query. It defaults to the last 7 days.
+func historyPeriod(r *http.Request) (time.Time, time.Time, error) {
+	now := time.Now()
+	query := r.URL.Query()
+
+	since, err := parseSince(query.Get("since"), now, now.Add(-defaultHistoryPeriod))
+	if err != nil {
+		return since, now, fmt.Errorf("invalid since: %v", err)
+	}
+
+	until, err := parseSince(query.Get("until"), now, now)
+	if err != nil {
+		return since, until, fmt.Errorf("invalid until: %v", err)
+	}
+	return since, until, nil
+}
+
+// queryLimit returns the limit query parameter, or def.
+func queryLimit(r *http.Request, def int) (int, error) {
+	limit := r.URL.Query().Get("limit")
+	if limit == "" {
+		return def, nil
+	}
+	l, err := strconv.Atoi(limit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit: %v", err)
+	}
+	return l, nil
+}
+
+// historyHandler serves the /v1/history/ endpoints:
+// transitions (node_id, since, until, limit), flakiest (since, until,
+// limit) and mttr (since, until).
+func (a *aggregator) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.history == nil {
+		http.Error(w, "history is disabled", http.StatusNotFound)
+		return
+	}
+
+	since, until, err := historyPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	switch r.URL.Path {
+	case "/v1/history/transitions":
+		var limit int
+		if limit, err = queryLimit(r, 1000); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err = a.history.transitions(r.URL.Query().Get("node_id"), since, until, limit)
+	case "/v1/history/flakiest":
+		var limit int
+		if limit, err = queryLimit(r, 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err = a.history.flakiest(since, until, limit)
+	case "/v1/history/mttr":
+		result, err = a.history.recoveries(since, until)
+	default:
+		http.Error(w, "unknown history query", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
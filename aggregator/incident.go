@@ -0,0 +1,526 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var incidentsBucket = []byte("incidents")
+
+// incidentLedger opens an incident the first time a health check fails
+// on a node, and closes it when the health check passes again. Incidents
+// are persisted in the state store, keyed by the time they were opened,
+// and open incidents are kept in memory.
+type incidentLedger struct {
+	sync.Mutex
+	store *stateStore
+
+	// open incidents, by node ID and health check.
+	open map[string]*types.Incident
+
+	// closed are the incidents closed in the last aggregation cycle of
+	// each node, so that the actions of that cycle are recorded in them.
+	closed map[string][]*types.Incident
+}
+
+// newIncidentLedger returns the incident ledger, with the open incidents
+// restored from the state store. The store may be nil, in which case
+// incidents are only kept in memory until closed.
+func newIncidentLedger(store *stateStore) (*incidentLedger, error) {
+	l := &incidentLedger{
+		store:  store,
+		open:   make(map[string]*types.Incident),
+		closed: make(map[string][]*types.Incident),
+	}
+	if store == nil {
+		return l, nil
+	}
+
+	err := store.forEachIncident(time.Time{}, func(inc *types.Incident) {
+		if inc.Open {
+			l.open[incidentKey(inc.NodeID, inc.Check)] = inc
+		}
+	})
+	return l, err
+}
+
+func incidentKey(nodeID, check string) string {
+	return nodeID + "/" + check
+}
+
+// observe opens, updates and closes the incidents of a node with its
+// latest health checks. Incidents are closed when the health check passes
+// again, or is no longer reported by the detector e.g. once removed from
+// its config. When the detector is unreachable, the node health only has
+// the DetectorUnreachable health check, and the other incidents are kept
+// open.
+func (l *incidentLedger) observe(status nodeResult, checks []types.HealthCheck, enforced func(check string) bool, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.closed[status.NodeID] = nil
+	reachable := false
+	reported := make(map[string]bool, len(checks))
+	for _, hc := range checks {
+		reported[hc.Type] = true
+		if hc.Type != types.DetectorUnreachable {
+			reachable = true
+		}
+		key := incidentKey(status.NodeID, hc.Type)
+		inc, ok := l.open[key]
+
+		switch {
+		case hc.Failed() && !ok:
+			// The detector reports when the health check started failing,
+			// older detectors only when it last ran.
+			started := hc.FailingSince
+			if started.IsZero() {
+				started = hc.LastRun
+			}
+			if started.IsZero() || started.After(now) {
+				started = now
+			}
+			inc = &types.Incident{
+				ID:           fmt.Sprintf("%s/%s/%d", status.NodeID, hc.Type, now.Unix()),
+				NodeID:       status.NodeID,
+				NodeAddress:  status.NodeAddress,
+				Datacenter:   status.Datacenter,
+				Check:        hc.Type,
+				Enforced:     enforced(hc.Type),
+				Open:         true,
+				StartedAt:    started,
+				OpenedAt:     now,
+				LastSeen:     now,
+				FirstMessage: strings.TrimSpace(hc.Message),
+				LastMessage:  strings.TrimSpace(hc.Message),
+			}
+			l.open[key] = inc
+			log.Info(fmt.Sprintf("Node %s: incident %s opened: %s is %s.", status.NodeAddress, inc.ID, hc.Type, hc.Result))
+		case hc.Failed():
+			inc.LastSeen = now
+			inc.LastMessage = strings.TrimSpace(hc.Message)
+			inc.Enforced = inc.Enforced || enforced(hc.Type)
+		case ok:
+			l.close(key, inc, "health check is passing", now)
+		default:
+			continue
+		}
+		l.save(inc)
+	}
+
+	if !reachable {
+		return
+	}
+	for key, inc := range l.open {
+		if inc.NodeID == status.NodeID && !reported[inc.Check] {
+			l.close(key, inc, "health check is no longer reported", now)
+			l.save(inc)
+		}
+	}
+}
+
+// closeNode closes the open incidents of a node.
+func (l *incidentLedger) closeNode(nodeID, reason string, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	for key, inc := range l.open {
+		if inc.NodeID == nodeID {
+			l.close(key, inc, reason, now)
+			l.save(inc)
+		}
+	}
+	delete(l.closed, nodeID)
+}
+
+// close closes an incident. Caller must hold the lock.
+func (l *incidentLedger) close(key string, inc *types.Incident, reason string, now time.Time) {
+	inc.Open = false
+	inc.ClosedAt = now
+	inc.CloseReason = reason
+	inc.DurationSeconds = now.Sub(inc.OpenedAt).Seconds()
+	delete(l.open, key)
+	l.closed[inc.NodeID] = append(l.closed[inc.NodeID], inc)
+	log.Info(fmt.Sprintf("Node %s: incident %s closed after %s: %s.", inc.NodeAddress, inc.ID, now.Sub(inc.OpenedAt).Round(time.Second), reason))
+}
+
+// recordAction records an aggregator decision in the incidents it was
+// made for: the open incidents of its health checks, or all incidents of
+// the node, including the ones which just closed, for eligibility changes
+// without health checks e.g. when the node is made eligible again.
+func (l *incidentLedger) recordAction(event *types.AuditEvent, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	action := types.IncidentAction{
+		Time:   now,
+		Action: event.Action,
+		Result: event.Result,
+		Reason: event.Reason,
+		Error:  event.Error,
+	}
+
+	var targets []*types.Incident
+	if len(event.Checks) > 0 {
+		for _, hc := range event.Checks {
+			if inc, ok := l.open[incidentKey(event.NodeID, hc.Type)]; ok {
+				targets = append(targets, inc)
+			}
+		}
+	} else {
+		for _, inc := range l.open {
+			if inc.NodeID == event.NodeID {
+				targets = append(targets, inc)
+			}
+		}
+		targets = append(targets, l.closed[event.NodeID]...)
+	}
+
+	for _, inc := range targets {
+		inc.Actions = append(inc.Actions, action)
+		l.save(inc)
+	}
+}
+
+// save persists an incident. Caller must hold the lock. The aggregator
+// keeps running if the incident can't be persisted.
+func (l *incidentLedger) save(inc *types.Incident) {
+	if l.store == nil {
+		return
+	}
+	if err := l.store.saveIncident(inc); err != nil {
+		log.Warning(fmt.Sprintf("Error in saving incident %s: %v", inc.ID, err))
+	}
+}
+
+// incidentFilter selects incidents when listing them.
+type incidentFilter struct {
+	state  string
+	nodeID string
+	check  string
+	since  time.Time
+	limit  int
+}
+
+func (f *incidentFilter) match(inc *types.Incident) bool {
+	if f.nodeID != "" && inc.NodeID != f.nodeID {
+		return false
+	}
+	if f.check != "" && inc.Check != f.check {
+		return false
+	}
+	return !inc.OpenedAt.Before(f.since)
+}
+
+// list returns the incidents matching the filter, most recently opened
+// last. Open incidents have their duration so far. If more than limit
+// incidents match, only the most recent ones are returned.
+func (l *incidentLedger) list(filter incidentFilter, now time.Time) ([]types.Incident, error) {
+	// The open incidents are copied under the lock, and the closed ones
+	// read from the store without it, not to block the aggregation loop.
+	result := []types.Incident{}
+	if filter.state != "closed" {
+		l.Lock()
+		for _, inc := range l.open {
+			if filter.match(inc) {
+				c := *inc
+				c.Actions = append([]types.IncidentAction(nil), inc.Actions...)
+				c.DurationSeconds = now.Sub(inc.OpenedAt).Seconds()
+				result = append(result, c)
+			}
+		}
+		l.Unlock()
+	}
+
+	if filter.state != "open" && l.store != nil {
+		// An incident closed since the open incidents were copied is
+		// listed once, closed.
+		open := make(map[string]int, len(result))
+		for i, inc := range result {
+			open[inc.ID] = i
+		}
+		var closed []types.Incident
+		err := l.store.forEachIncident(filter.since, func(inc *types.Incident) {
+			if inc.Open || !filter.match(inc) {
+				return
+			}
+			if i, ok := open[inc.ID]; ok {
+				result[i] = *inc
+				return
+			}
+			closed = append(closed, *inc)
+		})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, closed...)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].OpenedAt.Before(result[j].OpenedAt)
+	})
+	if filter.limit > 0 && len(result) > filter.limit {
+		result = result[len(result)-filter.limit:]
+	}
+	return result, nil
+}
+
+// slo returns the time to detect and the time to recover of the
+// incidents opened since and closed, per health check.
+func (l *incidentLedger) slo(since time.Time, now time.Time) ([]types.IncidentSLO, error) {
+	closed, err := l.list(incidentFilter{state: "closed", since: since}, now)
+	if err != nil {
+		return nil, err
+	}
+
+	detect := make(map[string][]float64)
+	recovery := make(map[string][]float64)
+	for _, inc := range closed {
+		detect[inc.Check] = append(detect[inc.Check], inc.OpenedAt.Sub(inc.StartedAt).Seconds())
+		recovery[inc.Check] = append(recovery[inc.Check], inc.ClosedAt.Sub(inc.OpenedAt).Seconds())
+	}
+
+	result := []types.IncidentSLO{}
+	for check := range detect {
+		result = append(result, types.IncidentSLO{
+			Check:                    check,
+			Incidents:                len(detect[check]),
+			MeanTimeToDetectSeconds:  mean(detect[check]),
+			P95TimeToDetectSeconds:   percentile(detect[check], 95),
+			MeanTimeToRecoverSeconds: mean(recovery[check]),
+			P95TimeToRecoverSeconds:  percentile(recovery[check], 95),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Check < result[j].Check
+	})
+	return result, nil
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	return total / float64(len(values))
+}
+
+// percentile returns the nearest rank percentile of values.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// updateMetrics exports the number of open incidents per datacenter and
+// health check. Nodes are not a label, so the cardinality is bounded by
+// the number of health checks.
+func (l *incidentLedger) updateMetrics(dc string) {
+	l.Lock()
+	defer l.Unlock()
+
+	counts := make(map[[2]string]int)
+	for _, inc := range l.open {
+		counts[[2]string{inc.Datacenter, inc.Check}]++
+	}
+
+	incidentsOpenGauge.Reset()
+	for key, count := range counts {
+		incidentsOpenGauge.With(prometheus.Labels{"dc": dc, "datacenter": key[0], "check": key[1]}).Set(float64(count))
+	}
+}
+
+// prune removes the incidents closed before the given time.
+func (l *incidentLedger) prune(before time.Time) (int, error) {
+	if l.store == nil {
+		return 0, nil
+	}
+	return l.store.pruneIncidents(before)
+}
+
+// observeIncidents updates the incidents of a node, unless running in dry run.
+func (a *aggregator) observeIncidents(status nodeResult, checks []types.HealthCheck, policy types.NodePolicy) {
+	if a.incidents == nil || a.dryRun {
+		return
+	}
+	a.incidents.observe(status, checks, func(check string) bool {
+		return a.isEnforced(policy, status.NodeID, check)
+	}, a.now())
+}
+
+// incidentStoreKey sorts the incidents by the time they were opened.
+func incidentStoreKey(inc *types.Incident) []byte {
+	return append(timeKey(inc.OpenedAt), inc.ID...)
+}
+
+// saveIncident persists an incident.
+func (s *stateStore) saveIncident(inc *types.Incident) error {
+	data, err := json.Marshal(inc)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(incidentsBucket).Put(incidentStoreKey(inc), data)
+	})
+}
+
+// forEachIncident calls fn with the incidents opened since, oldest first.
+func (s *stateStore) forEachIncident(since time.Time, fn func(inc *types.Incident)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(incidentsBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		k, v := c.First()
+		if !since.IsZero() {
+			k, v = c.Seek(timeKey(since))
+		}
+		for ; k != nil; k, v = c.Next() {
+			inc := &types.Incident{}
+			if err := json.Unmarshal(v, inc); err != nil {
+				continue
+			}
+			fn(inc)
+		}
+		return nil
+	})
+}
+
+// pruneIncidents removes the incidents closed before the given time.
+// Open incidents are kept, however old.
+func (s *stateStore) pruneIncidents(before time.Time) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(incidentsBucket)
+
+		// Incidents are opened before they are closed, only the ones
+		// opened before the cutoff need to be checked.
+		var keys [][]byte
+		c := bucket.Cursor()
+		cutoff := timeKey(before)
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], cutoff) < 0; k, v = c.Next() {
+			inc := &types.Incident{}
+			if err := json.Unmarshal(v, inc); err == nil && (inc.Open || !inc.ClosedAt.Before(before)) {
+				continue
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// incidentsHandler serves /v1/incidents, which lists the incidents.
+// Incidents can be filtered with the state (open, the default, closed or
+// all), node_id, check, since and limit query parameters.
+// /v1/incidents/slo returns the time to detect and time to recover per
+// health check, of the incidents closed since (default: 7 days).
+func (a *aggregator) incidentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.incidents == nil {
+		http.Error(w, "incident ledger is not available", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	query := r.URL.Query()
+	since, err := parseSince(query.Get("since"), now, time.Time{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid since: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Path == "/v1/incidents/slo" {
+		if query.Get("since") == "" {
+			since = now.Add(-defaultHistoryPeriod)
+		}
+		slo, err := a.incidents.slo(since, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, slo)
+		return
+	}
+
+	filter := incidentFilter{
+		state:  query.Get("state"),
+		nodeID: query.Get("node_id"),
+		check:  query.Get("check"),
+		since:  since,
+	}
+	switch filter.state {
+	case "":
+		filter.state = "open"
+	case "open", "closed", "all":
+	default:
+		http.Error(w, "invalid state. Set open, closed or all", http.StatusBadRequest)
+		return
+	}
+
+	if filter.limit, err = queryLimit(r, 1000); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := a.incidents.list(filter, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/cronexpr"
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sources of maintenance windows.
+const (
+	maintenanceSourceConfig = "config"
+	maintenanceSourceAdmin  = "admin"
+)
+
+// maintenanceWindow is a validated maintenance window.
+type maintenanceWindow struct {
+	types.MaintenanceWindow
+	source   string
+	expr     *cronexpr.Expression
+	duration time.Duration
+	location *time.Location
+}
+
+// maintenanceConfig is the --maintenance-config file.
+type maintenanceConfig struct {
+	Windows []types.MaintenanceWindow `json:"windows"`
+}
+
+// compileWindow validates a maintenance window.
+func compileWindow(w types.MaintenanceWindow, source string) (*maintenanceWindow, error) {
+	if w.ID == "" {
+		return nil, fmt.Errorf("maintenance window id must be set")
+	}
+
+	mw := &maintenanceWindow{MaintenanceWindow: w, source: source, location: time.UTC}
+	if w.Schedule == "" {
+		if w.Start.IsZero() || !w.End.After(w.Start) {
+			return nil, fmt.Errorf("maintenance window %s: either schedule and duration, or start and end (after start) must be set", w.ID)
+		}
+		return mw, nil
+	}
+
+	expr, err := cronexpr.Parse(w.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("maintenance window %s: invalid schedule: %v", w.ID, err)
+	}
+	mw.expr = expr
+
+	mw.duration, err = time.ParseDuration(w.Duration)
+	if err != nil || mw.duration <= 0 {
+		return nil, fmt.Errorf("maintenance window %s: invalid duration %q", w.ID, w.Duration)
+	}
+
+	if w.Timezone != "" {
+		mw.location, err = time.LoadLocation(w.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %s: invalid timezone: %v", w.ID, err)
+		}
+	}
+	return mw, nil
+}
+
+// active returns true if the maintenance window is in progress. A recurring
+// window is in progress if it started less than its duration ago.
+func (w *maintenanceWindow) active(now time.Time) bool {
+	if w.expr == nil {
+		return !now.Before(w.Start) && now.Before(w.End)
+	}
+
+	start := w.expr.Next(now.In(w.location).Add(-w.duration))
+	return !start.IsZero() && !start.After(now)
+}
+
+// appliesTo returns true if the maintenance window applies to the node.
+func (w *maintenanceWindow) appliesTo(datacenter, nodeClass string) bool {
+	return (len(w.Datacenters) == 0 || contains(w.Datacenters, datacenter)) &&
+		(len(w.NodeClasses) == 0 || contains(w.NodeClasses, nodeClass))
+}
+
+// covers returns true if the health check is alert-only during the window.
+func (w *maintenanceWindow) covers(check string) bool {
+	return len(w.Checks) == 0 || contains(w.Checks, check)
+}
+
+// loadMaintenanceConfig reads the maintenance windows from path.
+func loadMaintenanceConfig(path string) ([]*maintenanceWindow, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := maintenanceConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error in reading maintenance config %s: %v", path, err)
+	}
+
+	windows := make([]*maintenanceWindow, 0, len(config.Windows))
+	for _, w := range config.Windows {
+		mw, err := compileWindow(w, maintenanceSourceConfig)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, mw)
+	}
+	return windows, nil
+}
+
+// maintenanceWindows returns all the maintenance windows, from the config
+// file and the admin API.
+func (a *aggregator) maintenanceWindows() []*maintenanceWindow {
+	return append(append([]*maintenanceWindow{}, a.configWindows...), a.admin.maintenanceWindows()...)
+}
+
+// nodeMaintenance returns the maintenance windows in progress for a node.
+func (a *aggregator) nodeMaintenance(now time.Time, datacenter, nodeClass string) []*maintenanceWindow {
+	var windows []*maintenanceWindow
+	for _, w := range a.maintenanceWindows() {
+		if w.active(now) && w.appliesTo(datacenter, nodeClass) {
+			windows = append(windows, w)
+		}
+	}
+	return windows
+}
+
+// maintenanceCovers returns the maintenance window under which the health
+// check is alert-only, or nil.
+func maintenanceCovers(windows []*maintenanceWindow, check string) *maintenanceWindow {
+	for _, w := range windows {
+		if w.covers(check) {
+			return w
+		}
+	}
+	return nil
+}
+
+// activeMaintenanceWindows returns the number of maintenance windows in progress.
+func (a *aggregator) activeMaintenanceWindows(now time.Time) int {
+	count := 0
+	for _, w := range a.maintenanceWindows() {
+		if w.active(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// maintenanceWindows returns the compiled maintenance windows of the admin API.
+func (a *adminStore) maintenanceWindows() []*maintenanceWindow {
+	a.RLock()
+	defer a.RUnlock()
+	return a.windows
+}
+
+// compileWindows compiles the maintenance windows of the admin state, once
+// they changed. Caller must hold the lock, or own the store.
+func (a *adminStore) compileWindows() {
+	windows := make([]*maintenanceWindow, 0, len(a.state.MaintenanceWindows))
+	for _, w := range a.state.MaintenanceWindows {
+		mw, err := compileWindow(w, maintenanceSourceAdmin)
+		if err != nil {
+			// Windows are validated when added, this only happens if the admin state was edited.
+			log.Warning(fmt.Sprintf("Ignoring invalid maintenance window: %v", err))
+			continue
+		}
+		windows = append(windows, mw)
+	}
+	a.windows = windows
+}
+
+// addMaintenanceWindow adds a maintenance window, replacing any existing
+// window with the same ID.
+func (a *adminStore) addMaintenanceWindow(w types.MaintenanceWindow) error {
+	a.Lock()
+	defer a.Unlock()
+
+	a.removeWindowLocked(w.ID)
+	a.state.MaintenanceWindows = append(a.state.MaintenanceWindows, w)
+	a.compileWindows()
+	return a.save()
+}
+
+// removeMaintenanceWindow removes a maintenance window.
+// It returns false if no such window exists.
+func (a *adminStore) removeMaintenanceWindow(id string) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if !a.removeWindowLocked(id) {
+		return false, nil
+	}
+	a.compileWindows()
+	return true, a.save()
+}
+
+func (a *adminStore) removeWindowLocked(id string) bool {
+	found := false
+	windows := []types.MaintenanceWindow{}
+	for _, w := range a.state.MaintenanceWindows {
+		if w.ID == id {
+			found = true
+			continue
+		}
+		windows = append(windows, w)
+	}
+	a.state.MaintenanceWindows = windows
+	return found
+}
+
+// maintenanceWindowStatus is a maintenance window, as returned by the admin API.
+type maintenanceWindowStatus struct {
+	types.MaintenanceWindow
+	Source string `json:"source"`
+	Active bool   `json:"active"`
+}
+
+// maintenanceHandler serves /v1/admin/maintenance.
+// GET lists the maintenance windows, POST adds one, and DELETE removes
+// the one matching the id query parameter. Windows from the config file
+// can't be changed through the admin API.
+func (a *aggregator) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		windows := []maintenanceWindowStatus{}
+		for _, mw := range a.maintenanceWindows() {
+			windows = append(windows, maintenanceWindowStatus{
+				MaintenanceWindow: mw.MaintenanceWindow,
+				Source:            mw.source,
+				Active:            mw.active(now),
+			})
+		}
+		writeJSON(w, http.StatusOK, windows)
+	case http.MethodPost:
+		req := types.MaintenanceWindow{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		for _, cw := range a.configWindows {
+			if cw.ID == req.ID {
+				http.Error(w, fmt.Sprintf("maintenance window %s is defined in the config file", req.ID), http.StatusConflict)
+				return
+			}
+		}
+
+		if _, err := compileWindow(req, maintenanceSourceAdmin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.admin.addMaintenanceWindow(req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info(fmt.Sprintf("Maintenance window %s added through admin API.", req.ID))
+		writeJSON(w, http.StatusOK, req)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		found, err := a.admin.removeMaintenanceWindow(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "maintenance window not found", http.StatusNotFound)
+			return
+		}
+		log.Info(fmt.Sprintf("Maintenance window %s removed through admin API.", id))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -5,60 +5,182 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"reflect"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Aggregator metrics are prefixed with npd_aggregator_. Node addresses
+// and IDs are only used as labels by the opt-in node info metric, whose
+// series are removed once the node is gone, so that the number of series
+// doesn't grow with the fleet.
 var (
 	aggregatorCyclesTotalCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "aggregator_cycles_total",
+			Name: "npd_aggregator_cycles_total",
 			Help: "Number of cycles",
 		}, []string{"dc"})
 
 	aggregatorProcessingTime = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "aggregator_processing_time",
-			Help: "time spend aggregating information for this cycle",
+			Name: "npd_aggregator_cycle_duration_seconds",
+			Help: "Time spent aggregating information in the last cycle",
 		}, []string{"dc"})
 
 	nodesTotalGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "nodes_total",
+			Name: "npd_aggregator_nodes",
 			Help: "Total number of nodes",
 		}, []string{"dc"})
 
 	eligibleNodesGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "nodes_eligible",
+			Name: "npd_aggregator_nodes_eligible",
 			Help: "Number of eligible nodes for this cycle",
 		}, []string{"dc"})
 
+	healthyNodesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_nodes_healthy",
+			Help: "Number of nodes with all health checks passing in the last cycle",
+		}, []string{"dc"})
+
+	unhealthyNodesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_nodes_unhealthy",
+			Help: "Number of nodes with at least one failing health check in the last cycle",
+		}, []string{"dc"})
+
+	checkFailingNodesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_check_failing_nodes",
+			Help: "Number of nodes where a health check is failing in the last cycle",
+		}, []string{"dc", "datacenter", "check"})
+
 	nodeHandleErrorsCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "nodes_handle_errors",
+			Name: "npd_aggregator_node_errors_total",
 			Help: "Count of errors while handling nodes",
 		}, []string{"dc"})
 
 	nodeHandleSkipCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "nodes_handle_skip",
+			Name: "npd_aggregator_nodes_skipped_total",
 			Help: "Count of nodes skipped",
 		}, []string{"dc"})
 
-	healthCheckHealthyCounter = prometheus.NewCounterVec(
+	nodePollDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "npd_aggregator_node_poll_duration_seconds",
+			Help:    "Time to get the node health from the detector of a node",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"dc", "outcome"})
+
+	actionsCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "nodes_healthy",
-			Help: "Count of healthy nodes",
-		}, []string{"dc", "check"})
+			Name: "npd_aggregator_actions_total",
+			Help: "Count of aggregator actions, by type and outcome",
+		}, []string{"dc", "action", "outcome"})
+
+	aggregatorPausedGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_paused",
+			Help: "If the aggregator is paused, globally or for a datacenter",
+		}, []string{"scope"})
+
+	exclusionsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_exclusions",
+			Help: "Number of active node and health check exclusions",
+		}, []string{"type"})
+
+	scopeEligibleNodesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_threshold_scope_nodes_eligible",
+			Help: "Number of eligible nodes in a threshold scope",
+		}, []string{"dc", "datacenter", "node_pool", "node_class"})
 
-	healthCheckUnhealthyCounter = prometheus.NewCounterVec(
+	scopeTotalNodesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_threshold_scope_nodes_total",
+			Help: "Number of nodes in a threshold scope",
+		}, []string{"dc", "datacenter", "node_pool", "node_class"})
+
+	scopeEligibleRatioGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_threshold_scope_eligible_percentage",
+			Help: "Percentage of eligible nodes (or eligible capacity in capacity threshold mode) in a threshold scope",
+		}, []string{"dc", "datacenter", "node_pool", "node_class"})
+
+	scopeThresholdGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_threshold_scope_percentage",
+			Help: "Threshold percentage of a threshold scope",
+		}, []string{"dc", "datacenter", "node_pool", "node_class"})
+
+	scopeHeadroomGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_threshold_scope_headroom_percentage",
+			Help: "Percentage points of eligible nodes (or eligible capacity) above the threshold of a threshold scope",
+		}, []string{"dc", "datacenter", "node_pool", "node_class"})
+
+	scopeHeadroomNodesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_threshold_scope_headroom_nodes",
+			Help: "Number of nodes which can still be taken out of the scheduling pool before the threshold of a threshold scope is reached",
+		}, []string{"dc", "datacenter", "node_pool", "node_class"})
+
+	cordonCandidatesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_cordon_candidates",
+			Help: "Number of nodes which should be taken out of the scheduling pool in the last cycle",
+		}, []string{"dc"})
+
+	deferredCordonsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_cordons_deferred",
+			Help: "Number of nodes which should be taken out of the scheduling pool, but were deferred by the threshold in the last cycle",
+		}, []string{"dc"})
+
+	detectorUnreachableGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_nodes_detector_unreachable",
+			Help: "Number of eligible nodes where the detector is not answering",
+		}, []string{"dc"})
+
+	nodesQuarantinedGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_nodes_quarantined",
+			Help: "Number of nodes held ineligible for flapping",
+		}, []string{"dc"})
+
+	nodeQuarantinesCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "nodes_unhealthy",
-			Help: "Count of unhealthy nodes",
-		}, []string{"dc", "check", "host"})
+			Name: "npd_aggregator_quarantines_total",
+			Help: "Count of nodes quarantined for flapping",
+		}, []string{"dc"})
+
+	incidentsOpenGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_incidents_open",
+			Help: "Number of open incidents, per datacenter and health check",
+		}, []string{"dc", "datacenter", "check"})
+
+	maintenanceWindowsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_maintenance_windows_active",
+			Help: "Number of maintenance windows in progress",
+		}, []string{"dc"})
+
+	nodeInfoGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "npd_aggregator_node_info",
+			Help: "Health of a node in the last cycle it was checked. Only exported with --node-info-metrics",
+		}, []string{"dc", "node_id", "address", "datacenter", "eligibility", "healthy", "failing_checks"})
 
 	aggregatorInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "npd_aggregator_info",
@@ -66,6 +188,58 @@ var (
 	}, []string{"version"})
 )
 
+// nodeInfoMetrics keeps a single npd_aggregator_node_info series per node.
+// The series of a node is replaced when its labels change, and removed
+// once the node hasn't been checked for ttl, e.g. when it left the cluster.
+type nodeInfoMetrics struct {
+	sync.Mutex
+	ttl    time.Duration
+	series map[string]*nodeInfoSeries
+}
+
+type nodeInfoSeries struct {
+	labels   prometheus.Labels
+	lastSeen time.Time
+}
+
+// nodeInfoMetric is the node info metric, nil unless --node-info-metrics is set.
+var nodeInfoMetric *nodeInfoMetrics
+
+func newNodeInfoMetrics(ttl time.Duration) *nodeInfoMetrics {
+	return &nodeInfoMetrics{
+		ttl:    ttl,
+		series: make(map[string]*nodeInfoSeries),
+	}
+}
+
+// set exports the node info series of a node.
+func (m *nodeInfoMetrics) set(nodeID string, labels prometheus.Labels, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	if s, ok := m.series[nodeID]; ok && !reflect.DeepEqual(s.labels, labels) {
+		nodeInfoGauge.Delete(s.labels)
+	}
+	m.series[nodeID] = &nodeInfoSeries{labels: labels, lastSeen: now}
+	nodeInfoGauge.With(labels).Set(1)
+}
+
+// expire removes the series of the nodes which weren't checked for ttl.
+func (m *nodeInfoMetrics) expire(now time.Time) int {
+	m.Lock()
+	defer m.Unlock()
+
+	removed := 0
+	for nodeID, s := range m.series {
+		if now.Sub(s.lastSeen) > m.ttl {
+			nodeInfoGauge.Delete(s.labels)
+			delete(m.series, nodeID)
+			removed++
+		}
+	}
+	return removed
+}
+
 func registerMetrics() *prometheus.Registry {
 	r := prometheus.NewRegistry()
 	r.MustRegister(aggregatorCyclesTotalCounter)
@@ -74,16 +248,35 @@ func registerMetrics() *prometheus.Registry {
 	r.MustRegister(nodesTotalGauge)
 	r.MustRegister(nodeHandleErrorsCounter)
 	r.MustRegister(nodeHandleSkipCounter)
-	r.MustRegister(healthCheckHealthyCounter)
-	r.MustRegister(healthCheckUnhealthyCounter)
+	r.MustRegister(healthyNodesGauge)
+	r.MustRegister(unhealthyNodesGauge)
+	r.MustRegister(checkFailingNodesGauge)
+	r.MustRegister(nodePollDuration)
+	r.MustRegister(actionsCounter)
 	r.MustRegister(prometheus.NewGoCollector())
 	r.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	r.MustRegister(aggregatorPausedGauge)
+	r.MustRegister(exclusionsGauge)
 	r.MustRegister(aggregatorInfo)
+	r.MustRegister(scopeEligibleNodesGauge)
+	r.MustRegister(scopeTotalNodesGauge)
+	r.MustRegister(scopeEligibleRatioGauge)
+	r.MustRegister(scopeThresholdGauge)
+	r.MustRegister(scopeHeadroomGauge)
+	r.MustRegister(scopeHeadroomNodesGauge)
+	r.MustRegister(cordonCandidatesGauge)
+	r.MustRegister(deferredCordonsGauge)
+	r.MustRegister(detectorUnreachableGauge)
+	r.MustRegister(nodesQuarantinedGauge)
+	r.MustRegister(nodeQuarantinesCounter)
+	r.MustRegister(maintenanceWindowsGauge)
+	r.MustRegister(incidentsOpenGauge)
+	r.MustRegister(nodeInfoGauge)
 
 	return r
 }
 
-func metricsExporter(exporterAddr string, exporterPort int, appVersion string) {
+func metricsExporter(a *aggregator, exporterAddr string, exporterPort int, appVersion string) {
 	addr := net.JoinHostPort(exporterAddr, strconv.Itoa(exporterPort))
 
 	registry := registerMetrics()
@@ -94,6 +287,8 @@ func metricsExporter(exporterAddr string, exporterPort int, appVersion string) {
 		mux := http.NewServeMux()
 		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 		mux.HandleFunc("/health", healthCheckHandler)
+		a.registerAPIHandlers(mux)
+		a.registerAdminHandlers(mux)
 		if err := http.ListenAndServe(addr, mux); err != nil {
 			log.Fatalf("Failed to start Prometheus scrape endpoint: %v", err)
 		}
@@ -0,0 +1,104 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dynamic node meta keys published by the aggregator when running with
+// --publish-node-meta, so that jobs can constrain on node problems e.g.
+//
+//	constraint {
+//	  attribute = "${meta.npd.problem.docker}"
+//	  operator  = "is_not_set"
+//	}
+const (
+	metaHealthy       = "npd.healthy"
+	metaProblemPrefix = "npd.problem."
+)
+
+// nodeMetaApplyRequest is the body of the Nomad dynamic node metadata
+// API (PUT /v1/client/metadata). A nil value removes the key.
+type nodeMetaApplyRequest struct {
+	NodeID string
+	Meta   map[string]*string
+}
+
+// nodeMetaUpdate returns the dynamic node meta changes needed to publish
+// the health checks of a node. Keys of problems which are resolved are
+// removed. It returns nil if the node meta is already up to date.
+func nodeMetaUpdate(meta map[string]string, checks []types.HealthCheck) map[string]*string {
+	desired := make(map[string]string)
+	healthy := true
+	for _, hc := range checks {
+		if hc.Failed() {
+			healthy = false
+			desired[metaProblemPrefix+hc.Type] = hc.Result
+		}
+	}
+	desired[metaHealthy] = strconv.FormatBool(healthy)
+
+	update := make(map[string]*string)
+	for key, val := range desired {
+		if current, ok := meta[key]; !ok || current != val {
+			v := val
+			update[key] = &v
+		}
+	}
+
+	for key := range meta {
+		if _, ok := desired[key]; !ok && strings.HasPrefix(key, metaProblemPrefix) {
+			update[key] = nil
+		}
+	}
+
+	if len(update) == 0 {
+		return nil
+	}
+	return update
+}
+
+// publishNodeMeta writes the failing health checks of a node into its
+// dynamic node meta, using the Nomad node metadata API.
+func publishNodeMeta(client *api.Client, nodeInfo *api.Node, address string, checks []types.HealthCheck) error {
+	update := nodeMetaUpdate(nodeInfo.Meta, checks)
+	if update == nil {
+		return nil
+	}
+
+	req := &nodeMetaApplyRequest{
+		NodeID: nodeInfo.ID,
+		Meta:   update,
+	}
+
+	endpoint := "/v1/client/metadata?node_id=" + url.QueryEscape(nodeInfo.ID)
+	if _, err := client.Raw().Write(endpoint, req, nil, nil); err != nil {
+		return fmt.Errorf("error in updating node meta: %v", err)
+	}
+
+	log.Debug(fmt.Sprintf("Node %s: published %d node meta changes.", address, len(update)))
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// nomadCluster is the nodeSource and the actuator of a live Nomad cluster.
+type nomadCluster struct {
+	client *api.Client
+}
+
+// listNodes lists the nodes with the raw API, to get the node pools.
+func (n *nomadCluster) listNodes(resources bool) ([]*nodeStub, error) {
+	listOptions := queryOptions
+	if resources {
+		listOptions = &api.QueryOptions{AllowStale: true, Params: map[string]string{"resources": "true"}}
+	}
+
+	stubs := []*nodeStub{}
+	if _, err := n.client.Raw().Query("/v1/nodes", &stubs, listOptions); err != nil {
+		return nil, err
+	}
+	return stubs, nil
+}
+
+func (n *nomadCluster) nodeInfo(nodeID string) (*api.Node, error) {
+	nodeInfo, _, err := n.client.Nodes().Info(nodeID, queryOptions)
+	return nodeInfo, err
+}
+
+func (n *nomadCluster) toggleEligibility(nodeID string, eligible bool) error {
+	_, err := n.client.Nodes().ToggleEligibility(nodeID, eligible, nil)
+	return err
+}
+
+func (n *nomadCluster) publishNodeMeta(nodeInfo *api.Node, address string, checks []types.HealthCheck) error {
+	return publishNodeMeta(n.client, nodeInfo, address, checks)
+}
+
+// httpDetector reaches out to the detectors over HTTP.
+type httpDetector struct {
+	port      string
+	authToken string
+}
+
+// nodeHealth reaches out to the detector running on the node, and
+// returns the node health (/v1/nodehealth/).
+func (d *httpDetector) nodeHealth(address string) ([]types.HealthCheck, error) {
+	npdServer := fmt.Sprintf("http://%s%s", address, d.port)
+
+	npdActive, err := isNpdServerActive(npdServer, d.authToken)
+	if err != nil {
+		log.Debug(fmt.Sprintf("Error: %v\n", err))
+		return nil, fmt.Errorf("NNPD detector server is not active, maybe node was ineligible when npd was deployed")
+	}
+
+	if !npdActive {
+		return nil, fmt.Errorf("node problem detector /v1/health is unhealthy")
+	}
+
+	url := npdServer + "/v1/nodehealth/"
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error in building /v1/nodehealth/ HTTP request: %v", err)
+	}
+
+	if d.authToken != "" {
+		base64EncodedToken := base64.StdEncoding.EncodeToString([]byte(d.authToken))
+		req.Header.Set("Authorization", "Basic "+base64EncodedToken)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	httpClient := &http.Client{Timeout: time.Second * 5}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error in getting /v1/nodehealth/ HTTP response: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error in reading /v1/nodehealth/ HTTP response: %v", err)
+	}
+
+	current := []types.HealthCheck{}
+	if err := json.Unmarshal(body, &current); err != nil {
+		return nil, fmt.Errorf("error in unmarshalling /v1/nodehealth/ HTTP response body: %v", err)
+	}
+	return current, nil
+}
+
+// Check if Nomad node problem detector (nNPD) HTTP server is healthy and active.
+func isNpdServerActive(npdServer, authToken string) (bool, error) {
+	url := npdServer + "/v1/health/"
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if authToken != "" {
+		base64EncodedToken := base64.StdEncoding.EncodeToString([]byte(authToken))
+		req.Header.Set("Authorization", "Basic "+base64EncodedToken)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: time.Second * 5}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var planCommand = &cli.Command{
+	Name:  "plan",
+	Usage: "Run a single aggregation cycle in dry run, and print the eligibility changes the aggregator would make",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "format",
+			Value: "table",
+			Usage: "Output format: table or json",
+		},
+	}, aggregatorFlags...),
+	Action: func(c *cli.Context) error {
+		return plan(c)
+	},
+}
+
+// planReport is the output of `npd aggregator plan`.
+type planReport struct {
+	Paused      bool         `json:"paused"`
+	Cordon      int          `json:"cordon"`
+	Uncordon    int          `json:"uncordon"`
+	Deferred    int          `json:"deferred"`
+	NotEnforced int          `json:"not_enforced"`
+	Skipped     int          `json:"skipped"`
+	Nodes       []nodeResult `json:"nodes"`
+}
+
+func plan(context *cli.Context) error {
+	format := context.String("format")
+	if format != "table" && format != "json" {
+		return fmt.Errorf("invalid --format %s. Supported formats are table and json", format)
+	}
+
+	a, err := newAggregator(context)
+	if err != nil {
+		return err
+	}
+	a.dryRun = true
+
+	// Per node decisions are part of the plan, only log warnings.
+	if !context.Bool("debug") {
+		log.SetLevel(log.WarnLevel)
+	}
+
+	if len(a.detectorDCs) == 0 {
+		return fmt.Errorf("no detector datacenter. Set --detector-datacenter or the environment variable `NOMAD_DC'")
+	}
+
+	// Use the state and the admin overrides of the aggregator, if available.
+	// Without state, nodes are evaluated as in the first aggregation cycle.
+	dataDir := getDataDir(context)
+	a.admin, err = loadAdminStore(adminStatePath(dataDir))
+	if err != nil {
+		return err
+	}
+	a.admin.path = ""
+	a.admin.expire(time.Now())
+
+	store, err := openStateStoreReadOnly(stateStorePath(dataDir))
+	if err != nil {
+		log.Warning(fmt.Sprintf("Aggregator state is not available: %v. Nodes are evaluated as in the first aggregation cycle.", err))
+	} else {
+		a.records, err = store.loadNodes()
+		store.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	results, err := a.runCycle()
+	if err != nil {
+		return fmt.Errorf("error in listing nomad nodes: %v", err)
+	}
+
+	return writePlan(os.Stdout, format, newPlanReport(a.admin.isPaused(""), results))
+}
+
+// newPlanReport summarizes the results of a dry run aggregation cycle.
+func newPlanReport(paused bool, results []nodeResult) *planReport {
+	report := &planReport{
+		Paused: paused,
+		Nodes:  results,
+	}
+
+	for _, result := range results {
+		switch {
+		case result.Skipped != "":
+			report.Skipped++
+		case result.Event == nil:
+		case result.Event.Result == types.AuditResultBlocked:
+			report.Deferred++
+		case result.Event.Result == types.AuditResultDryRun:
+			report.NotEnforced++
+		case result.Event.Action == eligibilityString(true):
+			report.Uncordon++
+		default:
+			report.Cordon++
+		}
+	}
+	return report
+}
+
+// writePlan prints the plan report in the given format.
+func writePlan(w io.Writer, format string, report *planReport) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tADDRESS\tDATACENTER\tACTION\tRESULT\tRANK\tREASON")
+	for _, result := range report.Nodes {
+		action, res, rank, reason := "none", "-", "-", ""
+		switch {
+		case result.Skipped != "":
+			action, reason = "skip", result.Skipped
+		case result.Event != nil:
+			action, res, reason = result.Event.Action, result.Event.Result, result.Event.Reason
+			if result.Event.Rank > 0 {
+				rank = strconv.Itoa(result.Event.Rank)
+			}
+			if result.Event.Error != "" {
+				reason = fmt.Sprintf("%s (%s)", reason, result.Event.Error)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", result.NodeID, result.NodeAddress, result.Datacenter, action, res, rank, reason)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nPlan: %d to cordon, %d to uncordon, %d deferred by threshold, %d not enforced, %d skipped.\n",
+		report.Cordon, report.Uncordon, report.Deferred, report.NotEnforced, report.Skipped)
+	if report.Paused {
+		fmt.Fprintln(w, "Aggregator is paused, no changes will be made until it is resumed.")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Node meta keys which can be set on a Nomad client to override the
+// aggregator policy for that node. e.g.
+//
+//	client {
+//	  meta {
+//	    "npd.ignore"  = "true"
+//	    "npd.enforce" = "docker,ntp"
+//	  }
+//	}
+const (
+	// metaIgnore set to true, skips the node entirely.
+	metaIgnore = "npd.ignore"
+	// metaEnforce is a comma separated list of health checks which are
+	// enforced on the node, in addition to --enforce-health-check.
+	metaEnforce = "npd.enforce"
+	// metaUnenforce is a comma separated list of health checks from
+	// --enforce-health-check which are not enforced on the node.
+	metaUnenforce = "npd.unenforce"
+)
+
+// nodePolicy returns the effective policy of a node, by merging the
+// --enforce-health-check list with the npd.* node meta keys.
+func (a *aggregator) nodePolicy(nodeID string, meta map[string]string) types.NodePolicy {
+	policy := types.NodePolicy{}
+
+	enforce := make(map[string]bool)
+	for hc := range a.enforcedChecks {
+		enforce[hc] = true
+	}
+
+	if val, ok := meta[metaIgnore]; ok {
+		ignore, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Warning(fmt.Sprintf("Node %s: invalid %s node meta: %q, expected true or false.", nodeID, metaIgnore, val))
+		}
+		policy.Ignore = ignore
+		addOverride(&policy, metaIgnore, val)
+	}
+
+	if val, ok := meta[metaEnforce]; ok {
+		for _, hc := range splitList(val) {
+			enforce[hc] = true
+		}
+		addOverride(&policy, metaEnforce, val)
+	}
+
+	if val, ok := meta[metaUnenforce]; ok {
+		for _, hc := range splitList(val) {
+			delete(enforce, hc)
+		}
+		addOverride(&policy, metaUnenforce, val)
+	}
+
+	policy.Enforce = make([]string, 0, len(enforce))
+	for hc := range enforce {
+		policy.Enforce = append(policy.Enforce, hc)
+	}
+	sort.Strings(policy.Enforce)
+	return policy
+}
+
+func addOverride(policy *types.NodePolicy, key, val string) {
+	if policy.Overrides == nil {
+		policy.Overrides = make(map[string]string)
+	}
+	policy.Overrides[key] = val
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(val string) []string {
+	result := []string{}
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
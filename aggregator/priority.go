@@ -0,0 +1,119 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+// defaultSeverity is the severity of health checks without --check-severity.
+const defaultSeverity = 1
+
+// parseCheckSeverity parses the --check-severity flags, formatted as <check>=<severity>.
+func parseCheckSeverity(list []string) (map[string]int, error) {
+	severities := make(map[string]int)
+	for _, s := range list {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid --check-severity %s. Set check=severity", s)
+		}
+
+		severity, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --check-severity %s. Severity must be an integer", s)
+		}
+		severities[kv[0]] = severity
+	}
+	return severities, nil
+}
+
+func (a *aggregator) checkSeverity(check string) int {
+	if severity, ok := a.checkSeverities[check]; ok {
+		return severity
+	}
+	return defaultSeverity
+}
+
+// cordonCandidate is a node which should be taken out of the scheduling
+// pool. Candidates are collected during the aggregation cycle, and only
+// cordoned once ranked, so that the worst nodes are cordoned first when
+// the threshold doesn't allow cordoning all of them.
+type cordonCandidate struct {
+	nodeID  string
+	rec     *nodeRecord
+	event   *types.AuditEvent
+	failing int
+	since   time.Time
+}
+
+// newCordonCandidate returns the cordon candidate for the failing enforced
+// health checks of a node.
+func (a *aggregator) newCordonCandidate(nodeID string, rec *nodeRecord, event *types.AuditEvent) *cordonCandidate {
+	c := &cordonCandidate{
+		nodeID:  nodeID,
+		rec:     rec,
+		event:   event,
+		failing: len(event.Checks),
+	}
+
+	for _, hc := range event.Checks {
+		if severity := a.checkSeverity(hc.Type); severity > event.Severity {
+			event.Severity = severity
+		}
+
+		since, ok := rec.FailingSince[hc.Type]
+		if !ok && !hc.FailingSince.IsZero() {
+			// DetectorUnreachable is not recorded with the health checks.
+			since, ok = hc.FailingSince, true
+		}
+		if ok && (c.since.IsZero() || since.Before(c.since)) {
+			c.since = since
+		}
+	}
+	return c
+}
+
+// rankCandidates sorts the cordon candidates, worst first: by severity,
+// number of failing enforced health checks, and how long the node has
+// been failing. Ties are broken by node ID, so the order is stable
+// across aggregation cycles.
+func rankCandidates(candidates []*cordonCandidate) {
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.event.Severity != b.event.Severity {
+			return a.event.Severity > b.event.Severity
+		}
+		if a.failing != b.failing {
+			return a.failing > b.failing
+		}
+		if !a.since.Equal(b.since) {
+			return a.since.Before(b.since)
+		}
+		return a.nodeID < b.nodeID
+	})
+
+	for i, c := range candidates {
+		c.event.Rank = i + 1
+	}
+}
@@ -0,0 +1,405 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields which can be redacted from recordings (--record-redact).
+const (
+	redactMessage    = "message"
+	redactAddress    = "address"
+	redactName       = "name"
+	redactAttributes = "attributes"
+	redactMeta       = "meta"
+)
+
+var redactFields = []string{redactMessage, redactAddress, redactName, redactAttributes, redactMeta}
+
+// parseRedact parses the --record-redact flags.
+func parseRedact(list []string) (map[string]bool, error) {
+	redact := make(map[string]bool)
+	for _, field := range list {
+		if !contains(redactFields, field) {
+			return nil, fmt.Errorf("invalid --record-redact %s. Supported fields are %s", field, strings.Join(redactFields, ", "))
+		}
+		redact[field] = true
+	}
+	return redact, nil
+}
+
+// recorder wraps the nodeSource and the detectorClient of the aggregator,
+// and records the node lists, node info and node health of every
+// aggregation cycle as a timeline, which can be replayed with
+// `npd aggregator simulate`.
+//
+// The timeline is written to gzip compressed files in dir, named
+// timeline-<time>.jsonl.gz. Files are rotated at the start of an
+// aggregation cycle, once they are larger than maxSize bytes (compressed),
+// so that every file can be replayed on its own. At most maxFiles files
+// are kept.
+type recorder struct {
+	nodes    nodeSource
+	detector detectorClient
+	redact   map[string]bool
+
+	// redactKey is the HMAC key of the pseudonyms of redacted values.
+	redactKey []byte
+
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	gz       *gzip.Writer
+	size     int64
+
+	// recorded is the ModifyIndex of the node info recorded in the current file.
+	recorded map[string]uint64
+
+	// nodeIDs maps the node addresses of the current cycle to node IDs.
+	nodeIDs map[string]string
+}
+
+// countingWriter counts the bytes written to the recording file.
+type countingWriter struct {
+	r *recorder
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.r.file.Write(p)
+	w.r.size += int64(n)
+	return n, err
+}
+
+// openRecorder starts recording the timeline of the aggregator into dir.
+// Redacted values are replaced with an HMAC of redactKey, a random key
+// when it is empty.
+func openRecorder(a *aggregator, dir string, maxSize int64, maxFiles int, redact map[string]bool, redactKey []byte) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if len(redactKey) == 0 {
+		redactKey = make([]byte, 32)
+		if _, err := rand.Read(redactKey); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &recorder{
+		nodes:     a.nodes,
+		detector:  a.detector,
+		redact:    redact,
+		redactKey: redactKey,
+		dir:       dir,
+		maxSize:   maxSize,
+		maxFiles:  maxFiles,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	a.nodes, a.detector = r, r
+	return r, nil
+}
+
+func (r *recorder) open() error {
+	path := filepath.Join(r.dir, fmt.Sprintf("timeline-%s.jsonl.gz", time.Now().UTC().Format("20060102T150405.000000000")))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("error in opening recording %s: %v", path, err)
+	}
+
+	r.file = f
+	r.size = 0
+	r.gz = gzip.NewWriter(countingWriter{r})
+	r.recorded = make(map[string]uint64)
+	return nil
+}
+
+// rotate completes the current file, starts a new one, and removes the
+// oldest files above maxFiles. Caller must hold the lock.
+func (r *recorder) rotate() error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(r.dir, "timeline-*.jsonl.gz"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for i := 0; i < len(files)-r.maxFiles; i++ {
+		if err := os.Remove(files[i]); err != nil {
+			log.Warning(fmt.Sprintf("Error in removing recording %s: %v", files[i], err))
+		}
+	}
+	return nil
+}
+
+func (r *recorder) closeFile() error {
+	if err := r.gz.Close(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// write appends an entry to the timeline. The aggregator keeps running if
+// the timeline can't be written.
+func (r *recorder) write(entry *timelineEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in recording %s entry: %v", entry.Type, err))
+		return
+	}
+	data = append(data, '\n')
+
+	if _, err := r.gz.Write(data); err != nil {
+		log.Warning(fmt.Sprintf("Error in recording %s entry: %v", entry.Type, err))
+	}
+}
+
+// listNodes records the node list, which starts a new cycle of the timeline.
+func (r *recorder) listNodes(resources bool) ([]*nodeStub, error) {
+	stubs, err := r.nodes.listNodes(resources)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The previous cycle is complete, make it readable.
+	if err := r.gz.Flush(); err != nil {
+		log.Warning(fmt.Sprintf("Error in flushing recording: %v", err))
+	}
+	if r.maxSize > 0 && r.size > r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Warning(fmt.Sprintf("Error in rotating recording: %v", err))
+		}
+	}
+
+	r.nodeIDs = make(map[string]string, len(stubs))
+	redacted := make([]*nodeStub, 0, len(stubs))
+	for _, stub := range stubs {
+		r.nodeIDs[stub.Address] = stub.ID
+		redacted = append(redacted, r.redactStub(stub))
+	}
+
+	r.write(&timelineEntry{
+		Type:    timelineNodes,
+		Version: timelineVersion,
+		Time:    time.Now().UTC(),
+		Nodes:   redacted,
+	})
+	return stubs, nil
+}
+
+// nodeInfo records the node info, when it changed since it was last
+// recorded in the current file.
+func (r *recorder) nodeInfo(nodeID string) (*api.Node, error) {
+	nodeInfo, err := r.nodes.nodeInfo(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if index, ok := r.recorded[nodeID]; ok && index == nodeInfo.ModifyIndex {
+		return nodeInfo, nil
+	}
+	r.recorded[nodeID] = nodeInfo.ModifyIndex
+
+	r.write(&timelineEntry{
+		Type: timelineNode,
+		Time: time.Now().UTC(),
+		Node: r.redactNode(nodeInfo),
+	})
+	return nodeInfo, nil
+}
+
+// nodeHealth records the node health returned by the detector, or the
+// error in getting it.
+func (r *recorder) nodeHealth(address string) ([]types.HealthCheck, error) {
+	checks, err := r.detector.nodeHealth(address)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := &timelineEntry{
+		Type:    timelineNodeHealth,
+		Time:    time.Now().UTC(),
+		NodeID:  r.nodeIDs[address],
+		Address: address,
+	}
+	if r.redact[redactAddress] {
+		entry.Address = r.pseudonym(address)
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Health = make([]types.HealthCheck, 0, len(checks))
+		for _, hc := range checks {
+			if r.redact[redactMessage] && hc.Message != "" {
+				hc.Message = "redacted"
+			}
+			entry.Health = append(entry.Health, hc)
+		}
+	}
+	r.write(entry)
+	return checks, err
+}
+
+// redactNode returns a copy of the node info, without the redacted fields.
+// The npd.* node meta is kept, as it drives the aggregator decisions.
+// Addresses are redacted from the network resources as well, and the
+// node links and unique.* attributes (hostname, IP addresses, cloud
+// instance metadata) are redacted with either the address or the name.
+func (r *recorder) redactNode(nodeInfo *api.Node) *api.Node {
+	node := *nodeInfo
+	if r.redact[redactAddress] {
+		node.HTTPAddr = r.pseudonym(node.HTTPAddr)
+		node.Resources = r.redactResources(node.Resources)
+		node.Reserved = r.redactResources(node.Reserved)
+		node.NodeResources = r.redactNodeResources(node.NodeResources)
+	}
+	if r.redact[redactName] {
+		node.Name = r.pseudonym(node.Name)
+	}
+	if r.redact[redactAddress] || r.redact[redactName] {
+		node.Links = r.redactValues(node.Links, func(string) bool { return true })
+		node.Attributes = r.redactValues(node.Attributes, func(key string) bool {
+			return strings.HasPrefix(key, "unique.")
+		})
+	}
+	if r.redact[redactAttributes] {
+		node.Attributes = nil
+	}
+	if r.redact[redactMeta] {
+		node.Meta = make(map[string]string)
+		for key, val := range nodeInfo.Meta {
+			if strings.HasPrefix(key, "npd.") {
+				node.Meta[key] = val
+			}
+		}
+	}
+	return &node
+}
+
+// redactStub returns a copy of a node list entry, without the redacted fields.
+func (r *recorder) redactStub(stub *nodeStub) *nodeStub {
+	s := *stub
+	if r.redact[redactAddress] {
+		s.Address = r.pseudonym(s.Address)
+		s.NodeResources = r.redactNodeResources(s.NodeResources)
+	}
+	if r.redact[redactName] {
+		s.Name = r.pseudonym(s.Name)
+	}
+	return &s
+}
+
+// redactValues returns a copy of m, with the values of the keys matching
+// redact replaced with their pseudonym.
+func (r *recorder) redactValues(m map[string]string, redact func(key string) bool) map[string]string {
+	if m == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(m))
+	for key, val := range m {
+		if redact(key) {
+			val = r.pseudonym(val)
+		}
+		redacted[key] = val
+	}
+	return redacted
+}
+
+func (r *recorder) redactResources(resources *api.Resources) *api.Resources {
+	if resources == nil {
+		return nil
+	}
+	redacted := *resources
+	redacted.Networks = r.redactNetworks(resources.Networks)
+	return &redacted
+}
+
+func (r *recorder) redactNodeResources(resources *api.NodeResources) *api.NodeResources {
+	if resources == nil {
+		return nil
+	}
+	redacted := *resources
+	redacted.Networks = r.redactNetworks(resources.Networks)
+	return &redacted
+}
+
+// redactNetworks returns a copy of the networks, with pseudonyms for their addresses.
+func (r *recorder) redactNetworks(networks []*api.NetworkResource) []*api.NetworkResource {
+	if networks == nil {
+		return nil
+	}
+	redacted := make([]*api.NetworkResource, 0, len(networks))
+	for _, network := range networks {
+		n := *network
+		n.IP = r.pseudonym(n.IP)
+		n.CIDR = r.pseudonym(n.CIDR)
+		redacted = append(redacted, &n)
+	}
+	return redacted
+}
+
+// Close completes the current recording file.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeFile()
+}
+
+// pseudonym replaces a value with its HMAC, so that redacted addresses
+// and names still match across the timeline. Addresses and names are
+// guessable, a plain hash could be reversed by brute force.
+func (r *recorder) pseudonym(value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, r.redactKey)
+	mac.Write([]byte(value))
+	return "redacted-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
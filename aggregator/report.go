@@ -0,0 +1,230 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/urfave/cli/v2"
+)
+
+// reportFlags are shared by the report commands.
+var reportFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "aggregator",
+		Value: "http://localhost:3000",
+		Usage: "HTTP API address of the aggregator",
+	},
+	&cli.StringFlag{
+		Name:  "since",
+		Value: "168h",
+		Usage: "Start of the report, as a duration before now (e.g. 24h) or RFC3339",
+	},
+	&cli.StringFlag{
+		Name:  "until",
+		Usage: "End of the report, as a duration before now or RFC3339. Defaults to now",
+	},
+	&cli.StringFlag{
+		Name:  "format",
+		Value: "csv",
+		Usage: "Output format: csv or html",
+	},
+}
+
+var ReportCommand = &cli.Command{
+	Name:  "report",
+	Usage: "Report on the health check history of the aggregator",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "transitions",
+			Usage: "Health check transitions of a node",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:     "node-id",
+					Usage:    "ID of the node",
+					Required: true,
+				},
+				&cli.IntFlag{
+					Name:  "limit",
+					Value: 1000,
+					Usage: "Maximum number of transitions. Only the most recent ones are reported",
+				},
+			}, reportFlags...),
+			Action: func(c *cli.Context) error {
+				return report(c, "transitions", url.Values{"node_id": {c.String("node-id")}, "limit": {strconv.Itoa(c.Int("limit"))}})
+			},
+		},
+		{
+			Name:  "flakiest",
+			Usage: "Health checks with the most transitions",
+			Flags: append([]cli.Flag{
+				&cli.IntFlag{
+					Name:  "limit",
+					Value: 20,
+					Usage: "Number of health checks",
+				},
+			}, reportFlags...),
+			Action: func(c *cli.Context) error {
+				return report(c, "flakiest", url.Values{"limit": {strconv.Itoa(c.Int("limit"))}})
+			},
+		},
+		{
+			Name:  "mttr",
+			Usage: "Mean time to recover per health check",
+			Flags: reportFlags,
+			Action: func(c *cli.Context) error {
+				return report(c, "mttr", url.Values{})
+			},
+		},
+	},
+}
+
+// reportTable is a report, as printed by `npd report`.
+type reportTable struct {
+	Title  string
+	Header []string
+	Rows   [][]string
+}
+
+func report(context *cli.Context, query string, params url.Values) error {
+	format := context.String("format")
+	if format != "csv" && format != "html" {
+		return fmt.Errorf("invalid --format %s. Supported formats are csv and html", format)
+	}
+
+	params.Set("since", context.String("since"))
+	if until := context.String("until"); until != "" {
+		params.Set("until", until)
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/history/%s?%s", context.String("aggregator"), query, params.Encode())
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return fmt.Errorf("error in querying aggregator history: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error in reading aggregator history: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error in querying aggregator history: %s: %s", resp.Status, body)
+	}
+
+	table, err := newReportTable(query, body)
+	if err != nil {
+		return err
+	}
+	table.Title = fmt.Sprintf("%s (since %s)", table.Title, context.String("since"))
+	return writeReport(os.Stdout, format, table)
+}
+
+// newReportTable builds the report of a history query from its response.
+func newReportTable(query string, body []byte) (*reportTable, error) {
+	table := &reportTable{}
+	switch query {
+	case "transitions":
+		transitions := []types.Transition{}
+		if err := json.Unmarshal(body, &transitions); err != nil {
+			return nil, err
+		}
+		table.Title = "Health check transitions"
+		table.Header = []string{"time", "node_id", "node_address", "datacenter", "check", "from", "to", "message"}
+		for _, t := range transitions {
+			table.Rows = append(table.Rows, []string{t.Time.Format(time.RFC3339), t.NodeID, t.NodeAddress, t.Datacenter, t.Check, t.From, t.To, t.Message})
+		}
+	case "flakiest":
+		flakiest := []types.CheckFlakiness{}
+		if err := json.Unmarshal(body, &flakiest); err != nil {
+			return nil, err
+		}
+		table.Title = "Flakiest health checks"
+		table.Header = []string{"check", "transitions", "nodes"}
+		for _, cf := range flakiest {
+			table.Rows = append(table.Rows, []string{cf.Check, strconv.Itoa(cf.Transitions), strconv.Itoa(cf.Nodes)})
+		}
+	case "mttr":
+		recoveries := []types.CheckRecovery{}
+		if err := json.Unmarshal(body, &recoveries); err != nil {
+			return nil, err
+		}
+		table.Title = "Mean time to recover per health check"
+		table.Header = []string{"check", "recoveries", "mean_time_to_recover", "max_time_to_recover"}
+		for _, cr := range recoveries {
+			table.Rows = append(table.Rows, []string{cr.Check, strconv.Itoa(cr.Recoveries),
+				secondsString(cr.MeanTimeToRecoverSeconds), secondsString(cr.MaxTimeToRecoverSeconds)})
+		}
+	default:
+		return nil, fmt.Errorf("unknown history query %s", query)
+	}
+	return table, nil
+}
+
+func secondsString(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).String()
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// writeReport prints the report in the given format.
+func writeReport(w io.Writer, format string, table *reportTable) error {
+	if format == "html" {
+		return reportTemplate.Execute(w, table)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(table.Header); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(table.Rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
@@ -0,0 +1,387 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var simulateCommand = &cli.Command{
+	Name:  "simulate",
+	Usage: "Replay a recorded timeline of node lists and node health through the aggregator decisions, and print the resulting actions",
+	Flags: append([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:     "timeline",
+			Usage:    "JSONL timeline to replay, optionally gzip compressed (.gz). Files are replayed in the given order",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Value: "table",
+			Usage: "Output format: table or json",
+		},
+	}, aggregatorFlags...),
+	Action: func(c *cli.Context) error {
+		return simulate(c)
+	},
+}
+
+// timelineVersion is the version of the timeline format. It is only
+// increased for changes which older versions can't read.
+const timelineVersion = 1
+
+// Timeline entry types.
+const (
+	timelineNodes      = "nodes"
+	timelineNode       = "node"
+	timelineNodeHealth = "node_health"
+)
+
+// timelineEntry is a line of a timeline. A nodes entry (the node list)
+// starts an aggregation cycle, and the node (node info) and node_health
+// (/v1/nodehealth/ response, or the error in getting it) entries which
+// follow it belong to the same cycle.
+type timelineEntry struct {
+	Type    string              `json:"type"`
+	Version int                 `json:"version,omitempty"`
+	Time    time.Time           `json:"time"`
+	Nodes   []*nodeStub         `json:"nodes,omitempty"`
+	Node    *api.Node           `json:"node,omitempty"`
+	NodeID  string              `json:"node_id,omitempty"`
+	Address string              `json:"address,omitempty"`
+	Health  []types.HealthCheck `json:"health,omitempty"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// timelineCycle is an aggregation cycle of a timeline.
+type timelineCycle struct {
+	time   time.Time
+	nodes  []*nodeStub
+	infos  map[string]*api.Node
+	health map[string]*timelineEntry
+}
+
+// readTimeline reads the aggregation cycles of a timeline.
+func readTimeline(r io.Reader) ([]*timelineCycle, error) {
+	var cycles []*timelineCycle
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		entry := &timelineEntry{}
+		// A truncated last entry, e.g. of a file being recorded, is ignored.
+		if err := dec.Decode(entry); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return cycles, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error in reading timeline entry %d: %v", line, err)
+		}
+
+		if entry.Type == timelineNodes {
+			if entry.Version > timelineVersion {
+				return nil, fmt.Errorf("timeline entry %d: unsupported timeline version %d", line, entry.Version)
+			}
+			cycles = append(cycles, &timelineCycle{
+				time:   entry.Time,
+				nodes:  entry.Nodes,
+				infos:  make(map[string]*api.Node),
+				health: make(map[string]*timelineEntry),
+			})
+			continue
+		}
+
+		if len(cycles) == 0 {
+			return nil, fmt.Errorf("timeline entry %d: %s entry before the first nodes entry", line, entry.Type)
+		}
+
+		cycle := cycles[len(cycles)-1]
+		switch entry.Type {
+		case timelineNode:
+			if entry.Node == nil {
+				return nil, fmt.Errorf("timeline entry %d: node entry without node", line)
+			}
+			cycle.infos[entry.Node.ID] = entry.Node
+		case timelineNodeHealth:
+			cycle.health[entry.Address] = entry
+		default:
+			return nil, fmt.Errorf("timeline entry %d: unknown entry type %q", line, entry.Type)
+		}
+	}
+}
+
+// readTimelineFile reads the aggregation cycles of a timeline file.
+func readTimelineFile(path string) ([]*timelineCycle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("error in reading timeline %s: %v", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	cycles, err := readTimeline(r)
+	if err != nil {
+		return nil, fmt.Errorf("error in reading timeline %s: %v", path, err)
+	}
+	return cycles, nil
+}
+
+// replay is the nodeSource, detectorClient and actuator of a simulation.
+// It serves the recorded node lists and node health of the current cycle.
+// Eligibility changes made by the simulation override the recorded node
+// eligibility for the rest of the replay.
+type replay struct {
+	cycle       *timelineCycle
+	infos       map[string]*api.Node
+	eligibility map[string]string
+}
+
+func newReplay() *replay {
+	return &replay{
+		infos:       make(map[string]*api.Node),
+		eligibility: make(map[string]string),
+	}
+}
+
+// next moves the replay to the next aggregation cycle.
+func (r *replay) next(cycle *timelineCycle) {
+	r.cycle = cycle
+	for nodeID, info := range cycle.infos {
+		r.infos[nodeID] = info
+	}
+}
+
+func (r *replay) listNodes(resources bool) ([]*nodeStub, error) {
+	stubs := make([]*nodeStub, 0, len(r.cycle.nodes))
+	for _, node := range r.cycle.nodes {
+		stub := *node
+		if eligibility, ok := r.eligibility[stub.ID]; ok {
+			stub.SchedulingEligibility = eligibility
+		}
+		stubs = append(stubs, &stub)
+	}
+	return stubs, nil
+}
+
+// nodeInfo returns the last recorded node info. Timelines don't need to
+// record it, in which case it is built from the node list.
+func (r *replay) nodeInfo(nodeID string) (*api.Node, error) {
+	var info api.Node
+	if recorded, ok := r.infos[nodeID]; ok {
+		info = *recorded
+	} else {
+		found := false
+		for _, node := range r.cycle.nodes {
+			if node.ID == nodeID {
+				info = api.Node{
+					ID:                    node.ID,
+					Name:                  node.Name,
+					Datacenter:            node.Datacenter,
+					NodeClass:             node.NodeClass,
+					Status:                node.Status,
+					SchedulingEligibility: node.SchedulingEligibility,
+					Drain:                 node.Drain,
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("node %s is not part of the timeline", nodeID)
+		}
+	}
+
+	if eligibility, ok := r.eligibility[nodeID]; ok {
+		info.SchedulingEligibility = eligibility
+	}
+	return &info, nil
+}
+
+func (r *replay) nodeHealth(address string) ([]types.HealthCheck, error) {
+	entry, ok := r.cycle.health[address]
+	if !ok {
+		return nil, fmt.Errorf("no node health recorded")
+	}
+	if entry.Error != "" {
+		return nil, errors.New(entry.Error)
+	}
+	return entry.Health, nil
+}
+
+func (r *replay) toggleEligibility(nodeID string, eligible bool) error {
+	r.eligibility[nodeID] = eligibilityString(eligible)
+	return nil
+}
+
+func (r *replay) publishNodeMeta(nodeInfo *api.Node, address string, checks []types.HealthCheck) error {
+	return nil
+}
+
+// simulationReport is the output of `npd aggregator simulate`.
+type simulationReport struct {
+	Cycles      int                 `json:"cycles"`
+	Cordon      int                 `json:"cordon"`
+	Uncordon    int                 `json:"uncordon"`
+	Deferred    int                 `json:"deferred"`
+	NotEnforced int                 `json:"not_enforced"`
+	Events      []*types.AuditEvent `json:"events"`
+}
+
+func simulate(context *cli.Context) error {
+	format := context.String("format")
+	if format != "table" && format != "json" {
+		return fmt.Errorf("invalid --format %s. Supported formats are table and json", format)
+	}
+
+	a, err := newAggregator(context)
+	if err != nil {
+		return err
+	}
+
+	// Actions are part of the report, only log warnings.
+	if !context.Bool("debug") {
+		log.SetLevel(log.WarnLevel)
+	}
+
+	if len(a.detectorDCs) == 0 {
+		return fmt.Errorf("no detector datacenter. Set --detector-datacenter or the environment variable `NOMAD_DC'")
+	}
+
+	var cycles []*timelineCycle
+	for _, path := range context.StringSlice("timeline") {
+		c, err := readTimelineFile(path)
+		if err != nil {
+			return err
+		}
+		cycles = append(cycles, c...)
+	}
+
+	report, err := runSimulation(a, cycles)
+	if err != nil {
+		return err
+	}
+	return writeSimulation(os.Stdout, format, report)
+}
+
+// runSimulation replays the aggregation cycles of a timeline, starting
+// without state as in the first aggregation cycle. The aggregator clock
+// follows the timeline, so flap detection and maintenance windows behave
+// as they would have when the timeline was recorded. The simulated actions
+// and incidents are not counted in the metrics of the aggregator.
+func runSimulation(a *aggregator, cycles []*timelineCycle) (*simulationReport, error) {
+	r := newReplay()
+	var now time.Time
+	a.nodes, a.detector, a.actuator = r, r, r
+	a.clock = func() time.Time { return now }
+	a.store = nil
+	a.simulated = true
+
+	report := &simulationReport{Events: []*types.AuditEvent{}}
+
+	// As in the audit log, a node deferred by the threshold is only
+	// reported the first time.
+	deferred := make(map[string]bool)
+
+	for _, cycle := range cycles {
+		now = cycle.time
+		r.next(cycle)
+
+		results, err := a.runCycle()
+		if err != nil {
+			return nil, fmt.Errorf("cycle %s: %v", now.Format(time.RFC3339), err)
+		}
+		report.Cycles++
+
+		for _, result := range results {
+			event := result.Event
+			if event == nil {
+				delete(deferred, result.NodeID)
+				continue
+			}
+
+			blocked := event.Result == types.AuditResultBlocked && event.Action == eligibilityString(false)
+			if blocked && deferred[result.NodeID] {
+				continue
+			}
+			deferred[result.NodeID] = blocked
+
+			event.Timestamp = now
+			report.Events = append(report.Events, event)
+			switch {
+			case event.Result == types.AuditResultBlocked:
+				report.Deferred++
+			case event.Result == types.AuditResultDryRun:
+				report.NotEnforced++
+			case event.Action == eligibilityString(true):
+				report.Uncordon++
+			default:
+				report.Cordon++
+			}
+		}
+	}
+	return report, nil
+}
+
+// writeSimulation prints the simulation report in the given format.
+func writeSimulation(w io.Writer, format string, report *simulationReport) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tNODE\tADDRESS\tDATACENTER\tACTION\tRESULT\tRANK\tREASON")
+	for _, event := range report.Events {
+		rank, reason := "-", event.Reason
+		if event.Rank > 0 {
+			rank = strconv.Itoa(event.Rank)
+		}
+		if event.Error != "" {
+			reason = fmt.Sprintf("%s (%s)", reason, event.Error)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", event.Timestamp.Format(time.RFC3339), event.NodeID, event.NodeAddress,
+			event.Datacenter, event.Action, event.Result, rank, reason)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nSimulation: %d cycles, %d cordons, %d uncordons, %d deferred by threshold, %d not enforced.\n",
+		report.Cycles, report.Cordon, report.Uncordon, report.Deferred, report.NotEnforced)
+	return nil
+}
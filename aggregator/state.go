@@ -0,0 +1,262 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// stateSchemaVersion is bumped whenever nodeRecord changes in a way that
+// can't be handled by JSON decoding alone i.e. a field changes meaning.
+// Added or removed fields don't need a bump, unknown fields are ignored
+// and missing fields are decoded to their zero value.
+const stateSchemaVersion = 1
+
+var (
+	metaBucket  = []byte("meta")
+	nodesBucket = []byte("nodes")
+
+	schemaVersionKey = []byte("schema_version")
+)
+
+// nodeRecord is the aggregator state of a single node, persisted across restarts.
+type nodeRecord struct {
+	// Address and Datacenter of the node when it was last processed, so
+	// that the node status is complete after a restart.
+	Address    string `json:"address,omitempty"`
+	Datacenter string `json:"datacenter,omitempty"`
+
+	// Checks are the health check results from the last aggregation cycle.
+	Checks []types.HealthCheck `json:"checks"`
+
+	// Failures is the number of consecutive aggregation cycles a health
+	// check has been failing, and FailingSince is when it started failing.
+	Failures     map[string]int       `json:"failures"`
+	FailingSince map[string]time.Time `json:"failing_since"`
+
+	// Cordoned is true if the node was made ineligible by the aggregator,
+	// and CordonOwner is the aggregator instance which did it. A node
+	// cordoned by someone else is never made eligible by the aggregator.
+	Cordoned    bool   `json:"cordoned"`
+	CordonOwner string `json:"cordon_owner,omitempty"`
+
+	// Detector is the reachability of the node detector.
+	Detector types.DetectorStatus `json:"detector"`
+
+	// EnforcedFailing is true if enforced health checks were failing in the
+	// last cycle, and Transitions are the recent changes of EnforcedFailing.
+	// A node with too many transitions is Quarantined until QuarantineUntil.
+	// Quarantines is the number of consecutive quarantines, for the backoff.
+	EnforcedFailing bool        `json:"enforced_failing,omitempty"`
+	Transitions     []time.Time `json:"transitions,omitempty"`
+	Quarantined     bool        `json:"quarantined,omitempty"`
+	QuarantineUntil time.Time   `json:"quarantine_until,omitempty"`
+	Quarantines     int         `json:"quarantines,omitempty"`
+
+	// Deferred is true if the node should be cordoned, but the threshold
+	// didn't allow it. Deferred nodes are candidates again next cycle.
+	Deferred bool `json:"deferred,omitempty"`
+
+	LastAction     string    `json:"last_action,omitempty"`
+	LastActionTime time.Time `json:"last_action_time,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+func newNodeRecord() *nodeRecord {
+	return &nodeRecord{
+		Failures:     make(map[string]int),
+		FailingSince: make(map[string]time.Time),
+	}
+}
+
+// observe updates the consecutive failure counters with the latest
+// health check results, and stores them as the last results.
+func (rec *nodeRecord) observe(checks []types.HealthCheck, now time.Time) {
+	failures := make(map[string]int)
+	failingSince := make(map[string]time.Time)
+	for _, hc := range checks {
+		if !hc.Failed() {
+			continue
+		}
+
+		failures[hc.Type] = rec.Failures[hc.Type] + 1
+		since, ok := rec.FailingSince[hc.Type]
+		if !ok {
+			since = now
+		}
+		failingSince[hc.Type] = since
+	}
+
+	rec.Checks = checks
+	rec.Failures = failures
+	rec.FailingSince = failingSince
+}
+
+// recordAction records an eligibility change made by this aggregator instance.
+func (rec *nodeRecord) recordAction(eligible bool, reason string, now time.Time) {
+	rec.Cordoned = !eligible
+	rec.Deferred = false
+	rec.CordonOwner = ""
+	if rec.Cordoned {
+		rec.CordonOwner = instanceID
+	}
+	rec.LastAction = eligibilityString(eligible)
+	rec.LastActionTime = now
+	rec.Reason = reason
+}
+
+// stateStore persists the aggregator state in an embedded bolt database,
+// located in the aggregator --data-dir.
+type stateStore struct {
+	db *bolt.DB
+}
+
+// stateStorePath returns the location of the state database in dataDir.
+func stateStorePath(dataDir string) string {
+	return filepath.Join(dataDir, "state.db")
+}
+
+// openStateStore opens (or creates) the state database at path.
+func openStateStore(path string) (*stateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error in opening aggregator state %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(nodesBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(incidentsBucket); err != nil {
+			return err
+		}
+
+		version := 0
+		if val := meta.Get(schemaVersionKey); val != nil {
+			if version, err = strconv.Atoi(string(val)); err != nil {
+				return fmt.Errorf("invalid schema version: %q", val)
+			}
+		}
+
+		if version > stateSchemaVersion {
+			return fmt.Errorf("state schema version %d is newer than supported version %d", version, stateSchemaVersion)
+		}
+
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(stateSchemaVersion)))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &stateStore{db: db}, nil
+}
+
+// openStateStoreReadOnly opens an existing state database at path without
+// modifying it. It fails if the database is locked by a running aggregator.
+func openStateStoreReadOnly(path string) (*stateStore, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("error in opening aggregator state %s: %v", path, err)
+	}
+	return &stateStore{db: db}, nil
+}
+
+// loadNodes returns the persisted state of every node.
+// Records which can't be decoded are dropped, rather than failing startup.
+func (s *stateStore) loadNodes() (map[string]*nodeRecord, error) {
+	records := make(map[string]*nodeRecord)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nodesBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			rec := newNodeRecord()
+			if err := json.Unmarshal(v, rec); err != nil {
+				log.Warning(fmt.Sprintf("Error in decoding aggregator state for node %s: %v, dropping it.", k, err))
+				return nil
+			}
+			if rec.Failures == nil {
+				rec.Failures = make(map[string]int)
+			}
+			if rec.FailingSince == nil {
+				rec.FailingSince = make(map[string]time.Time)
+			}
+			records[string(k)] = rec
+			return nil
+		})
+	})
+	return records, err
+}
+
+// saveNode persists the state of a single node.
+func (s *stateStore) saveNode(nodeID string, rec *nodeRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodesBucket).Put([]byte(nodeID), data)
+	})
+}
+
+// deleteNode removes the state of a node which left the cluster.
+func (s *stateStore) deleteNode(nodeID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodesBucket).Delete([]byte(nodeID))
+	})
+}
+
+// Close closes the state database.
+func (s *stateStore) Close() error {
+	return s.db.Close()
+}
+
+// getInstanceID returns the identity of this aggregator instance, used
+// to record which aggregator owns a cordon.
+func getInstanceID() string {
+	if allocID := os.Getenv("NOMAD_ALLOC_ID"); allocID != "" {
+		return allocID
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
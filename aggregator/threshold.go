@@ -0,0 +1,404 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// --threshold-mode values.
+// In nodes mode, the threshold is the percentage of eligible nodes.
+// In capacity mode, it is the percentage of eligible allocatable CPU and memory.
+const (
+	thresholdModeNodes    = "nodes"
+	thresholdModeCapacity = "capacity"
+)
+
+// --threshold-scope dimensions. Nodes sharing the same values for all the
+// scope dimensions share the same threshold.
+const (
+	scopeDatacenter = "datacenter"
+	scopeNodePool   = "node_pool"
+	scopeNodeClass  = "node_class"
+
+	// scopeCluster is the scope of all nodes, when no dimension is set.
+	scopeCluster = "cluster"
+)
+
+var scopeDimensions = []string{scopeDatacenter, scopeNodePool, scopeNodeClass}
+
+// nodeStub is a node list stub with the node pool (Nomad 1.6+), which is
+// not part of the vendored Nomad API.
+type nodeStub struct {
+	api.NodeListStub
+	NodePool string
+}
+
+// resources are the allocatable CPU (MHz) and memory (MB) of a node,
+// i.e. the node resources minus the resources reserved on the client.
+type resources struct {
+	CPU      int64
+	MemoryMB int64
+}
+
+func (r *resources) add(o resources) {
+	r.CPU += o.CPU
+	r.MemoryMB += o.MemoryMB
+}
+
+func (r *resources) sub(o resources) {
+	r.CPU -= o.CPU
+	r.MemoryMB -= o.MemoryMB
+}
+
+// allocatable returns the allocatable resources of a node.
+func allocatable(nodeResources *api.NodeResources, reserved *api.NodeReservedResources) resources {
+	var r resources
+	if nodeResources == nil {
+		return r
+	}
+
+	r.CPU = nodeResources.Cpu.CpuShares
+	r.MemoryMB = nodeResources.Memory.MemoryMB
+	if reserved != nil {
+		r.CPU -= int64(reserved.Cpu.CpuShares)
+		r.MemoryMB -= int64(reserved.Memory.MemoryMB)
+	}
+
+	if r.CPU < 0 {
+		r.CPU = 0
+	}
+	if r.MemoryMB < 0 {
+		r.MemoryMB = 0
+	}
+	return r
+}
+
+// thresholdOverride is a --threshold-override, which sets the threshold
+// percentage of the scopes matching all its selectors.
+type thresholdOverride struct {
+	selectors  map[string]string
+	percentage int
+}
+
+// parseThresholdOverride parses a --threshold-override, formatted as
+// <dimension>=<value>[,<dimension>=<value>...]:<percentage>
+// e.g. datacenter=dc1,node_class=gpu:50
+func parseThresholdOverride(override string, dims []string) (thresholdOverride, error) {
+	o := thresholdOverride{selectors: make(map[string]string)}
+
+	i := strings.LastIndex(override, ":")
+	if i < 0 {
+		return o, fmt.Errorf("invalid --threshold-override %s. Expected <dimension>=<value>[,...]:<percentage>", override)
+	}
+
+	percentage, err := strconv.Atoi(override[i+1:])
+	if err != nil || percentage < 0 || percentage > 100 {
+		return o, fmt.Errorf("invalid --threshold-override %s. Percentage must be between 0 and 100", override)
+	}
+	o.percentage = percentage
+
+	for _, selector := range strings.Split(override[:i], ",") {
+		kv := strings.SplitN(selector, "=", 2)
+		if len(kv) != 2 || !contains(dims, kv[0]) {
+			return o, fmt.Errorf("invalid --threshold-override %s. Dimensions must be part of --threshold-scope: %s", override, strings.Join(dims, ", "))
+		}
+		o.selectors[kv[0]] = kv[1]
+	}
+	return o, nil
+}
+
+func (o *thresholdOverride) match(labels map[string]string) bool {
+	for dim, val := range o.selectors {
+		if labels[dim] != val {
+			return false
+		}
+	}
+	return true
+}
+
+// parseThresholdScope validates the --threshold-scope dimensions.
+func parseThresholdScope(dims []string) ([]string, error) {
+	if len(dims) == 1 && dims[0] == scopeCluster {
+		return nil, nil
+	}
+
+	for _, dim := range dims {
+		if !contains(scopeDimensions, dim) {
+			return nil, fmt.Errorf("invalid --threshold-scope %s. Supported scopes are %s, or %s", dim, strings.Join(scopeDimensions, ", "), scopeCluster)
+		}
+	}
+	return dims, nil
+}
+
+// thresholdScope is the eligible and total nodes, and allocatable
+// resources of a group of nodes sharing the same threshold.
+type thresholdScope struct {
+	labels        map[string]string
+	percentage    int
+	eligibleNodes int
+	totalNodes    int
+	eligible      resources
+	total         resources
+}
+
+// thresholdAccounting keeps track of the --threshold-percentage accounting
+// during an aggregation cycle. It is updated as nodes are toggled.
+type thresholdAccounting struct {
+	mode       string
+	percentage int
+	dims       []string
+	overrides  []thresholdOverride
+	scopes     map[string]*thresholdScope
+
+	// nodeScope and nodeResources are the scope and allocatable
+	// resources of each node, and eligible the nodes counted as eligible.
+	nodeScope     map[string]string
+	nodeResources map[string]resources
+	eligible      map[string]bool
+}
+
+func newThresholdAccounting(mode string, percentage int, dims []string, overrides []thresholdOverride) *thresholdAccounting {
+	return &thresholdAccounting{
+		mode:          mode,
+		percentage:    percentage,
+		dims:          dims,
+		overrides:     overrides,
+		scopes:        make(map[string]*thresholdScope),
+		nodeScope:     make(map[string]string),
+		nodeResources: make(map[string]resources),
+		eligible:      make(map[string]bool),
+	}
+}
+
+// scope returns the threshold scope of a node, e.g.
+// datacenter=dc1,node_pool=default,node_class=gpu
+func (t *thresholdAccounting) scope(node *nodeStub) (string, *thresholdScope) {
+	values := map[string]string{
+		scopeDatacenter: node.Datacenter,
+		scopeNodePool:   node.NodePool,
+		scopeNodeClass:  node.NodeClass,
+	}
+
+	labels := make(map[string]string, len(t.dims))
+	parts := make([]string, 0, len(t.dims))
+	for _, dim := range t.dims {
+		labels[dim] = values[dim]
+		parts = append(parts, dim+"="+values[dim])
+	}
+
+	key := strings.Join(parts, ",")
+	if key == "" {
+		key = scopeCluster
+	}
+
+	if scope, ok := t.scopes[key]; ok {
+		return key, scope
+	}
+
+	// The most specific override wins, i.e. the one with the most selectors.
+	scope := &thresholdScope{labels: labels, percentage: t.percentage}
+	best := -1
+	for _, o := range t.overrides {
+		if len(o.selectors) > best && o.match(labels) {
+			best = len(o.selectors)
+			scope.percentage = o.percentage
+		}
+	}
+	t.scopes[key] = scope
+	return key, scope
+}
+
+// add accounts for a node. In capacity mode, a node only provides
+// capacity while it is ready.
+func (t *thresholdAccounting) add(node *nodeStub, r resources) {
+	key, scope := t.scope(node)
+
+	eligible := node.SchedulingEligibility == "eligible"
+	if t.mode == thresholdModeCapacity {
+		eligible = eligible && node.Status == "ready"
+	}
+
+	t.nodeScope[node.ID] = key
+	t.nodeResources[node.ID] = r
+	t.eligible[node.ID] = eligible
+
+	scope.totalNodes++
+	scope.total.add(r)
+	if eligible {
+		scope.eligibleNodes++
+		scope.eligible.add(r)
+	}
+}
+
+// state returns the threshold accounting of the node scope, and whether
+// the node can be taken out of the scheduling pool. Nodes out of scope
+// (not accounted for) can never be taken out.
+//
+// In nodes mode, the eligible nodes must be above the threshold. In
+// capacity mode, the eligible CPU and memory must stay at or above the
+// threshold after taking the node out.
+func (t *thresholdAccounting) state(nodeID string) types.ThresholdState {
+	key, ok := t.nodeScope[nodeID]
+	if !ok {
+		return types.ThresholdState{Mode: t.mode, Percentage: t.percentage}
+	}
+	scope := t.scopes[key]
+
+	state := types.ThresholdState{
+		Mode:          t.mode,
+		Scope:         key,
+		Percentage:    scope.percentage,
+		EligibleNodes: scope.eligibleNodes,
+		TotalNodes:    scope.totalNodes,
+	}
+
+	if t.mode != thresholdModeCapacity {
+		state.Above = scope.totalNodes > 0 && percentage(int64(scope.eligibleNodes), int64(scope.totalNodes)) > float64(scope.percentage)
+		return state
+	}
+
+	state.EligibleCPU = scope.eligible.CPU
+	state.TotalCPU = scope.total.CPU
+	state.EligibleMemoryMB = scope.eligible.MemoryMB
+	state.TotalMemoryMB = scope.total.MemoryMB
+
+	after := scope.eligible
+	if t.eligible[nodeID] {
+		after.sub(t.nodeResources[nodeID])
+	}
+	state.Above = scope.total.CPU > 0 && scope.total.MemoryMB > 0 &&
+		percentage(after.CPU, scope.total.CPU) >= float64(scope.percentage) &&
+		percentage(after.MemoryMB, scope.total.MemoryMB) >= float64(scope.percentage)
+	return state
+}
+
+// toggled updates the accounting after a node eligibility change.
+func (t *thresholdAccounting) toggled(nodeID string, eligible bool) {
+	key, ok := t.nodeScope[nodeID]
+	if !ok || t.eligible[nodeID] == eligible {
+		return
+	}
+
+	scope := t.scopes[key]
+	t.eligible[nodeID] = eligible
+	if eligible {
+		scope.eligibleNodes++
+		scope.eligible.add(t.nodeResources[nodeID])
+	} else {
+		scope.eligibleNodes--
+		scope.eligible.sub(t.nodeResources[nodeID])
+	}
+}
+
+// eligibleRatio returns the percentage of eligible nodes, or eligible
+// capacity (the lowest of CPU and memory) in capacity mode.
+func (t *thresholdAccounting) eligibleRatio(scope *thresholdScope) float64 {
+	if t.mode != thresholdModeCapacity {
+		return percentage(int64(scope.eligibleNodes), int64(scope.totalNodes))
+	}
+
+	cpu := percentage(scope.eligible.CPU, scope.total.CPU)
+	memory := percentage(scope.eligible.MemoryMB, scope.total.MemoryMB)
+	if cpu < memory {
+		return cpu
+	}
+	return memory
+}
+
+// updateMetrics exports the per scope threshold accounting.
+func (t *thresholdAccounting) updateMetrics(dc string) {
+	scopeEligibleNodesGauge.Reset()
+	scopeTotalNodesGauge.Reset()
+	scopeEligibleRatioGauge.Reset()
+	scopeThresholdGauge.Reset()
+	scopeHeadroomGauge.Reset()
+	scopeHeadroomNodesGauge.Reset()
+
+	for _, scope := range t.scopes {
+		labels := prometheus.Labels{
+			"dc":            dc,
+			scopeDatacenter: scope.labels[scopeDatacenter],
+			scopeNodePool:   scope.labels[scopeNodePool],
+			scopeNodeClass:  scope.labels[scopeNodeClass],
+		}
+		scopeEligibleNodesGauge.With(labels).Set(float64(scope.eligibleNodes))
+		scopeTotalNodesGauge.With(labels).Set(float64(scope.totalNodes))
+		scopeEligibleRatioGauge.With(labels).Set(t.eligibleRatio(scope))
+		scopeThresholdGauge.With(labels).Set(float64(scope.percentage))
+		scopeHeadroomGauge.With(labels).Set(t.eligibleRatio(scope) - float64(scope.percentage))
+		if t.mode != thresholdModeCapacity {
+			scopeHeadroomNodesGauge.With(labels).Set(float64(headroomNodes(scope)))
+		}
+	}
+}
+
+// headroomNodes returns the number of nodes of a scope which can be taken
+// out of the scheduling pool, one after the other, in nodes mode. A node
+// can be taken out while the eligible nodes are above the threshold.
+func headroomNodes(scope *thresholdScope) int {
+	headroom := scope.eligibleNodes - scope.totalNodes*scope.percentage/100
+	if headroom < 0 || scope.totalNodes == 0 {
+		return 0
+	}
+	return headroom
+}
+
+// scopeKeys returns the threshold scope keys, sorted.
+func (t *thresholdAccounting) scopeKeys() []string {
+	keys := make([]string, 0, len(t.scopes))
+	for key := range t.scopes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// thresholdError returns why a node can't be taken out of the scheduling pool.
+func thresholdError(state types.ThresholdState) string {
+	if state.Scope == "" {
+		return "node is out of threshold scope"
+	}
+	if state.Mode == thresholdModeCapacity {
+		return fmt.Sprintf("eligible capacity of %s would drop below threshold", state.Scope)
+	}
+	return fmt.Sprintf("eligible nodes of %s below threshold", state.Scope)
+}
+
+func percentage(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total) * 100
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
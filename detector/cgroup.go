@@ -0,0 +1,347 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package detector
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Health check types of the cgroup checks.
+const (
+	cgroupMemoryCheck = "CgroupMemoryPressure"
+	cgroupCPUCheck    = "CgroupCPUThrottled"
+	cgroupPidsCheck   = "CgroupPidsPressure"
+)
+
+const (
+	// cgroupUnlimitedV1 is the lowest value of a cgroup v1 limit which
+	// means no limit (the page counter maximum, rounded down to a page).
+	cgroupUnlimitedV1 = uint64(1) << 62
+
+	// cgroupV2Controllers only exists at the root of a cgroup v2 hierarchy.
+	cgroupV2Controllers = "cgroup.controllers"
+
+	// Parent cgroups of the Nomad allocations: Nomad creates nomad.slice
+	// with cgroup v2, and /nomad in every controller with cgroup v1.
+	cgroupParentV2 = "nomad.slice"
+	cgroupParentV1 = "nomad"
+)
+
+// cgroupMonitor checks the resources of the cgroup tree of the Nomad
+// allocations (e.g. nomad.slice), against the limits of its parent cgroup.
+// Both cgroup v1 (a hierarchy per controller) and v2 (unified hierarchy)
+// are supported. The CPU counters of the previous cycle are kept to report
+// the CPU throttling since then.
+type cgroupMonitor struct {
+	root          string
+	parent        string
+	memoryLimit   float64
+	throttleLimit float64
+	pidsLimit     float64
+
+	periods       uint64
+	throttled     uint64
+	hasCPUCounter bool
+}
+
+func newCgroupMonitor(root, parent string) *cgroupMonitor {
+	return &cgroupMonitor{
+		root:   root,
+		parent: parent,
+	}
+}
+
+// isCgroupV2 returns true when root is a cgroup v2 unified hierarchy.
+func isCgroupV2(root string) bool {
+	_, err := os.Stat(filepath.Join(root, cgroupV2Controllers))
+	return err == nil
+}
+
+// defaultCgroupParent returns the parent cgroup of the Nomad allocations
+// for the cgroup version of root.
+func defaultCgroupParent(root string) string {
+	if isCgroupV2(root) {
+		return cgroupParentV2
+	}
+	return cgroupParentV1
+}
+
+// v2 returns true on the cgroup v2 unified hierarchy.
+func (c *cgroupMonitor) v2() bool {
+	return isCgroupV2(c.root)
+}
+
+// path returns the directory of the parent cgroup for a controller. With
+// cgroup v1, controllers may be mounted together, e.g. cpu,cpuacct.
+func (c *cgroupMonitor) path(controller string) string {
+	if c.v2() {
+		return filepath.Join(c.root, c.parent)
+	}
+
+	path := filepath.Join(c.root, controller, c.parent)
+	if _, err := os.Stat(path); err != nil && controller == "cpu" {
+		return filepath.Join(c.root, "cpu,cpuacct", c.parent)
+	}
+	return path
+}
+
+// readCgroupValue reads a single value cgroup file. Unlimited is true for
+// "max" (v2), or the very large limit of cgroup v1.
+func readCgroupValue(path string) (value uint64, unlimited bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, true, nil
+	}
+	value, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s: %v", path, err)
+	}
+	return value, value >= cgroupUnlimitedV1, nil
+}
+
+// readCgroupKeyValues reads a flat keyed cgroup file, e.g. memory.events or cpu.stat.
+func readCgroupKeyValues(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, scanner.Err()
+}
+
+// getCgroupStats runs the cgroup checks. They are not reported when the
+// parent cgroup doesn't exist, e.g. on nodes without Nomad allocations, or
+// when a controller is not enabled for it.
+func getCgroupStats(c *cgroupMonitor) {
+	if c == nil || c.parent == "" {
+		return
+	}
+	if _, err := os.Stat(c.path("memory")); err != nil {
+		log.Debug(fmt.Sprintf("cgroup %s not found, skipping cgroup checks.", c.path("memory")))
+		return
+	}
+
+	c.memoryCheck()
+	c.cpuCheck()
+	c.pidsCheck()
+}
+
+// reportCheck records the result of a built-in check. Missing files mean
+// that the check doesn't apply. Other errors, e.g. a permission denied or an
+// unexpected format, are logged and counted, and the check is reported as
+// not failing: they are errors of the detector, not problems of the node.
+func reportCheck(hc *types.HealthCheck, err error) {
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Debug(fmt.Sprintf("Skipping %s: %v", hc.Type, err))
+			return
+		}
+		log.Warning(fmt.Sprintf("Error in checking %s: %v", hc.Type, err))
+		healthCheckErrorCounter.With(prometheus.Labels{"check": hc.Type}).Inc()
+		hc.Update("false", err.Error())
+	}
+
+	setHealthCheck(hc)
+}
+
+// memoryCheck compares the memory usage of the parent cgroup to its limit.
+// OOM kills are reported by the OOM kill check.
+func (c *cgroupMonitor) memoryCheck() {
+	hc := &types.HealthCheck{Type: cgroupMemoryCheck}
+	dir := c.path("memory")
+
+	usageFile, limitFile := "memory.current", "memory.max"
+	if !c.v2() {
+		usageFile, limitFile = "memory.usage_in_bytes", "memory.limit_in_bytes"
+	}
+	usage, _, err := readCgroupValue(filepath.Join(dir, usageFile))
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+	limit, unlimited, err := readCgroupValue(filepath.Join(dir, limitFile))
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+
+	result := "false"
+	var msg string
+	if unlimited || limit == 0 {
+		msg = fmt.Sprintf("cgroup %s: %s memory used, no memory limit", c.parent, units.HumanSize(float64(usage)))
+	} else {
+		used := float64(usage) / float64(limit) * 100
+		msg = fmt.Sprintf("cgroup %s: %s memory used out of %s limit (%.2f %%)", c.parent, units.HumanSize(float64(usage)), units.HumanSize(float64(limit)), used)
+		if used >= c.memoryLimit {
+			result = "true"
+		}
+	}
+
+	hc.Update(result, msg)
+	reportCheck(hc, nil)
+}
+
+// totalOOMKills returns the number of OOM kills in the cgroup tree of the
+// parent cgroup, whatever the limit reached. v2 counters of memory.events
+// are hierarchical, v1 counters of memory.oom_control are summed.
+func (c *cgroupMonitor) totalOOMKills() (uint64, error) {
+	dir := c.path("memory")
+	if c.v2() {
+		path := filepath.Join(dir, "memory.events")
+		events, err := readCgroupKeyValues(path)
+		if err != nil {
+			return 0, err
+		}
+		kills, ok := events["oom_kill"]
+		if !ok {
+			return 0, fmt.Errorf("%s: missing oom_kill counter", path)
+		}
+		return kills, nil
+	}
+
+	var total uint64
+	found := false
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		events, err := readCgroupKeyValues(filepath.Join(path, "memory.oom_control"))
+		if err != nil {
+			return nil
+		}
+		if kills, ok := events["oom_kill"]; ok {
+			total += kills
+			found = true
+		}
+		return nil
+	})
+	if err == nil && !found {
+		err = os.ErrNotExist
+	}
+	return total, err
+}
+
+// parentOOMs returns the number of times the memory limit of the parent
+// cgroup itself was reached and the OOM killer invoked, from the oom
+// counter of its memory.events.local. The hierarchical memory.events also
+// counts the allocations reaching their own limit. cgroup v1 has no such
+// counter.
+func (c *cgroupMonitor) parentOOMs() (uint64, error) {
+	if !c.v2() {
+		return 0, fmt.Errorf("cgroup %s: no local OOM counter with cgroup v1", c.parent)
+	}
+	path := filepath.Join(c.path("memory"), "memory.events.local")
+	events, err := readCgroupKeyValues(path)
+	if err != nil {
+		return 0, err
+	}
+	ooms, ok := events["oom"]
+	if !ok {
+		return 0, fmt.Errorf("%s: missing oom counter", path)
+	}
+	return ooms, nil
+}
+
+// cpuCheck reports the share of CPU periods of the parent cgroup which
+// were throttled since the previous cycle.
+func (c *cgroupMonitor) cpuCheck() {
+	hc := &types.HealthCheck{Type: cgroupCPUCheck}
+	stat, err := readCgroupKeyValues(filepath.Join(c.path("cpu"), "cpu.stat"))
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+
+	periods, throttled := stat["nr_periods"], stat["nr_throttled"]
+	previousPeriods, previousThrottled, hasPrevious := c.periods, c.throttled, c.hasCPUCounter
+	c.periods, c.throttled, c.hasCPUCounter = periods, throttled, true
+
+	if !hasPrevious || periods <= previousPeriods {
+		hc.Update("false", fmt.Sprintf("cgroup %s: no CPU periods since last cycle", c.parent))
+		reportCheck(hc, nil)
+		return
+	}
+
+	ratio := float64(throttled-previousThrottled) / float64(periods-previousPeriods) * 100
+	result := "false"
+	if ratio >= c.throttleLimit {
+		result = "true"
+	}
+	hc.Update(result, fmt.Sprintf("cgroup %s: %.2f %% of CPU periods throttled since last cycle (%d out of %d)",
+		c.parent, ratio, throttled-previousThrottled, periods-previousPeriods))
+	reportCheck(hc, nil)
+}
+
+// pidsCheck compares the number of processes of the parent cgroup to its limit.
+func (c *cgroupMonitor) pidsCheck() {
+	hc := &types.HealthCheck{Type: cgroupPidsCheck}
+	dir := c.path("pids")
+
+	current, _, err := readCgroupValue(filepath.Join(dir, "pids.current"))
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+	limit, unlimited, err := readCgroupValue(filepath.Join(dir, "pids.max"))
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+
+	if unlimited || limit == 0 {
+		hc.Update("false", fmt.Sprintf("cgroup %s: %d pids, no pids limit", c.parent, current))
+		reportCheck(hc, nil)
+		return
+	}
+
+	used := float64(current) / float64(limit) * 100
+	result := "false"
+	if used >= c.pidsLimit {
+		result = "true"
+	}
+	hc.Update(result, fmt.Sprintf("cgroup %s: %d pids out of %d limit (%.2f %%)", c.parent, current, limit, used))
+	reportCheck(hc, nil)
+}
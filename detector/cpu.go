@@ -0,0 +1,318 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package detector
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	procStat    = "/proc/stat"
+	procLoadavg = "/proc/loadavg"
+)
+
+// cpuTimes are the cumulative CPU times of the cpu line of /proc/stat.
+type cpuTimes struct {
+	user, nice, system, idle, iowait, irq, softirq, steal uint64
+	cores                                                 int
+}
+
+func (t *cpuTimes) total() uint64 {
+	return t.user + t.nice + t.system + t.idle + t.iowait + t.irq + t.softirq + t.steal
+}
+
+// readCPUTimes reads the CPU times of all CPUs, and the number of CPUs.
+func readCPUTimes() (*cpuTimes, error) {
+	f, err := os.Open(procStat)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var times *cpuTimes
+	cores := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] != "cpu" {
+			cores++
+			continue
+		}
+		if len(fields) < 9 {
+			return nil, fmt.Errorf("%s: invalid cpu line: %s", procStat, scanner.Text())
+		}
+
+		var values [8]uint64
+		for i := range values {
+			if values[i], err = strconv.ParseUint(fields[i+1], 10, 64); err != nil {
+				return nil, fmt.Errorf("%s: invalid cpu line: %v", procStat, err)
+			}
+		}
+		times = &cpuTimes{
+			user: values[0], nice: values[1], system: values[2], idle: values[3],
+			iowait: values[4], irq: values[5], softirq: values[6], steal: values[7],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if times == nil {
+		return nil, fmt.Errorf("%s: missing cpu line", procStat)
+	}
+	times.cores = cores
+	return times, nil
+}
+
+// readLoadAverage reads the 1 minute load average.
+func readLoadAverage() (float64, error) {
+	data, err := ioutil.ReadFile(procLoadavg)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("%s is empty", procLoadavg)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// cpuSample is the CPU usage between two readings of /proc/stat, in
+// percentage of the CPU time, and the load average per core.
+type cpuSample struct {
+	time        time.Time
+	busy        float64
+	iowait      float64
+	steal       float64
+	loadPerCore float64
+}
+
+// cpuThresholds are the CPU pressure thresholds. A threshold of 0 is disabled.
+type cpuThresholds struct {
+	busy        float64
+	iowait      float64
+	steal       float64
+	loadPerCore float64
+}
+
+// cpuMonitor samples /proc/stat in the background, and reports CPU
+// pressure once the aggregated samples of the window have been above a
+// threshold for the sustain period. It goes back to no pressure once they
+// have been below all thresholds for the sustain period.
+type cpuMonitor struct {
+	sync.Mutex
+	interval    time.Duration
+	window      time.Duration
+	aggregation string
+	sustain     time.Duration
+	thresholds  cpuThresholds
+
+	last    *cpuTimes
+	samples []cpuSample
+
+	underPressure bool
+	pendingSince  time.Time
+}
+
+// newCPUMonitor validates the sampler settings. The aggregation is avg, or
+// a percentile e.g. p95.
+func newCPUMonitor(interval, window time.Duration, aggregation string, sustain time.Duration) (*cpuMonitor, error) {
+	if interval <= 0 || window < interval {
+		return nil, fmt.Errorf("invalid --cpu-sample-interval %s and --cpu-window %s. The window must be at least one interval", interval, window)
+	}
+	if _, err := aggregationPercentile(aggregation); err != nil {
+		return nil, err
+	}
+	return &cpuMonitor{
+		interval:    interval,
+		window:      window,
+		aggregation: aggregation,
+		sustain:     sustain,
+	}, nil
+}
+
+// aggregationPercentile returns the percentile of the aggregation, 0 for avg.
+func aggregationPercentile(aggregation string) (float64, error) {
+	if aggregation == "avg" {
+		return 0, nil
+	}
+	if strings.HasPrefix(aggregation, "p") {
+		if p, err := strconv.ParseFloat(aggregation[1:], 64); err == nil && p > 0 && p <= 100 {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid --cpu-aggregation %s. Set avg or a percentile e.g. p95", aggregation)
+}
+
+// run samples /proc/stat every interval.
+func (c *cpuMonitor) run() {
+	for {
+		if err := c.sample(time.Now()); err != nil {
+			log.Warning(fmt.Sprintf("Error in sampling CPU usage: %v", err))
+			healthCheckErrorCounter.With(prometheus.Labels{"check": "CPUUnderPressure"}).Inc()
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+// sample reads /proc/stat and /proc/loadavg, and adds the CPU usage since
+// the previous reading to the window.
+func (c *cpuMonitor) sample(now time.Time) error {
+	times, err := readCPUTimes()
+	if err != nil {
+		return err
+	}
+	load, err := readLoadAverage()
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	last := c.last
+	c.last = times
+	if last == nil || times.total() <= last.total() {
+		return nil
+	}
+
+	total := float64(times.total() - last.total())
+	busy := (times.user + times.nice + times.system + times.irq + times.softirq) - (last.user + last.nice + last.system + last.irq + last.softirq)
+	s := cpuSample{
+		time:   now,
+		busy:   float64(busy) / total * 100,
+		iowait: float64(times.iowait-last.iowait) / total * 100,
+		steal:  float64(times.steal-last.steal) / total * 100,
+	}
+	if times.cores > 0 {
+		s.loadPerCore = load / float64(times.cores)
+	}
+	c.samples = append(c.samples, s)
+
+	// Keep the samples of the window.
+	i := 0
+	for i < len(c.samples) && now.Sub(c.samples[i].time) > c.window {
+		i++
+	}
+	c.samples = c.samples[i:]
+	return nil
+}
+
+// aggregate returns the aggregated samples of the window, and the number
+// of samples.
+func (c *cpuMonitor) aggregate() (cpuSample, int) {
+	var busy, iowait, steal, load []float64
+	for _, s := range c.samples {
+		busy = append(busy, s.busy)
+		iowait = append(iowait, s.iowait)
+		steal = append(steal, s.steal)
+		load = append(load, s.loadPerCore)
+	}
+
+	p, _ := aggregationPercentile(c.aggregation)
+	return cpuSample{
+		busy:        aggregateValues(busy, p),
+		iowait:      aggregateValues(iowait, p),
+		steal:       aggregateValues(steal, p),
+		loadPerCore: aggregateValues(load, p),
+	}, len(c.samples)
+}
+
+// aggregateValues returns the average of values, or their nearest rank
+// percentile p.
+func aggregateValues(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	if p == 0 {
+		total := 0.0
+		for _, v := range values {
+			total += v
+		}
+		return total / float64(len(values))
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// evaluate returns whether the node is under CPU pressure, and a message
+// with the aggregated CPU usage and the thresholds it is above.
+func (c *cpuMonitor) evaluate(now time.Time) (bool, string) {
+	c.Lock()
+	defer c.Unlock()
+
+	stats, n := c.aggregate()
+	if n == 0 {
+		return c.underPressure, "CPU usage: no samples yet"
+	}
+
+	var breaches []string
+	check := func(name string, value, threshold float64, unit string) {
+		if threshold > 0 && value >= threshold {
+			breaches = append(breaches, fmt.Sprintf("%s %.2f%s >= %.2f%s", name, value, unit, threshold, unit))
+		}
+	}
+	check("user+system", stats.busy, c.thresholds.busy, "%")
+	check("iowait", stats.iowait, c.thresholds.iowait, "%")
+	check("steal", stats.steal, c.thresholds.steal, "%")
+	check("load per core", stats.loadPerCore, c.thresholds.loadPerCore, "")
+
+	// The state only changes once the breach (or its absence) is sustained.
+	breaching := len(breaches) > 0
+	if breaching == c.underPressure {
+		c.pendingSince = time.Time{}
+	} else {
+		if c.pendingSince.IsZero() {
+			c.pendingSince = now
+		}
+		if now.Sub(c.pendingSince) >= c.sustain {
+			c.underPressure = breaching
+			c.pendingSince = time.Time{}
+		}
+	}
+
+	msg := fmt.Sprintf("CPU usage (%s over %s): user+system %.2f %%, iowait %.2f %%, steal %.2f %%, load per core %.2f",
+		c.aggregation, c.window, stats.busy, stats.iowait, stats.steal, stats.loadPerCore)
+	if breaching {
+		msg = fmt.Sprintf("%s; %s", msg, strings.Join(breaches, ", "))
+		if !c.pendingSince.IsZero() {
+			msg = fmt.Sprintf("%s, for %s", msg, now.Sub(c.pendingSince).Round(time.Second))
+		}
+	}
+	return c.underPressure, msg
+}
@@ -41,9 +41,27 @@ import (
 )
 
 type Limits struct {
-	cpuLimit    string
-	memoryLimit string
-	diskLimit   string
+	cpuLimit            string
+	cpuIowaitLimit      string
+	cpuStealLimit       string
+	loadPerCoreLimit    string
+	memoryLimit         string
+	diskLimit           string
+	cgroupMemoryLimit   string
+	cgroupThrottleLimit string
+	cgroupPidsLimit     string
+	fileNrLimit         string
+	kernelPidsLimit     string
+	conntrackLimit      string
+}
+
+// builtinChecks keep the state of the built-in checks across detector cycles.
+type builtinChecks struct {
+	cpu    *cpuMonitor
+	cgroup *cgroupMonitor
+	oom    *oomMonitor
+	fs     *fsMonitor
+	kernel kernelTableLimits
 }
 
 var (
@@ -61,6 +79,16 @@ var (
 	healthCheckErrorCounter   = &prometheus.CounterVec{}
 	healthCheckProblemCounter = &prometheus.CounterVec{}
 	healthCheckProblemGauge   = &prometheus.GaugeVec{}
+
+	// Execution metrics of the health check scripts, labeled with the check type.
+	checkDurationHistogram  = &prometheus.HistogramVec{}
+	checkLastSuccessGauge   = &prometheus.GaugeVec{}
+	checkExitCodeGauge      = &prometheus.GaugeVec{}
+	checkStdoutBytesCounter = &prometheus.CounterVec{}
+	checkStderrBytesCounter = &prometheus.CounterVec{}
+	checkCPUSecondsCounter  = &prometheus.CounterVec{}
+
+	scriptMetricsDroppedCounter = &prometheus.CounterVec{}
 )
 
 //Todo: Add comments to describe locking/contention.
@@ -89,6 +117,11 @@ var DetectorCommand = &cli.Command{
 			Value: "/v1/metrics/",
 			Usage: "The path to expose the detector metrics in prometheus format",
 		},
+		&cli.IntFlag{
+			Name:  "script-metrics-max-series",
+			Value: 100,
+			Usage: "Maximum number of metric series a health check script can emit. Set to 0 to ignore the metrics emitted by scripts",
+		},
 		&cli.BoolFlag{
 			Name:  "auth",
 			Usage: "If set to true, detector must set DETECTOR_HTTP_TOKEN=<your_token> as an environment variable when starting detector",
@@ -102,7 +135,42 @@ var DetectorCommand = &cli.Command{
 			Name:    "cpu-limit",
 			Aliases: []string{"cl"},
 			Value:   "85",
-			Usage:   "CPU threshold in percentage",
+			Usage:   "User+system CPU threshold in percentage",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-iowait-limit",
+			Value: "0",
+			Usage: "CPU iowait threshold in percentage. Set to 0 to disable it",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-steal-limit",
+			Value: "0",
+			Usage: "CPU steal threshold in percentage. Set to 0 to disable it",
+		},
+		&cli.StringFlag{
+			Name:  "load-per-core-limit",
+			Value: "0",
+			Usage: "1 minute load average per CPU core threshold. Set to 0 to disable it",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-sample-interval",
+			Value: "1s",
+			Usage: "Time between two samples of /proc/stat",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-window",
+			Value: "1m",
+			Usage: "Window over which the CPU samples are aggregated",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-aggregation",
+			Value: "avg",
+			Usage: "Aggregation of the CPU samples of the window: avg, or a percentile e.g. p95",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-sustain",
+			Value: "1m",
+			Usage: "Time a CPU threshold must be breached (or no longer breached) before CPUUnderPressure changes",
 		},
 		&cli.StringFlag{
 			Name:    "memory-limit",
@@ -116,6 +184,90 @@ var DetectorCommand = &cli.Command{
 			Value:   "90",
 			Usage:   "Disk threshold in percentage",
 		},
+		&cli.StringFlag{
+			Name:  "cgroup-root",
+			Value: "/sys/fs/cgroup",
+			Usage: "Mount point of the cgroup hierarchy (v2), or of the cgroup v1 controllers",
+		},
+		&cli.StringFlag{
+			Name:  "cgroup-parent",
+			Usage: "Parent cgroup of the Nomad allocations, relative to --cgroup-root (v2) or to the controllers (v1). Defaults to nomad.slice with cgroup v2, and nomad with cgroup v1. Set to an empty string to disable the cgroup checks",
+		},
+		&cli.StringFlag{
+			Name:  "cgroup-memory-limit",
+			Value: "90",
+			Usage: "Memory usage threshold of the parent cgroup, in percentage of its memory limit",
+		},
+		&cli.StringFlag{
+			Name:  "cgroup-throttle-limit",
+			Value: "25",
+			Usage: "CPU throttling threshold of the parent cgroup, in percentage of the CPU periods since the last cycle",
+		},
+		&cli.StringFlag{
+			Name:  "cgroup-pids-limit",
+			Value: "90",
+			Usage: "Number of processes threshold of the parent cgroup, in percentage of its pids limit",
+		},
+		&cli.IntFlag{
+			Name:  "oom-kill-limit",
+			Value: 2,
+			Usage: "OOMKilling is reported when more than this number of OOM kills happen within --oom-window",
+		},
+		&cli.StringFlag{
+			Name:  "oom-window",
+			Value: "10m",
+			Usage: "Window over which the OOM kills are counted",
+		},
+		&cli.StringFlag{
+			Name:  "oom-quiet-period",
+			Value: "15m",
+			Usage: "Time without OOM kill before OOMKilling clears",
+		},
+		&cli.StringFlag{
+			Name:  "oom-kill-scope",
+			Value: "all",
+			Usage: "OOM kills counted by OOMKilling: all, from /proc/vmstat and the cgroup memory.events, or node, only the global OOM kills and the OOMs at the memory limit of --cgroup-parent",
+		},
+		&cli.StringFlag{
+			Name:  "oom-kernel-log",
+			Value: "/dev/kmsg",
+			Usage: "Kernel log to read the OOM killed processes, and the global OOM kills of the node scope, from. Set to an empty string to disable it",
+		},
+		&cli.StringFlag{
+			Name:  "fs-mountpoints",
+			Value: "/",
+			Usage: "Comma separated list of mountpoints to check for read-only and degraded filesystems. Set to an empty string to disable the filesystem checks",
+		},
+		&cli.StringFlag{
+			Name:  "fs-probe-dir",
+			Value: ".nnpd-probe",
+			Usage: "Scratch directory of the write/fsync/delete probe, relative to each mountpoint",
+		},
+		&cli.StringFlag{
+			Name:  "fs-probe-latency-limit",
+			Value: "500ms",
+			Usage: "Latency threshold of the write/fsync/delete probe. Set to 0 to disable it",
+		},
+		&cli.StringFlag{
+			Name:  "fs-probe-timeout",
+			Value: "5s",
+			Usage: "Time to wait for the write/fsync/delete probe before reporting it as failed",
+		},
+		&cli.StringFlag{
+			Name:  "file-nr-limit",
+			Value: "90",
+			Usage: "Allocated file descriptors threshold, in percentage of fs.file-max",
+		},
+		&cli.StringFlag{
+			Name:  "kernel-pids-limit",
+			Value: "90",
+			Usage: "Number of threads threshold, in percentage of the lowest of kernel.pid_max and kernel.threads-max",
+		},
+		&cli.StringFlag{
+			Name:  "conntrack-limit",
+			Value: "90",
+			Usage: "Conntrack table threshold, in percentage of nf_conntrack_max",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		return startNpdHttpServer(c)
@@ -143,11 +295,69 @@ func startNpdHttpServer(context *cli.Context) error {
 	}
 
 	limits := &Limits{
-		cpuLimit:    context.String("cpu-limit"),
-		memoryLimit: context.String("memory-limit"),
-		diskLimit:   context.String("disk-limit"),
+		cpuLimit:            context.String("cpu-limit"),
+		cpuIowaitLimit:      context.String("cpu-iowait-limit"),
+		cpuStealLimit:       context.String("cpu-steal-limit"),
+		loadPerCoreLimit:    context.String("load-per-core-limit"),
+		memoryLimit:         context.String("memory-limit"),
+		diskLimit:           context.String("disk-limit"),
+		cgroupMemoryLimit:   context.String("cgroup-memory-limit"),
+		cgroupThrottleLimit: context.String("cgroup-throttle-limit"),
+		cgroupPidsLimit:     context.String("cgroup-pids-limit"),
+		fileNrLimit:         context.String("file-nr-limit"),
+		kernelPidsLimit:     context.String("kernel-pids-limit"),
+		conntrackLimit:      context.String("conntrack-limit"),
+	}
+
+	cpuSampleInterval, err := time.ParseDuration(context.String("cpu-sample-interval"))
+	if err != nil {
+		return err
+	}
+	cpuWindow, err := time.ParseDuration(context.String("cpu-window"))
+	if err != nil {
+		return err
+	}
+	cpuSustain, err := time.ParseDuration(context.String("cpu-sustain"))
+	if err != nil {
+		return err
+	}
+	cpu, err := newCPUMonitor(cpuSampleInterval, cpuWindow, context.String("cpu-aggregation"), cpuSustain)
+	if err != nil {
+		return err
+	}
+
+	oomWindow, err := time.ParseDuration(context.String("oom-window"))
+	if err != nil {
+		return err
+	}
+	oomQuietPeriod, err := time.ParseDuration(context.String("oom-quiet-period"))
+	if err != nil {
+		return err
+	}
+	oomKillLimit := context.Int("oom-kill-limit")
+	if oomKillLimit < 0 {
+		return fmt.Errorf("invalid --oom-kill-limit %d. It must be 0 or more", oomKillLimit)
+	}
+	oomKillScope := context.String("oom-kill-scope")
+	if oomKillScope != oomScopeAll && oomKillScope != oomScopeNode {
+		return fmt.Errorf("invalid --oom-kill-scope %s. It must be %s or %s", oomKillScope, oomScopeAll, oomScopeNode)
+	}
+
+	kernelLimits, err := parseKernelTableLimits(limits.fileNrLimit, limits.kernelPidsLimit, limits.conntrackLimit)
+	if err != nil {
+		return err
+	}
+
+	fsProbeLatencyLimit, err := time.ParseDuration(context.String("fs-probe-latency-limit"))
+	if err != nil {
+		return err
+	}
+	fsProbeTimeout, err := time.ParseDuration(context.String("fs-probe-timeout"))
+	if err != nil {
+		return err
 	}
 
+	scriptMetrics.maxSeries = context.Int("script-metrics-max-series")
 	reg := registerMetrics()
 
 	nomadAllocDir := os.Getenv("NOMAD_ALLOC_DIR")
@@ -158,7 +368,21 @@ func startNpdHttpServer(context *cli.Context) error {
 	detectorInfo.With(prometheus.Labels{"version": context.App.Version}).Set(1)
 
 	done := make(chan bool, 1)
-	go collect(done, detectorCycleTime, limits)
+	cgroupRoot, cgroupParent := context.String("cgroup-root"), context.String("cgroup-parent")
+	if !context.IsSet("cgroup-parent") {
+		cgroupParent = defaultCgroupParent(cgroupRoot)
+	}
+	cgroup := newCgroupMonitor(cgroupRoot, cgroupParent)
+	checks := &builtinChecks{
+		cpu:    cpu,
+		cgroup: cgroup,
+		oom:    newOOMMonitor(uint64(oomKillLimit), oomWindow, oomQuietPeriod, oomKillScope, context.String("oom-kernel-log"), cgroup),
+		fs:     newFSMonitor(context.String("fs-mountpoints"), context.String("fs-probe-dir"), fsProbeLatencyLimit, fsProbeTimeout),
+		kernel: kernelLimits,
+	}
+
+	go cpu.run()
+	go collect(done, detectorCycleTime, limits, checks)
 	<-done
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -170,9 +394,14 @@ func startNpdHttpServer(context *cli.Context) error {
 	metricsPath := context.String("prometheus-metrics-path")
 	http.Handle(metricsPath, metricsHandler(reg))
 
-	log.Info(fmt.Sprintf("detector started with --cpu-limit: %s%%", limits.cpuLimit))
+	log.Info(fmt.Sprintf("detector started with --cpu-limit: %s%%, --cpu-iowait-limit: %s%%, --cpu-steal-limit: %s%%, --load-per-core-limit: %s",
+		limits.cpuLimit, limits.cpuIowaitLimit, limits.cpuStealLimit, limits.loadPerCoreLimit))
+	log.Info(fmt.Sprintf("detector started with --cpu-aggregation: %s over --cpu-window: %s, sampled every %s, sustained for %s", cpu.aggregation, cpuWindow, cpuSampleInterval, cpuSustain))
 	log.Info(fmt.Sprintf("detector started with --memory-limit: %s%%", limits.memoryLimit))
 	log.Info(fmt.Sprintf("detector started with --disk-limit: %s%%", limits.diskLimit))
+	log.Info(fmt.Sprintf("detector started with --oom-kill-limit: %d within --oom-window: %s, --oom-quiet-period: %s, --oom-kill-scope: %s", oomKillLimit, oomWindow, oomQuietPeriod, oomKillScope))
+	log.Info(fmt.Sprintf("detector started with --file-nr-limit: %s%%, --kernel-pids-limit: %s%%, --conntrack-limit: %s%%", limits.fileNrLimit, limits.kernelPidsLimit, limits.conntrackLimit))
+	log.Info(fmt.Sprintf("detector started with --fs-mountpoints: %s, --fs-probe-latency-limit: %s", strings.Join(checks.fs.mountpoints, ","), fsProbeLatencyLimit))
 
 	port := context.String("port")
 	log.Info(fmt.Sprintf("nomad node problem detector ready to receive requests. Listening on %s", port))
@@ -199,7 +428,7 @@ func readConfig(configPath string, configFile interface{}) error {
 	return json.Unmarshal(data, configFile)
 }
 
-func collect(done chan bool, detectorCycleTime time.Duration, limits *Limits) {
+func collect(done chan bool, detectorCycleTime time.Duration, limits *Limits, checks *builtinChecks) {
 	startServer := false
 	configPath := nnpdRoot + "/config.json"
 
@@ -217,6 +446,18 @@ func collect(done chan bool, detectorCycleTime time.Duration, limits *Limits) {
 		log.Fatal(errMsg)
 	}
 
+	cpu := checks.cpu
+	cpu.thresholds.busy = cpuLimit
+	if cpu.thresholds.iowait, err = strconv.ParseFloat(limits.cpuIowaitLimit, 64); err != nil {
+		log.Fatal(fmt.Sprintf("Error in parsing --cpu-iowait-limit: %s", err.Error()))
+	}
+	if cpu.thresholds.steal, err = strconv.ParseFloat(limits.cpuStealLimit, 64); err != nil {
+		log.Fatal(fmt.Sprintf("Error in parsing --cpu-steal-limit: %s", err.Error()))
+	}
+	if cpu.thresholds.loadPerCore, err = strconv.ParseFloat(limits.loadPerCoreLimit, 64); err != nil {
+		log.Fatal(fmt.Sprintf("Error in parsing --load-per-core-limit: %s", err.Error()))
+	}
+
 	memoryLimit, err := strconv.ParseFloat(limits.memoryLimit, 64)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error in parsing --memory-limit: %s", err.Error())
@@ -229,6 +470,17 @@ func collect(done chan bool, detectorCycleTime time.Duration, limits *Limits) {
 		log.Fatal(errMsg)
 	}
 
+	cgroup := checks.cgroup
+	if cgroup.memoryLimit, err = strconv.ParseFloat(limits.cgroupMemoryLimit, 64); err != nil {
+		log.Fatal(fmt.Sprintf("Error in parsing --cgroup-memory-limit: %s", err.Error()))
+	}
+	if cgroup.throttleLimit, err = strconv.ParseFloat(limits.cgroupThrottleLimit, 64); err != nil {
+		log.Fatal(fmt.Sprintf("Error in parsing --cgroup-throttle-limit: %s", err.Error()))
+	}
+	if cgroup.pidsLimit, err = strconv.ParseFloat(limits.cgroupPidsLimit, 64); err != nil {
+		log.Fatal(fmt.Sprintf("Error in parsing --cgroup-pids-limit: %s", err.Error()))
+	}
+
 	for {
 		for _, cfg := range configFile {
 			wg.Add(1)
@@ -236,9 +488,13 @@ func collect(done chan bool, detectorCycleTime time.Duration, limits *Limits) {
 		}
 		wg.Wait()
 
-		getCPUStats(cpuLimit)
+		getCPUStats(cpu)
 		getMemoryStats(memoryLimit)
 		getDiskStats(diskLimit)
+		getCgroupStats(cgroup)
+		getOOMStats(checks.oom)
+		getFilesystemStats(checks.fs)
+		getKernelTableStats(checks.kernel)
 
 		if !startServer {
 			startServer = true
@@ -262,24 +518,30 @@ func collect(done chan bool, detectorCycleTime time.Duration, limits *Limits) {
 
 }
 
-// Get CPU usage of the nomad client node.
-func getCPUStats(cpuLimit float64) {
+// setHealthCheck records the latest result of a health check. A failing
+// health check keeps the time it started failing from its previous result.
+func setHealthCheck(hc *types.HealthCheck) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if hc.Failed() {
+		hc.FailingSince = hc.LastRun
+		if prev, ok := m[hc.Type]; ok && prev.Failed() && !prev.FailingSince.IsZero() {
+			hc.FailingSince = prev.FailingSince
+		}
+	}
+	m[hc.Type] = hc
+}
+
+// Get CPU pressure of the nomad client node, from the background CPU sampler.
+func getCPUStats(cpu *cpuMonitor) {
 	hc := &types.HealthCheck{}
 	hc.Type = "CPUUnderPressure"
 
-	cpuStats, err := collectCPUStats()
-	if err != nil {
-		hc.Update("true", err.Error())
-		healthCheckErrorCounter.With(prometheus.Labels{"check": hc.Type}).Inc()
-	} else if cpuStats.User >= cpuLimit {
-		hc.Update("true", fmt.Sprintf("CPU usage: %f %%", cpuStats.User))
-	} else {
-		hc.Update("false", fmt.Sprintf("CPU usage: %f %%", cpuStats.User))
-	}
+	underPressure, msg := cpu.evaluate(time.Now())
+	hc.Update(strconv.FormatBool(underPressure), msg)
 
-	mutex.Lock()
-	m[hc.Type] = hc
-	mutex.Unlock()
+	setHealthCheck(hc)
 }
 
 // Get memory usage of the nomad client node.
@@ -306,9 +568,7 @@ func getMemoryStats(memoryLimit float64) {
 		hc.Update(result, fmt.Sprintf("%s memory available out of %s total memory", availableMemory, totalMemory))
 	}
 
-	mutex.Lock()
-	m[hc.Type] = hc
-	mutex.Unlock()
+	setHealthCheck(hc)
 }
 
 // Get disk usage of the nomad client node.
@@ -326,9 +586,7 @@ func getDiskStats(diskLimit float64) {
 		hc.Update("false", fmt.Sprintf("disk usage is %f %%", diskStats.UsedPercent))
 	}
 
-	mutex.Lock()
-	m[hc.Type] = hc
-	mutex.Unlock()
+	setHealthCheck(hc)
 }
 
 func executeHealthCheck(wg *sync.WaitGroup, cfg types.Config) {
@@ -344,15 +602,47 @@ func executeHealthCheck(wg *sync.WaitGroup, cfg types.Config) {
 	var stderr bytes.Buffer
 	cmd.Stdout = &output
 	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
+	start := time.Now()
+	err := cmd.Run()
+	observeCheckRun(cfg.Type, cmd, time.Since(start), output.Len(), stderr.Len())
+
+	message, samples, parseErr := parseScriptOutput(output.String())
+	if parseErr != nil {
+		log.Warning(fmt.Sprintf("Health check %s: error in parsing metrics: %v", cfg.Type, parseErr))
+	}
+	scriptMetrics.set(cfg.Type, samples)
+
+	if err != nil {
 		hc.Update("Unhealthy", fmt.Sprintf("%s:%s\n", err.Error(), stderr.String()))
 	} else {
-		hc.Update("Healthy", output.String())
+		hc.Update("Healthy", message)
 	}
 
-	mutex.Lock()
-	m[cfg.Type] = hc
-	mutex.Unlock()
+	setHealthCheck(hc)
+}
+
+// observeCheckRun exports the execution metrics of a health check script:
+// how long it ran, its exit code, the size of its output, and the CPU time
+// of the child process. The exit code is -1 when the script couldn't be
+// started, or was killed by a signal e.g. on timeout.
+func observeCheckRun(checkType string, cmd *exec.Cmd, duration time.Duration, stdoutBytes, stderrBytes int) {
+	labels := prometheus.Labels{"type": checkType}
+	checkDurationHistogram.With(labels).Observe(duration.Seconds())
+	checkStdoutBytesCounter.With(labels).Add(float64(stdoutBytes))
+	checkStderrBytesCounter.With(labels).Add(float64(stderrBytes))
+
+	state := cmd.ProcessState
+	if state == nil {
+		checkExitCodeGauge.With(labels).Set(-1)
+		return
+	}
+
+	checkExitCodeGauge.With(labels).Set(float64(state.ExitCode()))
+	if state.Success() {
+		checkLastSuccessGauge.With(labels).SetToCurrentTime()
+	}
+	checkCPUSecondsCounter.With(prometheus.Labels{"type": checkType, "mode": "user"}).Add(state.UserTime().Seconds())
+	checkCPUSecondsCounter.With(prometheus.Labels{"type": checkType, "mode": "system"}).Add(state.SystemTime().Seconds())
 }
 
 func validateAuthorizationToken(w http.ResponseWriter, r *http.Request) error {
@@ -446,6 +736,37 @@ func registerMetrics() *prometheus.Registry {
 	gaugeOpts.Help = "If a specific check is affecting the host or not"
 	healthCheckProblemGauge = prometheus.NewGaugeVec(gaugeOpts, []string{"check"})
 
+	histogramOpts := prometheus.HistogramOpts{ConstLabels: counterOpts.ConstLabels}
+	histogramOpts.Name = "npd_detector_check_duration_seconds"
+	histogramOpts.Help = "Time a health check script took to run"
+	histogramOpts.Buckets = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+	checkDurationHistogram = prometheus.NewHistogramVec(histogramOpts, []string{"type"})
+
+	gaugeOpts.Name = "npd_detector_check_last_success_timestamp_seconds"
+	gaugeOpts.Help = "Time a health check script last exited successfully, in seconds since epoch"
+	checkLastSuccessGauge = prometheus.NewGaugeVec(gaugeOpts, []string{"type"})
+
+	gaugeOpts.Name = "npd_detector_check_exit_code"
+	gaugeOpts.Help = "Exit code of the last run of a health check script, -1 if it couldn't be started or was killed by a signal"
+	checkExitCodeGauge = prometheus.NewGaugeVec(gaugeOpts, []string{"type"})
+
+	counterOpts.Name = "npd_detector_check_stdout_bytes_total"
+	counterOpts.Help = "Bytes written to stdout by a health check script"
+	checkStdoutBytesCounter = prometheus.NewCounterVec(counterOpts, []string{"type"})
+
+	counterOpts.Name = "npd_detector_check_stderr_bytes_total"
+	counterOpts.Help = "Bytes written to stderr by a health check script"
+	checkStderrBytesCounter = prometheus.NewCounterVec(counterOpts, []string{"type"})
+
+	counterOpts.Name = "npd_detector_check_cpu_seconds_total"
+	counterOpts.Help = "CPU time consumed by a health check script, in user and system mode"
+	checkCPUSecondsCounter = prometheus.NewCounterVec(counterOpts, []string{"type", "mode"})
+
+	counterOpts.Name = "npd_detector_script_metrics_dropped_total"
+	counterOpts.Help = "Metric series emitted by a health check script above --script-metrics-max-series, which were dropped"
+	scriptMetricsDroppedCounter = prometheus.NewCounterVec(counterOpts, []string{"type"})
+	scriptMetrics.constLabels = counterOpts.ConstLabels
+
 	r := prometheus.NewRegistry()
 	r.MustRegister(prometheus.NewGoCollector())
 	r.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
@@ -453,5 +774,13 @@ func registerMetrics() *prometheus.Registry {
 	r.MustRegister(healthCheckProblemCounter)
 	r.MustRegister(healthCheckProblemGauge)
 	r.MustRegister(healthCheckErrorCounter)
+	r.MustRegister(checkDurationHistogram)
+	r.MustRegister(checkLastSuccessGauge)
+	r.MustRegister(checkExitCodeGauge)
+	r.MustRegister(checkStdoutBytesCounter)
+	r.MustRegister(checkStderrBytesCounter)
+	r.MustRegister(checkCPUSecondsCounter)
+	r.MustRegister(scriptMetricsDroppedCounter)
+	r.MustRegister(scriptMetrics)
 	return r
 }
@@ -19,14 +19,21 @@ package detector
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -74,15 +81,89 @@ func TestCPUStatsUnderLimit(t *testing.T) {
 		Result: "false",
 	}
 
-	cpuLimit := 75.0
-	getCPUStats(cpuLimit)
+	dir := t.TempDir()
+	defer func(stat, loadavg string) { procStat, procLoadavg = stat, loadavg }(procStat, procLoadavg)
+	procStat, procLoadavg = filepath.Join(dir, "stat"), filepath.Join(dir, "loadavg")
+	assert.Nil(t, ioutil.WriteFile(procLoadavg, []byte("0.50 0.40 0.30 1/71 21512\n"), 0644))
+
+	cpu, err := newCPUMonitor(time.Second, time.Minute, "avg", 0)
+	assert.Nil(t, err)
+	cpu.thresholds = cpuThresholds{busy: 75.0}
+	start := time.Now()
+	assert.Nil(t, ioutil.WriteFile(procStat, []byte("cpu  100 0 100 800 0 0 0 0 0 0\ncpu0 100 0 100 800 0 0 0 0 0 0\nintr 0\n"), 0644))
+	assert.Nil(t, cpu.sample(start))
+	// 40% user+system over the second sample.
+	assert.Nil(t, ioutil.WriteFile(procStat, []byte("cpu  130 0 110 860 0 0 0 0 0 0\ncpu0 130 0 110 860 0 0 0 0 0 0\nintr 0\n"), 0644))
+	assert.Nil(t, cpu.sample(start.Add(time.Second)))
+	getCPUStats(cpu)
 
 	actual := m[expected.Type]
 	delete(m, expected.Type)
 
 	assert.Equal(t, actual.Type, expected.Type, "Type should be equal")
 	assert.Equal(t, actual.Result, expected.Result, "Result should be equal")
-	assert.Contains(t, actual.Message, "CPU usage", "Message should contain CPU usage")
+	assert.Contains(t, actual.Message, "user+system 40.00 %", "Message should contain CPU usage")
+}
+
+// TestCPUMonitor test the CPU sampler window, aggregation and sustained breaches.
+func TestCPUMonitor(t *testing.T) {
+	dir := t.TempDir()
+	defer func(stat, loadavg string) { procStat, procLoadavg = stat, loadavg }(procStat, procLoadavg)
+	procStat, procLoadavg = filepath.Join(dir, "stat"), filepath.Join(dir, "loadavg")
+	assert.Nil(t, ioutil.WriteFile(procLoadavg, []byte("4.00 3.00 2.00 2/71 21512\n"), 0644))
+
+	// user nice system idle iowait irq softirq steal, on 2 cores.
+	write := func(user, system, idle, iowait, steal uint64) {
+		stat := fmt.Sprintf("cpu  %d 0 %d %d %d 0 0 %d 0 0\ncpu0 0 0 0 0 0 0 0 0 0 0\ncpu1 0 0 0 0 0 0 0 0 0 0\nintr 0\n", user, system, idle, iowait, steal)
+		assert.Nil(t, ioutil.WriteFile(procStat, []byte(stat), 0644))
+	}
+
+	_, err := newCPUMonitor(time.Second, time.Minute, "p101", 0)
+	assert.NotNil(t, err)
+
+	cpu, err := newCPUMonitor(time.Second, 30*time.Second, "p50", 20*time.Second)
+	assert.Nil(t, err)
+	cpu.thresholds = cpuThresholds{busy: 85, iowait: 25, steal: 10, loadPerCore: 4}
+
+	start := time.Now()
+	write(0, 0, 0, 0, 0)
+	assert.Nil(t, cpu.sample(start))
+
+	// 10s of 50% user+system, 30% iowait.
+	var user, system, idle, iowait uint64
+	for i := 1; i <= 10; i++ {
+		user, system, idle, iowait = user+40, system+10, idle+20, iowait+30
+		write(user, system, idle, iowait, 0)
+		assert.Nil(t, cpu.sample(start.Add(time.Duration(i)*time.Second)))
+	}
+
+	// The breach starts, but isn't sustained yet.
+	underPressure, msg := cpu.evaluate(start.Add(10 * time.Second))
+	assert.False(t, underPressure)
+	assert.Contains(t, msg, "user+system 50.00 %, iowait 30.00 %, steal 0.00 %, load per core 2.00")
+	assert.Contains(t, msg, "iowait 30.00% >= 25.00%")
+
+	underPressure, _ = cpu.evaluate(start.Add(30 * time.Second))
+	assert.True(t, underPressure)
+
+	// A single idle second doesn't move the median.
+	idle += 100
+	write(user, system, idle, iowait, 0)
+	assert.Nil(t, cpu.sample(start.Add(31*time.Second)))
+	underPressure, _ = cpu.evaluate(start.Add(31 * time.Second))
+	assert.True(t, underPressure)
+
+	// Once the busy samples are out of the window, the recovery must be sustained too.
+	for i := 32; i <= 70; i++ {
+		idle += 100
+		write(user, system, idle, iowait, 0)
+		assert.Nil(t, cpu.sample(start.Add(time.Duration(i)*time.Second)))
+	}
+	underPressure, msg = cpu.evaluate(start.Add(70 * time.Second))
+	assert.True(t, underPressure)
+	assert.Contains(t, msg, "iowait 0.00 %")
+	underPressure, _ = cpu.evaluate(start.Add(90 * time.Second))
+	assert.False(t, underPressure)
 }
 
 // TestMemoryStats test if memory is under/over limit.
@@ -191,6 +272,25 @@ func TestNodeHealthEndpoint(t *testing.T) {
 	delete(m, "portworx")
 }
 
+// TestFailingSince test that a failing health check keeps the time it started failing.
+func TestFailingSince(t *testing.T) {
+	defer delete(m, "docker")
+
+	start := time.Now().Add(-time.Minute)
+	setHealthCheck(&types.HealthCheck{Type: "docker", Result: "Unhealthy", LastRun: start})
+	assert.True(t, m["docker"].FailingSince.Equal(start))
+
+	setHealthCheck(&types.HealthCheck{Type: "docker", Result: "Unhealthy", LastRun: time.Now()})
+	assert.True(t, m["docker"].FailingSince.Equal(start), "failing since should be kept while failing")
+
+	setHealthCheck(&types.HealthCheck{Type: "docker", Result: "Healthy", LastRun: time.Now()})
+	assert.True(t, m["docker"].FailingSince.IsZero())
+
+	now := time.Now()
+	setHealthCheck(&types.HealthCheck{Type: "docker", Result: "Unhealthy", LastRun: now})
+	assert.True(t, m["docker"].FailingSince.Equal(now))
+}
+
 // TestHealthEndpoint test the /v1/health/ HTTP endpoint.
 func TestHealthEndpoint(t *testing.T) {
 	req, err := http.NewRequest("POST", "/v1/health/", nil)
@@ -228,3 +328,450 @@ func TestMetricsEndpoint(t *testing.T) {
 		t.Errorf("prometheusMetricsHandlerFor returned incorrect content: got %v, expected %v", rr.Body.String(), expectedMetric)
 	}
 }
+
+// TestCheckExecutionMetrics test the duration, exit code, output and CPU time metrics of health check scripts.
+func TestCheckExecutionMetrics(t *testing.T) {
+	registerMetrics()
+
+	root := t.TempDir()
+	defer func(root string) { nnpdRoot = root }(nnpdRoot)
+	nnpdRoot = root
+
+	scripts := map[string]string{
+		"healthy":   "#!/bin/sh\necho ok\n",
+		"unhealthy": "#!/bin/sh\necho failed >&2\nexit 3\n",
+	}
+	for checkType, script := range scripts {
+		assert.Nil(t, os.MkdirAll(filepath.Join(root, checkType), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(root, checkType, "check.sh"), []byte(script), 0755))
+	}
+
+	var wg sync.WaitGroup
+	for _, checkType := range []string{"healthy", "unhealthy", "missing"} {
+		wg.Add(1)
+		executeHealthCheck(&wg, types.Config{Type: checkType, HealthCheck: "check.sh"})
+	}
+	defer func() {
+		for _, checkType := range []string{"healthy", "unhealthy", "missing"} {
+			delete(m, checkType)
+		}
+	}()
+
+	healthy := prometheus.Labels{"type": "healthy"}
+	unhealthy := prometheus.Labels{"type": "unhealthy"}
+	assert.Equal(t, 0.0, testutil.ToFloat64(checkExitCodeGauge.With(healthy)))
+	assert.Equal(t, 3.0, testutil.ToFloat64(checkExitCodeGauge.With(unhealthy)))
+	assert.Equal(t, -1.0, testutil.ToFloat64(checkExitCodeGauge.With(prometheus.Labels{"type": "missing"})))
+	assert.Equal(t, 3.0, testutil.ToFloat64(checkStdoutBytesCounter.With(healthy)))
+	assert.Equal(t, 7.0, testutil.ToFloat64(checkStderrBytesCounter.With(unhealthy)))
+	assert.InDelta(t, float64(time.Now().Unix()), testutil.ToFloat64(checkLastSuccessGauge.With(healthy)), 60)
+	assert.Equal(t, 0.0, testutil.ToFloat64(checkLastSuccessGauge.With(unhealthy)))
+	assert.Equal(t, 3, testutil.CollectAndCount(checkDurationHistogram))
+	assert.Equal(t, 4, testutil.CollectAndCount(checkCPUSecondsCounter))
+	assert.Equal(t, "Unhealthy", m["unhealthy"].Result)
+}
+
+// TestScriptMetrics test parsing and re-exporting the metrics emitted by health check scripts.
+func TestScriptMetrics(t *testing.T) {
+	stdout := "NTP OK: offset 12ms | offset=12ms;100;500 'zombie count'=3 reads=42c used=10KB;;;0;100 missing=U\n" +
+		"details\n" +
+		"# BEGIN NPD METRICS\n" +
+		"# TYPE containers gauge\n" +
+		"containers{state=\"running\",type=\"docker\"} 7\n" +
+		"containers{state=\"exited\"} 2\n" +
+		"# END NPD METRICS\n"
+
+	message, samples, err := parseScriptOutput(stdout)
+	assert.Nil(t, err)
+	assert.Equal(t, "NTP OK: offset 12ms\ndetails\n", message)
+	assert.Equal(t, 6, len(samples))
+	assert.Equal(t, scriptSample{name: "offset_seconds", valueType: prometheus.GaugeValue, value: 0.012}, samples[0])
+	assert.Equal(t, "zombie_count", samples[1].name)
+	assert.Equal(t, prometheus.CounterValue, samples[2].valueType)
+	assert.Equal(t, "reads_total", samples[2].name)
+	assert.Equal(t, 10240.0, samples[3].value)
+	assert.Equal(t, "running", samples[4].labels["state"])
+
+	_, samples, err = parseScriptOutput("OK | a=1 b=oops c=2")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, len(samples))
+
+	// A | which isn't followed by perfdata is kept in the message.
+	for _, line := range []string{"CRITICAL: grep foo | wc -l returned 0", "OK | see logs", "OK |", "x | mode=a b"} {
+		message, samples, err = parseScriptOutput(line)
+		assert.Nil(t, err)
+		assert.Equal(t, line, message)
+		assert.Equal(t, 0, len(samples))
+	}
+
+	defer func(c *scriptMetricsCollector) { scriptMetrics = c }(scriptMetrics)
+	scriptMetrics = newScriptMetricsCollector(5)
+	r := registerMetrics()
+
+	_, samples, _ = parseScriptOutput(stdout)
+	scriptMetrics.set("ntp", samples)
+	assert.Equal(t, 1.0, testutil.ToFloat64(scriptMetricsDroppedCounter.With(prometheus.Labels{"type": "ntp"})))
+
+	expected := `# HELP npd_detector_script_containers Metric emitted by a health check script
+# TYPE npd_detector_script_containers gauge
+npd_detector_script_containers{exported_type="docker",state="running",type="ntp"} 7
+# HELP npd_detector_script_offset_seconds Metric emitted by a health check script
+# TYPE npd_detector_script_offset_seconds gauge
+npd_detector_script_offset_seconds{type="ntp"} 0.012
+`
+	assert.Nil(t, testutil.GatherAndCompare(r, strings.NewReader(expected), "npd_detector_script_containers", "npd_detector_script_offset_seconds"))
+
+	// A check which stops emitting metrics has them removed.
+	scriptMetrics.set("ntp", nil)
+	assert.Nil(t, testutil.GatherAndCompare(r, strings.NewReader(""), "npd_detector_script_offset_seconds"))
+}
+
+// TestCgroupChecks test the cgroup memory, CPU throttling and pids checks on cgroup v1 and v2.
+func TestCgroupChecks(t *testing.T) {
+	registerMetrics()
+	defer func() {
+		for _, checkType := range []string{cgroupMemoryCheck, cgroupCPUCheck, cgroupPidsCheck} {
+			delete(m, checkType)
+		}
+	}()
+
+	write := func(path, data string) {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+
+	// cgroup v2, with an allocation cgroup under nomad.slice.
+	root := t.TempDir()
+	parent := filepath.Join(root, "nomad.slice")
+	alloc := filepath.Join(parent, "share.slice", "f8c2.web.scope")
+	write(filepath.Join(root, "cgroup.controllers"), "cpu memory pids\n")
+	write(filepath.Join(parent, "memory.current"), "536870912\n")
+	write(filepath.Join(parent, "memory.max"), "1073741824\n")
+	write(filepath.Join(parent, "memory.events"), "low 0\nhigh 0\nmax 4\noom 1\noom_kill 1\n")
+	write(filepath.Join(alloc, "memory.events"), "low 0\nhigh 0\nmax 4\noom 1\noom_kill 1\n")
+	write(filepath.Join(parent, "cpu.stat"), "usage_usec 100\nnr_periods 100\nnr_throttled 10\nthrottled_usec 5000\n")
+	write(filepath.Join(parent, "pids.current"), "95\n")
+	write(filepath.Join(parent, "pids.max"), "100\n")
+
+	c := newCgroupMonitor(root, "nomad.slice")
+	c.memoryLimit, c.throttleLimit, c.pidsLimit = 90, 25, 90
+	getCgroupStats(c)
+
+	assert.Equal(t, "false", m[cgroupMemoryCheck].Result)
+	assert.Equal(t, "cgroup nomad.slice: 536.9MB memory used out of 1.074GB limit (50.00 %)", m[cgroupMemoryCheck].Message)
+	assert.Equal(t, "false", m[cgroupCPUCheck].Result)
+	assert.Equal(t, "true", m[cgroupPidsCheck].Result)
+	assert.Equal(t, "cgroup nomad.slice: 95 pids out of 100 limit (95.00 %)", m[cgroupPidsCheck].Message)
+
+	// 30 of the last 50 CPU periods throttled. OOM kills of the allocations
+	// are left to the OOM kill check.
+	write(filepath.Join(parent, "memory.current"), "1020054732\n")
+	write(filepath.Join(parent, "memory.events"), "oom 3\noom_kill 3\n")
+	write(filepath.Join(alloc, "memory.events"), "oom 3\noom_kill 3\n")
+	write(filepath.Join(parent, "cpu.stat"), "nr_periods 150\nnr_throttled 40\n")
+	write(filepath.Join(parent, "pids.max"), "max\n")
+	getCgroupStats(c)
+
+	assert.Equal(t, "true", m[cgroupMemoryCheck].Result)
+	assert.Equal(t, "cgroup nomad.slice: 1.02GB memory used out of 1.074GB limit (95.00 %)", m[cgroupMemoryCheck].Message)
+	assert.Equal(t, "true", m[cgroupCPUCheck].Result)
+	assert.Contains(t, m[cgroupCPUCheck].Message, "60.00 % of CPU periods throttled")
+	assert.Equal(t, "false", m[cgroupPidsCheck].Result)
+	assert.Contains(t, m[cgroupPidsCheck].Message, "no pids limit")
+	assert.Equal(t, "nomad.slice", defaultCgroupParent(root))
+
+	// cgroup v1, with cpu and cpuacct mounted together and no pids controller.
+	for _, checkType := range []string{cgroupMemoryCheck, cgroupCPUCheck, cgroupPidsCheck} {
+		delete(m, checkType)
+	}
+	root = t.TempDir()
+	write(filepath.Join(root, "memory", "nomad", "memory.usage_in_bytes"), "1000\n")
+	write(filepath.Join(root, "memory", "nomad", "memory.limit_in_bytes"), "9223372036854771712\n")
+	write(filepath.Join(root, "memory", "nomad", "memory.oom_control"), "oom_kill_disable 0\nunder_oom 0\noom_kill 0\n")
+	write(filepath.Join(root, "cpu,cpuacct", "nomad", "cpu.stat"), "nr_periods 0\nnr_throttled 0\nthrottled_time 0\n")
+
+	assert.Equal(t, "nomad", defaultCgroupParent(root))
+	c = newCgroupMonitor(root, "nomad")
+	getCgroupStats(c)
+	assert.Equal(t, "false", m[cgroupMemoryCheck].Result)
+	assert.Contains(t, m[cgroupMemoryCheck].Message, "no memory limit")
+	assert.Equal(t, "false", m[cgroupCPUCheck].Result)
+	assert.Nil(t, m[cgroupPidsCheck])
+
+	// Without the parent cgroup, the checks are not reported.
+	delete(m, cgroupMemoryCheck)
+	getCgroupStats(newCgroupMonitor(root, "missing"))
+	assert.Nil(t, m[cgroupMemoryCheck])
+}
+
+// TestOOMMonitor test the OOM kill check: the OOM kills of both scopes,
+// the window, the limit, the quiet period and the killed processes.
+func TestOOMMonitor(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path, data string) {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	appendLog := func(path, data string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = f.WriteString(data)
+		assert.Nil(t, err)
+		f.Close()
+	}
+
+	kernelLog := filepath.Join(dir, "kmsg")
+	root := filepath.Join(dir, "cgroup")
+	parentEvents := filepath.Join(root, "nomad.slice", "memory.events.local")
+
+	write(kernelLog, "3,100,1000,-;Out of memory: Killed process 10 (old) total-vm:100kB\n")
+	write(filepath.Join(root, "cgroup.controllers"), "memory\n")
+	write(parentEvents, "low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n")
+
+	o := newOOMMonitor(2, 10*time.Minute, 15*time.Minute, oomScopeNode, kernelLog, newCgroupMonitor(root, "nomad.slice"))
+	start := time.Now()
+
+	// The first cycle is the baseline, the kernel log is skipped.
+	raised, msg, err := o.evaluate(start)
+	assert.Nil(t, err)
+	assert.False(t, raised)
+	assert.Equal(t, "0 OOM kills in the last 10m0s (limit: 2)", msg)
+
+	// A task reaching its own memory limit is not counted.
+	appendLog(kernelLog, "3,101,2000,-;Memory cgroup out of memory: Killed process 4242 (java) total-vm:100kB\n SUBSYSTEM=memory\n")
+	raised, msg, err = o.evaluate(start.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, raised)
+	assert.Equal(t, "0 OOM kills in the last 10m0s (limit: 2)", msg)
+
+	// 2 global OOM kills are within the limit.
+	appendLog(kernelLog, "3,102,3000,-;Out of memory: Killed process 5120 (python3) total-vm:100kB\n"+
+		"3,103,3100,-;Out of memory: Kill process 5121 (python3) score 900 or sacrifice child\n"+
+		"3,104,3200,-;Killed process 5121 (python3) total-vm:100kB\n")
+	raised, msg, err = o.evaluate(start.Add(2 * time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, raised)
+	assert.Equal(t, "2 OOM kills in the last 10m0s (limit: 2); killed: python3 (5120), python3 (5121)", msg)
+
+	// An OOM at the memory limit of the parent cgroup.
+	write(parentEvents, "low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n")
+	raised, msg, err = o.evaluate(start.Add(3 * time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, raised)
+	assert.Equal(t, "3 OOM kills in the last 10m0s (limit: 2); killed: python3 (5120), python3 (5121), 1 OOM at the memory limit of cgroup nomad.slice", msg)
+
+	// Out of the window, it stays raised until the quiet period.
+	raised, msg, err = o.evaluate(start.Add(14 * time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, raised)
+	assert.Equal(t, "0 OOM kills in the last 10m0s (limit: 2); last OOM kill 11m0s ago, clears after 15m0s without OOM kill", msg)
+
+	raised, _, err = o.evaluate(start.Add(18 * time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, raised)
+
+	// Without the kernel log, and with cgroup v1, there is no OOM kill source.
+	v1 := t.TempDir()
+	write(filepath.Join(v1, "memory", "nomad", "memory.oom_control"), "oom_kill_disable 0\nunder_oom 0\noom_kill 0\n")
+	o = newOOMMonitor(2, 10*time.Minute, 15*time.Minute, oomScopeNode, "", newCgroupMonitor(v1, "nomad"))
+	_, _, err = o.evaluate(start)
+	assert.NotNil(t, err)
+
+	// With the all scope, every OOM kill is counted, from the highest of
+	// the /proc/vmstat and cgroup counters.
+	defer func(path string) { procVMStat = path }(procVMStat)
+	procVMStat = filepath.Join(dir, "vmstat")
+	write(procVMStat, "nr_free_pages 1000\noom_kill 5\n")
+	write(filepath.Join(root, "nomad.slice", "memory.events"), "oom 0\noom_kill 0\n")
+	kernelLog = filepath.Join(dir, "kmsg-all")
+	write(kernelLog, "")
+
+	o = newOOMMonitor(2, 10*time.Minute, 15*time.Minute, oomScopeAll, kernelLog, newCgroupMonitor(root, "nomad.slice"))
+	raised, _, err = o.evaluate(start)
+	assert.Nil(t, err)
+	assert.False(t, raised)
+
+	write(procVMStat, "nr_free_pages 1000\noom_kill 7\n")
+	appendLog(kernelLog, "3,101,2000,-;Memory cgroup out of memory: Killed process 4242 (java) total-vm:100kB\n")
+	raised, msg, err = o.evaluate(start.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, raised)
+	assert.Equal(t, "2 OOM kills in the last 10m0s (limit: 2); killed: java (4242)", msg)
+
+	write(filepath.Join(root, "nomad.slice", "memory.events"), "oom 3\noom_kill 3\n")
+	raised, msg, err = o.evaluate(start.Add(2 * time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, raised)
+	assert.Contains(t, msg, "5 OOM kills in the last 10m0s")
+
+	// A kernel log read error keeps the kernel log open, so that the next
+	// read carries on rather than skipping the ring buffer again.
+	o = newOOMMonitor(2, 10*time.Minute, 15*time.Minute, oomScopeAll, dir, nil)
+	_, _, err = o.killedProcesses()
+	assert.NotNil(t, err)
+	assert.True(t, o.kmsg >= 0)
+	syscall.Close(o.kmsg)
+}
+
+// TestFilesystemChecks test the read-only mount detection and the
+// write/fsync/delete probe of the filesystem checks.
+func TestFilesystemChecks(t *testing.T) {
+	registerMetrics()
+	defer func() {
+		for _, checkType := range []string{fsReadOnlyCheck, fsProbeFailedCheck, fsSlowCheck} {
+			delete(m, checkType)
+		}
+	}()
+
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	broken := filepath.Join(dir, "broken dir")
+	assert.Nil(t, os.MkdirAll(data, 0755))
+	assert.Nil(t, os.MkdirAll(broken, 0755))
+	// The probe directory can't be created on broken.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(broken, ".nnpd-probe"), []byte{}, 0644))
+
+	defer func(path string) { procSelfMountinfo = path }(procSelfMountinfo)
+	procSelfMountinfo = filepath.Join(dir, "mountinfo")
+	mountinfo := func(dataOptions, dataSuperOptions string) {
+		lines := []string{
+			"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro",
+			fmt.Sprintf("40 22 8:16 / %s %s shared:20 - ext4 /dev/sdb %s", data, dataOptions, dataSuperOptions),
+			fmt.Sprintf("41 22 8:32 / %s rw,relatime - xfs /dev/sdc rw", strings.Replace(broken, " ", `\040`, -1)),
+		}
+		assert.Nil(t, ioutil.WriteFile(procSelfMountinfo, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+	}
+
+	// All mounts are read-write, the probes are fast enough.
+	mountinfo("rw,relatime", "rw")
+	f := newFSMonitor(data, ".nnpd-probe", time.Minute, 10*time.Second)
+	getFilesystemStats(f)
+	assert.Equal(t, "false", m[fsReadOnlyCheck].Result)
+	assert.Equal(t, "false", m[fsProbeFailedCheck].Result)
+	assert.Equal(t, "false", m[fsSlowCheck].Result)
+	assert.Contains(t, m[fsSlowCheck].Message, "write/fsync/delete probe latency: "+data+": ")
+	files, err := ioutil.ReadDir(filepath.Join(data, ".nnpd-probe"))
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	// The probe takes longer than the latency limit.
+	f.latencyLimit = time.Nanosecond
+	getFilesystemStats(f)
+	assert.Equal(t, "true", m[fsSlowCheck].Result)
+	assert.Contains(t, m[fsSlowCheck].Message, "write/fsync/delete probe slower than 1ns on "+data+": ")
+
+	// A directory which is not a mountpoint is checked on the mount containing it.
+	plain := filepath.Join(dir, "plain")
+	assert.Nil(t, os.MkdirAll(plain, 0755))
+	getFilesystemStats(newFSMonitor(plain, ".nnpd-probe", time.Minute, 10*time.Second))
+	assert.Equal(t, "false", m[fsReadOnlyCheck].Result)
+	assert.Equal(t, "false", m[fsProbeFailedCheck].Result)
+
+	// The data filesystem is remounted read-only after I/O errors, the
+	// probe fails on broken, and /missing doesn't exist.
+	mountinfo("rw,relatime", "ro,errors=remount-ro")
+	nested := filepath.Join(data, "alloc")
+	assert.Nil(t, os.MkdirAll(nested, 0755))
+	f = newFSMonitor(data+", "+nested+", "+broken+",/missing", ".nnpd-probe", time.Minute, 10*time.Second)
+	errors := testutil.ToFloat64(healthCheckErrorCounter.With(prometheus.Labels{"check": fsReadOnlyCheck}))
+	getFilesystemStats(f)
+	assert.Equal(t, "true", m[fsReadOnlyCheck].Result)
+	assert.Equal(t, "read-only filesystems: "+data+" (remounted ro by the kernel), "+nested+" on "+data+" (remounted ro by the kernel)", m[fsReadOnlyCheck].Message)
+	assert.Equal(t, errors+1, testutil.ToFloat64(healthCheckErrorCounter.With(prometheus.Labels{"check": fsReadOnlyCheck})))
+	assert.Equal(t, "true", m[fsProbeFailedCheck].Result)
+	assert.Contains(t, m[fsProbeFailedCheck].Message, "write/fsync/delete probe failed on "+broken+": ")
+	assert.Equal(t, "false", m[fsSlowCheck].Result)
+
+	mountinfo("ro,relatime", "ro")
+	getFilesystemStats(newFSMonitor(data, ".nnpd-probe", time.Minute, 10*time.Second))
+	assert.Equal(t, "read-only filesystems: "+data+" (mounted ro)", m[fsReadOnlyCheck].Message)
+
+	// A probe which doesn't complete within the timeout isn't started again.
+	f = newFSMonitor(data, ".nnpd-probe", time.Minute, time.Second)
+	blocked := make(chan fsProbeResult)
+	f.pending[data] = &fsProbe{started: time.Now(), done: blocked}
+	mountinfo("rw,relatime", "rw")
+	getFilesystemStats(f)
+	assert.Equal(t, "true", m[fsProbeFailedCheck].Result)
+	assert.Contains(t, m[fsProbeFailedCheck].Message, "probe hung for")
+}
+
+// TestKernelTableChecks test the file descriptors, PIDs and conntrack table checks.
+func TestKernelTableChecks(t *testing.T) {
+	registerMetrics()
+	defer func() {
+		for _, checkType := range []string{fileDescriptorsCheck, kernelPidsCheck, conntrackCheck} {
+			delete(m, checkType)
+		}
+	}()
+
+	dir := t.TempDir()
+	write := func(path, data string) {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+
+	defer func(sys, loadavg string) { procSys, procLoadavg = sys, loadavg }(procSys, procLoadavg)
+	procSys = filepath.Join(dir, "sys")
+	procLoadavg = filepath.Join(dir, "loadavg")
+
+	write(filepath.Join(procSys, "fs", "file-nr"), "9500\t0\t10000\n")
+	write(procLoadavg, "0.20 0.18 0.12 1/400 11206\n")
+	write(filepath.Join(procSys, "kernel", "pid_max"), "32768\n")
+	write(filepath.Join(procSys, "kernel", "threads-max"), "1000\n")
+
+	// nf_conntrack is not loaded.
+	limits := kernelTableLimits{fileDescriptors: 90, pids: 90, conntrack: 90}
+	getKernelTableStats(limits)
+	assert.Equal(t, "true", m[fileDescriptorsCheck].Result)
+	assert.Equal(t, "file descriptors (fs.file-nr): 9500 used out of 10000 (95.00 %)", m[fileDescriptorsCheck].Message)
+	assert.Equal(t, "false", m[kernelPidsCheck].Result)
+	assert.Equal(t, "PIDs (kernel.threads-max): 400 used out of 1000 (40.00 %)", m[kernelPidsCheck].Message)
+	assert.Nil(t, m[conntrackCheck])
+
+	write(filepath.Join(procSys, "net", "netfilter", "nf_conntrack_count"), "262144\n")
+	write(filepath.Join(procSys, "net", "netfilter", "nf_conntrack_max"), "262144\n")
+	write(filepath.Join(procSys, "kernel", "threads-max"), "64000\n")
+	write(procLoadavg, "0.20 0.18 0.12 1/31000 11206\n")
+	getKernelTableStats(limits)
+	assert.Equal(t, "true", m[conntrackCheck].Result)
+	assert.Equal(t, "conntrack table (nf_conntrack_count): 262144 used out of 262144 (100.00 %)", m[conntrackCheck].Message)
+	assert.Equal(t, "true", m[kernelPidsCheck].Result)
+	assert.Equal(t, "PIDs (kernel.pid_max): 31000 used out of 32768 (94.60 %)", m[kernelPidsCheck].Message)
+
+	// Invalid content is counted as an error of the check, not a failure.
+	errors := testutil.ToFloat64(healthCheckErrorCounter.With(prometheus.Labels{"check": fileDescriptorsCheck}))
+	write(filepath.Join(procSys, "fs", "file-nr"), "9500\n")
+	getKernelTableStats(limits)
+	assert.Equal(t, "false", m[fileDescriptorsCheck].Result)
+	assert.Contains(t, m[fileDescriptorsCheck].Message, "expected 3 values, got 1")
+	assert.Equal(t, errors+1, testutil.ToFloat64(healthCheckErrorCounter.With(prometheus.Labels{"check": fileDescriptorsCheck})))
+
+	// So is an unreadable table.
+	errors = testutil.ToFloat64(healthCheckErrorCounter.With(prometheus.Labels{"check": conntrackCheck}))
+	assert.Nil(t, os.Remove(filepath.Join(procSys, "net", "netfilter", "nf_conntrack_max")))
+	assert.Nil(t, os.Mkdir(filepath.Join(procSys, "net", "netfilter", "nf_conntrack_max"), 0755))
+	getKernelTableStats(limits)
+	assert.Equal(t, "false", m[conntrackCheck].Result)
+	assert.Equal(t, errors+1, testutil.ToFloat64(healthCheckErrorCounter.With(prometheus.Labels{"check": conntrackCheck})))
+}
+
+func TestParseKernelTableLimits(t *testing.T) {
+	limits, err := parseKernelTableLimits("90", "100", "0.5")
+	assert.Nil(t, err)
+	assert.Equal(t, kernelTableLimits{fileDescriptors: 90, pids: 100, conntrack: 0.5}, limits)
+
+	for _, tc := range []struct {
+		fileNr, pids, conntrack string
+		err                     string
+	}{
+		{"0", "90", "90", "invalid --file-nr-limit 0"},
+		{"90", "101", "90", "invalid --kernel-pids-limit 101"},
+		{"90", "90", "-1", "invalid --conntrack-limit -1"},
+		{"90", "90", "ninety", "invalid --conntrack-limit ninety"},
+	} {
+		_, err := parseKernelTableLimits(tc.fileNr, tc.pids, tc.conntrack)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), tc.err)
+	}
+}
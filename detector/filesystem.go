@@ -0,0 +1,306 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package detector
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Health check types of the filesystem checks.
+const (
+	fsReadOnlyCheck    = "FilesystemReadOnly"
+	fsProbeFailedCheck = "FilesystemProbeFailed"
+	fsSlowCheck        = "FilesystemSlow"
+)
+
+var procSelfMountinfo = "/proc/self/mountinfo"
+
+// fsProbeSize is the size of the file written by the probe.
+const fsProbeSize = 4096
+
+// mountInfo are the read-only flags of a mount, from /proc/self/mountinfo.
+// A filesystem remounted read-only by the kernel after I/O errors (e.g.
+// errors=remount-ro) has ro super options, but keeps rw mount options.
+type mountInfo struct {
+	mountReadOnly bool
+	superReadOnly bool
+}
+
+// readMountinfo reads the mounts of /proc/self/mountinfo, by mountpoint.
+// When mounts are stacked on a mountpoint, the last one is visible.
+func readMountinfo() (map[string]mountInfo, error) {
+	f, err := os.Open(procSelfMountinfo)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := make(map[string]mountInfo)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 0 || separator+3 >= len(fields) {
+			continue
+		}
+
+		mounts[unescapeMountinfo(fields[4])] = mountInfo{
+			mountReadOnly: hasOption(fields[5], "ro"),
+			superReadOnly: hasOption(fields[separator+3], "ro"),
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountinfo decodes the octal escapes of mountinfo paths, e.g. \040 for a space.
+func unescapeMountinfo(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// mountOf returns the mount which contains path: the mount with the
+// longest mountpoint prefix of path, e.g. / for a directory of the root
+// filesystem.
+func mountOf(mounts map[string]mountInfo, path string) (string, mountInfo, bool) {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if mount, ok := mounts[dir]; ok {
+			return dir, mount, true
+		}
+		if dir == filepath.Dir(dir) {
+			return "", mountInfo{}, false
+		}
+	}
+}
+
+func hasOption(options, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// fsProbeResult is the outcome of a write/fsync/delete probe.
+type fsProbeResult struct {
+	latency time.Duration
+	err     error
+}
+
+// fsProbe is a probe which didn't complete within the probe timeout.
+type fsProbe struct {
+	started time.Time
+	done    chan fsProbeResult
+}
+
+// fsMonitor checks that the monitored mountpoints are mounted read-write,
+// and probes them with a write, fsync and delete of a file in a scratch
+// directory, against a latency threshold. A probe stuck on a hung
+// filesystem is not started again until it completes.
+type fsMonitor struct {
+	mountpoints  []string
+	probeDir     string
+	latencyLimit time.Duration
+	timeout      time.Duration
+
+	pending map[string]*fsProbe
+}
+
+// newFSMonitor takes a comma separated list of mountpoints.
+func newFSMonitor(mountpoints, probeDir string, latencyLimit, timeout time.Duration) *fsMonitor {
+	f := &fsMonitor{
+		probeDir:     probeDir,
+		latencyLimit: latencyLimit,
+		timeout:      timeout,
+		pending:      make(map[string]*fsProbe),
+	}
+	for _, mountpoint := range strings.Split(mountpoints, ",") {
+		if mountpoint = strings.TrimSpace(mountpoint); mountpoint != "" {
+			f.mountpoints = append(f.mountpoints, filepath.Clean(mountpoint))
+		}
+	}
+	return f
+}
+
+// runFSProbe writes a file in dir, fsyncs it and deletes it.
+func runFSProbe(dir string) fsProbeResult {
+	start := time.Now()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fsProbeResult{err: err}
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("probe-%d", os.Getpid()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fsProbeResult{err: err}
+	}
+	if _, err := f.Write(make([]byte, fsProbeSize)); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fsProbeResult{err: err}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fsProbeResult{err: err}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return fsProbeResult{err: err}
+	}
+	if err := os.Remove(path); err != nil {
+		return fsProbeResult{err: err}
+	}
+	return fsProbeResult{latency: time.Since(start)}
+}
+
+// probe probes a mountpoint, and waits for the probe up to the timeout.
+func (f *fsMonitor) probe(mountpoint string) fsProbeResult {
+	if p, ok := f.pending[mountpoint]; ok {
+		select {
+		case <-p.done:
+			delete(f.pending, mountpoint)
+		default:
+			return fsProbeResult{err: fmt.Errorf("probe hung for %s", time.Since(p.started).Round(time.Second))}
+		}
+	}
+
+	p := &fsProbe{started: time.Now(), done: make(chan fsProbeResult, 1)}
+	dir := filepath.Join(mountpoint, f.probeDir)
+	go func() {
+		p.done <- runFSProbe(dir)
+	}()
+
+	select {
+	case result := <-p.done:
+		return result
+	case <-time.After(f.timeout):
+		f.pending[mountpoint] = p
+		return fsProbeResult{err: fmt.Errorf("probe timed out after %s", f.timeout)}
+	}
+}
+
+// getFilesystemStats runs the filesystem checks on the monitored mountpoints.
+func getFilesystemStats(f *fsMonitor) {
+	if f == nil || len(f.mountpoints) == 0 {
+		return
+	}
+
+	mounts, err := readMountinfo()
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in reading %s: %v", procSelfMountinfo, err))
+		healthCheckErrorCounter.With(prometheus.Labels{"check": fsReadOnlyCheck}).Inc()
+		return
+	}
+
+	var readOnly, failed, slow, latencies []string
+	for _, mountpoint := range f.mountpoints {
+		// A missing mountpoint is a configuration error of the detector, not
+		// a condition of the node.
+		if _, err := os.Stat(mountpoint); err != nil {
+			log.Warning(fmt.Sprintf("Error in checking filesystem %s: %v", mountpoint, err))
+			healthCheckErrorCounter.With(prometheus.Labels{"check": fsReadOnlyCheck}).Inc()
+			continue
+		}
+
+		// A directory which is not a mountpoint is checked on the mount
+		// containing it, e.g. a Nomad data dir on the root filesystem.
+		path, mount, ok := mountOf(mounts, mountpoint)
+		if !ok {
+			log.Warning(fmt.Sprintf("Error in checking filesystem %s: no mount in %s", mountpoint, procSelfMountinfo))
+			healthCheckErrorCounter.With(prometheus.Labels{"check": fsReadOnlyCheck}).Inc()
+			continue
+		}
+		where := mountpoint
+		if path != mountpoint {
+			where = fmt.Sprintf("%s on %s", mountpoint, path)
+		}
+
+		switch {
+		case mount.superReadOnly && !mount.mountReadOnly:
+			readOnly = append(readOnly, fmt.Sprintf("%s (remounted ro by the kernel)", where))
+			continue
+		case mount.mountReadOnly || mount.superReadOnly:
+			readOnly = append(readOnly, fmt.Sprintf("%s (mounted ro)", where))
+			continue
+		}
+
+		result := f.probe(mountpoint)
+		if result.err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", mountpoint, result.err))
+			continue
+		}
+		latency := fmt.Sprintf("%s: %s", mountpoint, result.latency.Round(time.Microsecond))
+		latencies = append(latencies, latency)
+		if f.latencyLimit > 0 && result.latency >= f.latencyLimit {
+			slow = append(slow, latency)
+		}
+	}
+
+	monitored := strings.Join(f.mountpoints, ", ")
+	reportFilesystemCheck(fsReadOnlyCheck, readOnly, "read-only filesystems: ",
+		fmt.Sprintf("read-write filesystems: %s", monitored))
+	reportFilesystemCheck(fsProbeFailedCheck, failed, "write/fsync/delete probe failed on ",
+		fmt.Sprintf("write/fsync/delete probe succeeded on the read-write filesystems of %s", monitored))
+	reportFilesystemCheck(fsSlowCheck, slow, fmt.Sprintf("write/fsync/delete probe slower than %s on ", f.latencyLimit),
+		fmt.Sprintf("write/fsync/delete probe latency: %s", strings.Join(latencies, ", ")))
+}
+
+// reportFilesystemCheck reports a filesystem check, with the mountpoints
+// which have the problem.
+func reportFilesystemCheck(checkType string, problems []string, problemMsg, okMsg string) {
+	hc := &types.HealthCheck{Type: checkType}
+	if len(problems) > 0 {
+		hc.Update("true", problemMsg+strings.Join(problems, ", "))
+	} else {
+		hc.Update("false", okMsg)
+	}
+
+	setHealthCheck(hc)
+}
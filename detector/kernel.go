@@ -0,0 +1,196 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package detector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+// Health check types of the kernel table checks.
+const (
+	fileDescriptorsCheck = "FileDescriptorsExhausted"
+	kernelPidsCheck      = "PIDsExhausted"
+	conntrackCheck       = "ConntrackTableFull"
+)
+
+var procSys = "/proc/sys"
+
+// kernelTableLimits are the thresholds of the kernel table checks, in
+// percentage of the size of the tables.
+type kernelTableLimits struct {
+	fileDescriptors float64
+	pids            float64
+	conntrack       float64
+}
+
+// parseKernelTableLimits parses the thresholds of the kernel table checks,
+// which must be in (0, 100]: a threshold of 0 would always fail.
+func parseKernelTableLimits(fileNr, pids, conntrack string) (kernelTableLimits, error) {
+	var limits kernelTableLimits
+	for _, l := range []struct {
+		flag  string
+		value string
+		limit *float64
+	}{
+		{"file-nr-limit", fileNr, &limits.fileDescriptors},
+		{"kernel-pids-limit", pids, &limits.pids},
+		{"conntrack-limit", conntrack, &limits.conntrack},
+	} {
+		v, err := strconv.ParseFloat(l.value, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid --%s %s: %v", l.flag, l.value, err)
+		}
+		if v <= 0 || v > 100 {
+			return limits, fmt.Errorf("invalid --%s %s. It must be more than 0 and at most 100", l.flag, l.value)
+		}
+		*l.limit = v
+	}
+	return limits, nil
+}
+
+// readProcValues reads the unsigned integers of a /proc file.
+func readProcValues(path string) ([]uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []uint64
+	for _, field := range strings.Fields(string(data)) {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return values, nil
+}
+
+// usageCheck reports a kernel table check, comparing its usage to its size.
+func usageCheck(checkType string, used, size uint64, limit float64, msg string) {
+	hc := &types.HealthCheck{Type: checkType}
+	if size == 0 {
+		reportCheck(hc, fmt.Errorf("%s: table size is 0", msg))
+		return
+	}
+
+	usage := float64(used) / float64(size) * 100
+	result := "false"
+	if usage >= limit {
+		result = "true"
+	}
+	hc.Update(result, fmt.Sprintf("%s: %d used out of %d (%.2f %%)", msg, used, size, usage))
+	reportCheck(hc, nil)
+}
+
+// getKernelTableStats runs the kernel table checks. The conntrack check is
+// not reported when the nf_conntrack module is not loaded. A table which
+// can't be read or parsed is counted in the check errors, see reportCheck.
+func getKernelTableStats(limits kernelTableLimits) {
+	fileDescriptorsStats(limits.fileDescriptors)
+	pidsStats(limits.pids)
+	conntrackStats(limits.conntrack)
+}
+
+// fileDescriptorsStats compares the allocated file handles to fs.file-max.
+// fs.file-nr has the allocated, the allocated but unused (always 0 since
+// Linux 2.6) and the maximum file handles.
+func fileDescriptorsStats(limit float64) {
+	path := filepath.Join(procSys, "fs", "file-nr")
+	values, err := readProcValues(path)
+	if err == nil && len(values) != 3 {
+		err = fmt.Errorf("%s: expected 3 values, got %d", path, len(values))
+	}
+	if err != nil {
+		reportCheck(&types.HealthCheck{Type: fileDescriptorsCheck}, err)
+		return
+	}
+
+	allocated, unused, fileMax := values[0], values[1], values[2]
+	used := allocated
+	if unused < allocated {
+		used = allocated - unused
+	}
+	usageCheck(fileDescriptorsCheck, used, fileMax, limit, "file descriptors (fs.file-nr)")
+}
+
+// pidsStats compares the number of threads, from /proc/loadavg, to the
+// lowest of kernel.pid_max and kernel.threads-max: every thread takes a PID.
+func pidsStats(limit float64) {
+	hc := &types.HealthCheck{Type: kernelPidsCheck}
+	data, err := ioutil.ReadFile(procLoadavg)
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+
+	// 0.20 0.18 0.12 1/80 11206: the 4th field is runnable/total threads.
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 || !strings.Contains(fields[3], "/") {
+		reportCheck(hc, fmt.Errorf("%s: invalid content: %s", procLoadavg, strings.TrimSpace(string(data))))
+		return
+	}
+	threads, err := strconv.ParseUint(strings.SplitN(fields[3], "/", 2)[1], 10, 64)
+	if err != nil {
+		reportCheck(hc, fmt.Errorf("%s: %v", procLoadavg, err))
+		return
+	}
+
+	pidMax, err := readProcValues(filepath.Join(procSys, "kernel", "pid_max"))
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+	threadsMax, err := readProcValues(filepath.Join(procSys, "kernel", "threads-max"))
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+
+	size, table := pidMax[0], "kernel.pid_max"
+	if threadsMax[0] < size {
+		size, table = threadsMax[0], "kernel.threads-max"
+	}
+	usageCheck(kernelPidsCheck, threads, size, limit, fmt.Sprintf("PIDs (%s)", table))
+}
+
+// conntrackStats compares the connections tracked by netfilter to the size
+// of the conntrack table. Packets of new connections are dropped once it is full.
+func conntrackStats(limit float64) {
+	hc := &types.HealthCheck{Type: conntrackCheck}
+	count, err := readProcValues(filepath.Join(procSys, "net", "netfilter", "nf_conntrack_count"))
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+	conntrackMax, err := readProcValues(filepath.Join(procSys, "net", "netfilter", "nf_conntrack_max"))
+	if err != nil {
+		reportCheck(hc, err)
+		return
+	}
+	usageCheck(conntrackCheck, count[0], conntrackMax[0], limit, "conntrack table (nf_conntrack_count)")
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package detector
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// oomKillCheck is the health check type of the OOM kill check.
+const oomKillCheck = "OOMKilling"
+
+// OOM kill scopes (--oom-kill-scope): every OOM kill of the node, or only
+// the ones which are a problem of the node rather than of a task.
+const (
+	oomScopeAll  = "all"
+	oomScopeNode = "node"
+)
+
+var procVMStat = "/proc/vmstat"
+
+// killedProcess matches the kernel log line of an OOM kill, from the
+// global or a memory cgroup OOM killer, e.g.
+// Out of memory: Killed process 4242 (java) total-vm:...
+// Memory cgroup out of memory: Killed process 4242 (java) total-vm:...
+// Kernels before 5.0 log "Kill process" instead.
+var killedProcess = regexp.MustCompile(`(Memory cgroup out of memory|Out of memory)[^:]*: Kill(?:ed)? process (\d+) \(([^)]*)\)`)
+
+// oomEvent is a number of OOM kills seen in a detector cycle.
+type oomEvent struct {
+	time  time.Time
+	kills uint64
+	names []string
+}
+
+// oomMonitor counts the OOM kills of the node. It reports a problem when
+// more than limit OOM kills happen within window, until no OOM kill
+// happens for the quiet period.
+//
+// With the all scope, every OOM kill is counted, from the oom_kill counter
+// of /proc/vmstat and of the memory.events of the Nomad cgroup tree. With
+// the node scope, only the kills of the global OOM killer, from the kernel
+// log, and the OOMs at the memory limit of the parent cgroup of the Nomad
+// allocations are counted: a task reaching its own memory limit is not.
+type oomMonitor struct {
+	limit     uint64
+	window    time.Duration
+	quiet     time.Duration
+	scope     string
+	kernelLog string
+	cgroup    *cgroupMonitor
+
+	vmstat    *uint64
+	cgroupOOM *uint64
+	parentOOM *uint64
+	kmsg      int
+	partial   string
+	events    []oomEvent
+	lastKill  time.Time
+	raised    bool
+}
+
+func newOOMMonitor(limit uint64, window, quiet time.Duration, scope, kernelLog string, cgroup *cgroupMonitor) *oomMonitor {
+	return &oomMonitor{
+		limit:     limit,
+		window:    window,
+		quiet:     quiet,
+		scope:     scope,
+		kernelLog: kernelLog,
+		cgroup:    cgroup,
+		kmsg:      -1,
+	}
+}
+
+// readVMStatOOMKills reads the oom_kill counter of /proc/vmstat, which
+// counts the OOM kills of both the global and the memory cgroup OOM killer.
+func readVMStatOOMKills() (uint64, error) {
+	values, err := readCgroupKeyValues(procVMStat)
+	if err != nil {
+		return 0, err
+	}
+	kills, ok := values["oom_kill"]
+	if !ok {
+		return 0, fmt.Errorf("%s: missing oom_kill counter", procVMStat)
+	}
+	return kills, nil
+}
+
+// counterDelta returns the increase of a counter since its previous value,
+// and records it. A counter going backwards (e.g. a recreated cgroup) is
+// taken as a new baseline.
+func counterDelta(previous **uint64, value uint64) uint64 {
+	last := *previous
+	*previous = &value
+	if last == nil || value < *last {
+		return 0
+	}
+	return value - *last
+}
+
+// killedProcesses returns the processes killed by the global and by the
+// memory cgroup OOM killers since the previous cycle, from the kernel log.
+// With /dev/kmsg, the first read returns the whole ring buffer, which is
+// skipped. The kernel log is kept open after a read error, so that the
+// next cycle carries on from where it stopped.
+func (o *oomMonitor) killedProcesses() (global, memcg []string, err error) {
+	first := false
+	if o.kmsg < 0 {
+		// The file is read with raw syscalls: an os.File of /dev/kmsg would
+		// block in the runtime poller rather than return EAGAIN.
+		fd, err := syscall.Open(o.kernelLog, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", o.kernelLog, err)
+		}
+		o.kmsg = fd
+		first = true
+	}
+
+	// /dev/kmsg returns a record per read, and EAGAIN once there are no
+	// new records. A regular file returns partial lines, and then EOF.
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(o.kmsg, buf)
+		if err == syscall.EAGAIN || (err == nil && n == 0) {
+			break
+		}
+		if err == syscall.EPIPE {
+			// Records were overwritten before being read.
+			continue
+		}
+		if err != nil {
+			return global, memcg, fmt.Errorf("%s: %v", o.kernelLog, err)
+		}
+
+		lines := strings.Split(o.partial+string(buf[:n]), "\n")
+		o.partial = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			match := killedProcess.FindStringSubmatch(line)
+			if match == nil || first {
+				continue
+			}
+			name := fmt.Sprintf("%s (%s)", match[3], match[2])
+			if match[1] == "Out of memory" {
+				global = append(global, name)
+			} else {
+				memcg = append(memcg, name)
+			}
+		}
+	}
+	return global, memcg, nil
+}
+
+// newOOMKills returns the number of OOM kills of the scope since the
+// previous cycle, and the processes killed.
+func (o *oomMonitor) newOOMKills() (uint64, []string, error) {
+	var global, memcg []string
+	var logErr error
+	if o.kernelLog != "" {
+		global, memcg, logErr = o.killedProcesses()
+		if logErr != nil {
+			log.Warning(fmt.Sprintf("Error in reading OOM kills from %s: %v", o.kernelLog, logErr))
+		}
+	}
+	hasCgroup := o.cgroup != nil && o.cgroup.parent != ""
+
+	if o.scope == oomScopeNode {
+		kills, names := uint64(len(global)), global
+		found := o.kernelLog != "" && logErr == nil
+
+		if hasCgroup {
+			ooms, err := o.cgroup.parentOOMs()
+			if err == nil {
+				if delta := counterDelta(&o.parentOOM, ooms); delta > 0 {
+					kills += delta
+					names = append(names, fmt.Sprintf("%d OOM at the memory limit of cgroup %s", delta, o.cgroup.parent))
+				}
+				found = true
+			} else {
+				log.Debug(fmt.Sprintf("Error in reading OOMs of cgroup %s: %v", o.cgroup.parent, err))
+			}
+		}
+
+		if !found {
+			return 0, nil, fmt.Errorf("neither the kernel log nor the local OOM counter of the parent cgroup could be read, use --oom-kill-scope %s", oomScopeAll)
+		}
+		return kills, names, nil
+	}
+
+	// Both counters are read, /proc/vmstat counts every OOM kill of the
+	// node but its oom_kill counter is missing before Linux 4.13.
+	var kills uint64
+	found := false
+	vmstat, err := readVMStatOOMKills()
+	if err == nil {
+		kills = counterDelta(&o.vmstat, vmstat)
+		found = true
+	} else {
+		log.Debug(fmt.Sprintf("Error in reading OOM kills of %s: %v", procVMStat, err))
+	}
+
+	if hasCgroup {
+		cgroupOOM, err := o.cgroup.totalOOMKills()
+		if err == nil {
+			if delta := counterDelta(&o.cgroupOOM, cgroupOOM); delta > kills {
+				kills = delta
+			}
+			found = true
+		} else {
+			log.Debug(fmt.Sprintf("Error in reading OOM kills of cgroup %s: %v", o.cgroup.parent, err))
+		}
+	}
+
+	if !found {
+		return 0, nil, fmt.Errorf("no OOM kill counter in %s or in the memory cgroup", procVMStat)
+	}
+	return kills, append(global, memcg...), nil
+}
+
+// evaluate returns whether the node is OOM killing, and a message with the
+// OOM kills of the window and the processes killed.
+func (o *oomMonitor) evaluate(now time.Time) (bool, string, error) {
+	kills, names, err := o.newOOMKills()
+	if err != nil {
+		return false, "", err
+	}
+
+	if kills > 0 {
+		o.events = append(o.events, oomEvent{time: now, kills: kills, names: names})
+		o.lastKill = now
+	} else if len(names) > 0 && len(o.events) > 0 {
+		// The kernel log may only have the kill after the counters.
+		last := &o.events[len(o.events)-1]
+		last.names = append(last.names, names...)
+	}
+
+	// Keep the OOM kills of the window.
+	i := 0
+	for i < len(o.events) && now.Sub(o.events[i].time) > o.window {
+		i++
+	}
+	o.events = o.events[i:]
+
+	var total uint64
+	var killed []string
+	for _, e := range o.events {
+		total += e.kills
+		killed = append(killed, e.names...)
+	}
+
+	if total > o.limit {
+		o.raised = true
+	} else if o.raised && now.Sub(o.lastKill) >= o.quiet {
+		o.raised = false
+	}
+
+	msg := fmt.Sprintf("%d OOM kills in the last %s (limit: %d)", total, o.window, o.limit)
+	if len(killed) > 0 {
+		msg = fmt.Sprintf("%s; killed: %s", msg, strings.Join(killed, ", "))
+	}
+	if o.raised && total <= o.limit {
+		msg = fmt.Sprintf("%s; last OOM kill %s ago, clears after %s without OOM kill", msg, now.Sub(o.lastKill).Round(time.Second), o.quiet)
+	}
+	return o.raised, msg, nil
+}
+
+// getOOMStats runs the OOM kill check.
+func getOOMStats(o *oomMonitor) {
+	if o == nil {
+		return
+	}
+
+	hc := &types.HealthCheck{Type: oomKillCheck}
+	raised, msg, err := o.evaluate(time.Now())
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in checking OOM kills: %v", err))
+		healthCheckErrorCounter.With(prometheus.Labels{"check": hc.Type}).Inc()
+		return
+	}
+	hc.Update(strconv.FormatBool(raised), msg)
+
+	setHealthCheck(hc)
+}
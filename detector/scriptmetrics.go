@@ -0,0 +1,362 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package detector
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Health check scripts emit metrics in their stdout, either as Nagios
+// perfdata after a | on the first line, or as prometheus/OpenMetrics text
+// between these marker lines.
+const (
+	scriptMetricsBegin = "# BEGIN NPD METRICS"
+	scriptMetricsEnd   = "# END NPD METRICS"
+
+	// scriptMetricsPrefix is prepended to the names of the script metrics,
+	// so that they can't collide with the detector metrics.
+	scriptMetricsPrefix = "npd_detector_script_"
+)
+
+// scriptSample is a sample of a metric emitted by a health check script.
+type scriptSample struct {
+	name      string
+	valueType prometheus.ValueType
+	labels    map[string]string
+	value     float64
+}
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// metricName turns a perfdata label into a valid metric name.
+func metricName(label string) string {
+	name := invalidMetricChars.ReplaceAllString(strings.TrimSpace(label), "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// parseScriptOutput splits the stdout of a health check script into its
+// message and its metrics. The metrics are removed from the message.
+func parseScriptOutput(stdout string) (string, []scriptSample, error) {
+	var message, metrics []string
+	inMetrics := false
+	for _, line := range strings.Split(stdout, "\n") {
+		switch {
+		case strings.TrimSpace(line) == scriptMetricsBegin:
+			inMetrics = true
+		case strings.TrimSpace(line) == scriptMetricsEnd:
+			inMetrics = false
+		case inMetrics:
+			metrics = append(metrics, line)
+		default:
+			message = append(message, line)
+		}
+	}
+
+	var samples []scriptSample
+	var errs []string
+
+	// Nagios perfdata: TEXT | label=value[UOM];[warn];[crit];[min];[max] ...
+	// A | followed by anything else is part of the message.
+	if len(message) > 0 {
+		if i := strings.Index(message[0], "|"); i >= 0 && perfdataPairs.MatchString(strings.TrimSpace(message[0][i+1:])) {
+			perfdata, err := parsePerfdata(message[0][i+1:])
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			samples = append(samples, perfdata...)
+			message[0] = strings.TrimSpace(message[0][:i])
+		}
+	}
+
+	if len(metrics) > 0 {
+		text, err := parseMetricsText(strings.Join(metrics, "\n") + "\n")
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		samples = append(samples, text...)
+	}
+
+	var err error
+	if len(errs) > 0 {
+		err = fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return strings.Join(message, "\n"), samples, err
+}
+
+// perfdataUnits maps the Nagios perfdata units of measurement to a metric
+// name suffix, and a factor to the base unit.
+var perfdataUnits = map[string]struct {
+	suffix string
+	factor float64
+}{
+	"":   {"", 1},
+	"s":  {"_seconds", 1},
+	"ms": {"_seconds", 1e-3},
+	"us": {"_seconds", 1e-6},
+	"%":  {"_percent", 1},
+	"B":  {"_bytes", 1},
+	"KB": {"_bytes", 1 << 10},
+	"MB": {"_bytes", 1 << 20},
+	"GB": {"_bytes", 1 << 30},
+	"TB": {"_bytes", 1 << 40},
+	"c":  {"_total", 1},
+}
+
+// perfdataPairs matches space separated label=value pairs, with labels
+// optionally quoted with single quotes.
+var perfdataPairs = regexp.MustCompile(`^(?:(?:'[^']+'|[^'=\s]+)=\S+\s*)+$`)
+
+var perfdataValue = regexp.MustCompile(`^(-?[0-9.]+(?:[eE][-+]?[0-9]+)?)([a-zA-Z%]*)$`)
+
+// parsePerfdata parses Nagios perfdata. Labels can be quoted with single
+// quotes when they contain spaces. Values are converted to the base unit,
+// and counters (c) are exported as counters. Unknown values (U) are skipped.
+func parsePerfdata(perfdata string) ([]scriptSample, error) {
+	var samples []scriptSample
+	var errs []string
+	rest := strings.TrimSpace(perfdata)
+	for rest != "" {
+		var label string
+		if rest[0] == '\'' {
+			end := strings.Index(rest[1:], "'")
+			if end < 0 {
+				return samples, fmt.Errorf("perfdata: unterminated label quote")
+			}
+			label = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			end := strings.Index(rest, "=")
+			if end < 0 {
+				return samples, fmt.Errorf("perfdata: missing = in %q", rest)
+			}
+			label = rest[:end]
+			rest = rest[end:]
+		}
+		if !strings.HasPrefix(rest, "=") {
+			return samples, fmt.Errorf("perfdata: missing = after label %q", label)
+		}
+
+		var data string
+		if end := strings.IndexAny(rest, " \t"); end >= 0 {
+			data, rest = rest[1:end], strings.TrimSpace(rest[end:])
+		} else {
+			data, rest = rest[1:], ""
+		}
+
+		value := strings.SplitN(data, ";", 2)[0]
+		if value == "U" {
+			continue
+		}
+		match := perfdataValue.FindStringSubmatch(value)
+		if match == nil {
+			errs = append(errs, fmt.Sprintf("perfdata: invalid value %q for label %q", value, label))
+			continue
+		}
+		unit, ok := perfdataUnits[match[2]]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("perfdata: unknown unit %q for label %q", match[2], label))
+			continue
+		}
+		v, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("perfdata: invalid value %q for label %q", value, label))
+			continue
+		}
+
+		name := metricName(label)
+		if name == "" {
+			errs = append(errs, "perfdata: empty label")
+			continue
+		}
+		valueType := prometheus.GaugeValue
+		if match[2] == "c" {
+			valueType = prometheus.CounterValue
+		}
+		samples = append(samples, scriptSample{
+			name:      name + unit.suffix,
+			valueType: valueType,
+			value:     v * unit.factor,
+		})
+	}
+
+	if len(errs) > 0 {
+		return samples, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return samples, nil
+}
+
+// parseMetricsText parses metrics in the prometheus text format. Only
+// counters, gauges and untyped metrics are supported.
+func parseMetricsText(text string) ([]scriptSample, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		return nil, fmt.Errorf("metrics: %v", err)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var samples []scriptSample
+	var errs []string
+	for _, name := range names {
+		family := families[name]
+		for _, metric := range family.GetMetric() {
+			sample := scriptSample{name: name, labels: make(map[string]string)}
+			for _, pair := range metric.GetLabel() {
+				sample.labels[pair.GetName()] = pair.GetValue()
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				sample.valueType = prometheus.CounterValue
+				sample.value = metric.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				sample.valueType = prometheus.GaugeValue
+				sample.value = metric.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				sample.valueType = prometheus.UntypedValue
+				sample.value = metric.GetUntyped().GetValue()
+			default:
+				errs = append(errs, fmt.Sprintf("metrics: %s: unsupported type %s", name, family.GetType()))
+				continue
+			}
+			samples = append(samples, sample)
+		}
+	}
+
+	if len(errs) > 0 {
+		return samples, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return samples, nil
+}
+
+// scriptMetricsCollector re-exports the latest metrics of every health
+// check script, with the check type as a label. Every check is limited to
+// maxSeries series; the others are dropped.
+type scriptMetricsCollector struct {
+	sync.Mutex
+	maxSeries   int
+	constLabels prometheus.Labels
+	samples     map[string][]scriptSample
+}
+
+var scriptMetrics = newScriptMetricsCollector(100)
+
+func newScriptMetricsCollector(maxSeries int) *scriptMetricsCollector {
+	return &scriptMetricsCollector{
+		maxSeries: maxSeries,
+		samples:   make(map[string][]scriptSample),
+	}
+}
+
+// set replaces the metrics of a health check with the ones of its last run.
+func (c *scriptMetricsCollector) set(checkType string, samples []scriptSample) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.maxSeries <= 0 {
+		return
+	}
+	if len(samples) > c.maxSeries {
+		log.Warning(fmt.Sprintf("Health check %s emitted %d metric series, only the first %d are exported.", checkType, len(samples), c.maxSeries))
+		scriptMetricsDroppedCounter.With(prometheus.Labels{"type": checkType}).Add(float64(len(samples) - c.maxSeries))
+		samples = samples[:c.maxSeries]
+	}
+	c.samples[checkType] = samples
+}
+
+// Describe sends no descriptor, the script metrics are not known in
+// advance. This makes the collector unchecked.
+func (c *scriptMetricsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends the script metrics. A metric name must have the same type
+// across checks; samples conflicting with the first type seen are skipped.
+func (c *scriptMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+
+	checkTypes := make([]string, 0, len(c.samples))
+	for checkType := range c.samples {
+		checkTypes = append(checkTypes, checkType)
+	}
+	sort.Strings(checkTypes)
+
+	valueTypes := make(map[string]prometheus.ValueType)
+	seen := make(map[string]bool)
+	for _, checkType := range checkTypes {
+		for _, sample := range c.samples[checkType] {
+			name := scriptMetricsPrefix + sample.name
+			if valueType, ok := valueTypes[name]; ok && valueType != sample.valueType {
+				continue
+			}
+			valueTypes[name] = sample.valueType
+
+			labelNames := make([]string, 0, len(sample.labels)+1)
+			for label := range sample.labels {
+				if label != "type" {
+					labelNames = append(labelNames, label)
+				}
+			}
+			sort.Strings(labelNames)
+
+			labelValues := make([]string, 0, len(labelNames)+1)
+			for _, label := range labelNames {
+				labelValues = append(labelValues, sample.labels[label])
+			}
+			// The type label of a script is kept as exported_type.
+			if scriptType, ok := sample.labels["type"]; ok {
+				labelNames = append(labelNames, "exported_type")
+				labelValues = append(labelValues, scriptType)
+			}
+			labelNames = append(labelNames, "type")
+			labelValues = append(labelValues, checkType)
+
+			// Duplicate series would fail the whole scrape.
+			key := name + "\xff" + strings.Join(labelNames, "\xff") + "\xff" + strings.Join(labelValues, "\xff")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			desc := prometheus.NewDesc(name, "Metric emitted by a health check script", labelNames, c.constLabels)
+			metric, err := prometheus.NewConstMetric(desc, sample.valueType, sample.value, labelValues...)
+			if err != nil {
+				log.Debug(fmt.Sprintf("Health check %s: invalid metric %s: %v", checkType, name, err))
+				continue
+			}
+			ch <- metric
+		}
+	}
+}
@@ -10,6 +10,7 @@ require (
 	github.com/docker/go-units v0.4.0
 	github.com/go-ole/go-ole v1.2.5 // indirect
 	github.com/gosuri/uiprogress v0.0.1
+	github.com/hashicorp/cronexpr v1.1.1
 	github.com/hashicorp/go-version v1.2.1 // indirect
 	github.com/hashicorp/memberlist v0.2.4 // indirect
 	github.com/hashicorp/nomad v1.1.14
@@ -17,14 +18,16 @@ require (
 	github.com/hashicorp/raft v1.3.1 // indirect
 	github.com/hashicorp/yamux v0.0.0-20200609203250-aecfd211c9ce // indirect
 	github.com/jhoonb/archivex v0.0.0-20201016144719-6a343cdae81d
-	github.com/mackerelio/go-osstat v0.1.0
 	github.com/miekg/dns v1.1.41 // indirect
 	github.com/otiai10/copy v1.6.0
 	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.10.0
 	github.com/shirou/gopsutil v3.21.2+incompatible
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
 	github.com/urfave/cli/v2 v2.3.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a // indirect
 	golang.org/x/net v0.0.0-20210410081132-afb366fc7cd1 // indirect
 )
@@ -59,6 +59,7 @@ func main() {
 		},
 		Commands: []*cli.Command{
 			aggregator.AggregatorCommand,
+			aggregator.ReportCommand,
 			detector.DetectorCommand,
 			config.ConfigCommand,
 		},
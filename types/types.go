@@ -24,6 +24,10 @@ type HealthCheck struct {
 	Result  string    `json:"result"`
 	Message string    `json:"message"`
 	LastRun time.Time `json:"last_run"`
+
+	// FailingSince is the time the detector first ran the health check in
+	// its current failure, zero when passing (or from older detectors).
+	FailingSince time.Time `json:"failing_since,omitempty"`
 }
 
 func (h *HealthCheck) Update(result, message string) {
@@ -36,3 +40,294 @@ type Config struct {
 	Type        string `json:"type"`
 	HealthCheck string `json:"health_check"`
 }
+
+// Failed returns true if the health check is reporting a problem.
+// Custom health checks report Healthy/Unhealthy, while the default CPU,
+// memory and disk checks report true/false.
+func (h *HealthCheck) Failed() bool {
+	return h.Result == "Unhealthy" || h.Result == "true"
+}
+
+// CheckStatus is the aggregator view of a single health check on a node.
+type CheckStatus struct {
+	HealthCheck
+	Enforced            bool      `json:"enforced"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	FailingSince        time.Time `json:"failing_since,omitempty"`
+}
+
+// NodePolicy is the effective aggregator policy for a single node, after
+// merging the aggregator flags with the npd.* node meta overrides.
+type NodePolicy struct {
+	Ignore    bool              `json:"ignore"`
+	Enforce   []string          `json:"enforce"`
+	Overrides map[string]string `json:"overrides,omitempty"`
+}
+
+// Enforces returns true if the health check is enforced by the policy.
+func (p *NodePolicy) Enforces(check string) bool {
+	for _, hc := range p.Enforce {
+		if hc == check {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeStatus is the aggregator view of a single node, as exposed on
+// the aggregator /v1/nodes HTTP endpoints.
+type NodeStatus struct {
+	ID             string         `json:"id"`
+	Address        string         `json:"address"`
+	Datacenter     string         `json:"datacenter"`
+	NodeClass      string         `json:"node_class"`
+	Eligibility    string         `json:"eligibility"`
+	Healthy        bool           `json:"healthy"`
+	Skipped        string         `json:"skipped,omitempty"`
+	Policy         NodePolicy     `json:"policy"`
+	Checks         []CheckStatus  `json:"checks"`
+	CordonOwner    string         `json:"cordon_owner,omitempty"`
+	LastAction     string         `json:"last_action,omitempty"`
+	LastActionTime time.Time      `json:"last_action_time,omitempty"`
+	Reason         string         `json:"reason,omitempty"`
+	LastSeen       time.Time      `json:"last_seen"`
+	Detector       DetectorStatus `json:"detector"`
+
+	// Transitions is the number of recent transitions between healthy and
+	// unhealthy. A flapping node is quarantined until QuarantinedUntil.
+	Transitions      int       `json:"transitions"`
+	QuarantinedUntil time.Time `json:"quarantined_until,omitempty"`
+}
+
+// DetectorUnreachable is the health check reported by the aggregator for
+// nodes whose detector has not been answering for several cycles.
+const DetectorUnreachable = "DetectorUnreachable"
+
+// DetectorStatus is the reachability of the detector running on a node.
+// LastContact is zero if the detector never answered.
+type DetectorStatus struct {
+	Reachable         bool      `json:"reachable"`
+	UnreachableCycles int       `json:"unreachable_cycles,omitempty"`
+	UnreachableSince  time.Time `json:"unreachable_since,omitempty"`
+	LastContact       time.Time `json:"last_contact,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// Coverage lists the eligible nodes without a detector answering, as
+// exposed on the aggregator /v1/coverage HTTP endpoint.
+type Coverage struct {
+	Nodes     int          `json:"nodes"`
+	Covered   int          `json:"covered"`
+	Uncovered []NodeStatus `json:"uncovered"`
+}
+
+// Transition is a change of the result of a health check on a node, as
+// recorded in the aggregator history. From is empty when the health check
+// was failing when first observed.
+type Transition struct {
+	Time        time.Time `json:"time"`
+	NodeID      string    `json:"node_id"`
+	NodeAddress string    `json:"node_address"`
+	Datacenter  string    `json:"datacenter"`
+	Check       string    `json:"check"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Failing     bool      `json:"failing"`
+	Message     string    `json:"message,omitempty"`
+}
+
+// CheckFlakiness is the number of transitions of a health check, across
+// all nodes, over a period of time.
+type CheckFlakiness struct {
+	Check       string `json:"check"`
+	Transitions int    `json:"transitions"`
+	Nodes       int    `json:"nodes"`
+}
+
+// CheckRecovery is the time nodes took to recover from a failing health
+// check, over a period of time.
+type CheckRecovery struct {
+	Check                    string  `json:"check"`
+	Recoveries               int     `json:"recoveries"`
+	MeanTimeToRecoverSeconds float64 `json:"mean_time_to_recover_seconds"`
+	MaxTimeToRecoverSeconds  float64 `json:"max_time_to_recover_seconds"`
+}
+
+// Incident is a health check failing on a node, from the first aggregation
+// cycle it is failing to the first one it is passing again, or it is no
+// longer reported by the detector.
+//
+// StartedAt is when the health check started failing on the detector
+// (its FailingSince, or its LastRun for older detectors), OpenedAt when
+// the aggregator detected it, and ClosedAt when it recovered.
+type Incident struct {
+	ID           string           `json:"id"`
+	NodeID       string           `json:"node_id"`
+	NodeAddress  string           `json:"node_address"`
+	Datacenter   string           `json:"datacenter"`
+	Check        string           `json:"check"`
+	Enforced     bool             `json:"enforced"`
+	Open         bool             `json:"open"`
+	StartedAt    time.Time        `json:"started_at"`
+	OpenedAt     time.Time        `json:"opened_at"`
+	LastSeen     time.Time        `json:"last_seen"`
+	ClosedAt     time.Time        `json:"closed_at,omitempty"`
+	FirstMessage string           `json:"first_message"`
+	LastMessage  string           `json:"last_message"`
+	CloseReason  string           `json:"close_reason,omitempty"`
+	Actions      []IncidentAction `json:"actions,omitempty"`
+
+	// DurationSeconds is the time from OpenedAt to ClosedAt, or to now
+	// for open incidents.
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// IncidentAction is an aggregator decision made during an incident.
+type IncidentAction struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Result string    `json:"result"`
+	Reason string    `json:"reason,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// IncidentSLO is the time to detect (StartedAt to OpenedAt) and the time
+// to recover (OpenedAt to ClosedAt) of the closed incidents of a health
+// check, over a period of time.
+type IncidentSLO struct {
+	Check                    string  `json:"check"`
+	Incidents                int     `json:"incidents"`
+	MeanTimeToDetectSeconds  float64 `json:"mean_time_to_detect_seconds"`
+	P95TimeToDetectSeconds   float64 `json:"p95_time_to_detect_seconds"`
+	MeanTimeToRecoverSeconds float64 `json:"mean_time_to_recover_seconds"`
+	P95TimeToRecoverSeconds  float64 `json:"p95_time_to_recover_seconds"`
+}
+
+// CheckSummary holds the number of nodes passing and failing a health check.
+type CheckSummary struct {
+	Healthy   int  `json:"healthy"`
+	Unhealthy int  `json:"unhealthy"`
+	Enforced  bool `json:"enforced"`
+}
+
+// DatacenterSummary holds node and health check counts for a datacenter.
+type DatacenterSummary struct {
+	Nodes     int                      `json:"nodes"`
+	Healthy   int                      `json:"healthy"`
+	Unhealthy int                      `json:"unhealthy"`
+	Skipped   int                      `json:"skipped"`
+	Cordoned  int                      `json:"cordoned"`
+	Checks    map[string]*CheckSummary `json:"checks"`
+}
+
+// Summary holds cluster wide counts, as exposed on the aggregator
+// /v1/summary HTTP endpoint.
+type Summary struct {
+	Nodes       int                           `json:"nodes"`
+	Healthy     int                           `json:"healthy"`
+	Unhealthy   int                           `json:"unhealthy"`
+	Skipped     int                           `json:"skipped"`
+	Cordoned    int                           `json:"cordoned"`
+	Checks      map[string]*CheckSummary      `json:"checks"`
+	Datacenters map[string]*DatacenterSummary `json:"datacenters"`
+}
+
+// Exclusion excludes a node, a health check, or a health check on a
+// single node from enforcement until ExpiresAt.
+// If only NodeID is set, the node is not reached out to at all.
+// If only Check is set, the health check is not enforced on any node.
+// If both are set, the health check is not enforced on that node.
+type Exclusion struct {
+	NodeID    string    `json:"node_id,omitempty"`
+	Check     string    `json:"check,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired returns true if the exclusion has an expiry time in the past.
+func (e *Exclusion) Expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// AdminState is the runtime state managed through the aggregator admin API.
+type AdminState struct {
+	Paused             bool                `json:"paused"`
+	PausedDatacenters  []string            `json:"paused_datacenters"`
+	Exclusions         []Exclusion         `json:"exclusions"`
+	MaintenanceWindows []MaintenanceWindow `json:"maintenance_windows,omitempty"`
+}
+
+// MaintenanceWindow is a period during which enforcement is alert-only:
+// the aggregator doesn't take nodes out of the scheduling pool, and leaves
+// the nodes it cordoned alone.
+//
+// A window is either recurring, starting on a cron Schedule (in Timezone,
+// UTC by default) for Duration (e.g. 2h), or an absolute Start to End range.
+// It applies to the nodes in Datacenters and NodeClasses, and to the Checks
+// health checks, or to all of them when empty.
+type MaintenanceWindow struct {
+	ID          string    `json:"id"`
+	Reason      string    `json:"reason,omitempty"`
+	Schedule    string    `json:"schedule,omitempty"`
+	Duration    string    `json:"duration,omitempty"`
+	Timezone    string    `json:"timezone,omitempty"`
+	Start       time.Time `json:"start,omitempty"`
+	End         time.Time `json:"end,omitempty"`
+	Datacenters []string  `json:"datacenters,omitempty"`
+	NodeClasses []string  `json:"node_classes,omitempty"`
+	Checks      []string  `json:"checks,omitempty"`
+}
+
+// ThresholdState is the --threshold-percentage accounting at the time
+// of an aggregator decision, in the --threshold-scope of the node. Scope
+// is empty for nodes out of scope. The CPU (MHz) and memory (MB) capacity
+// are only set in capacity threshold mode.
+type ThresholdState struct {
+	Mode             string `json:"mode,omitempty"`
+	Scope            string `json:"scope,omitempty"`
+	Percentage       int    `json:"percentage"`
+	EligibleNodes    int    `json:"eligible_nodes"`
+	TotalNodes       int    `json:"total_nodes"`
+	EligibleCPU      int64  `json:"eligible_cpu,omitempty"`
+	TotalCPU         int64  `json:"total_cpu,omitempty"`
+	EligibleMemoryMB int64  `json:"eligible_memory_mb,omitempty"`
+	TotalMemoryMB    int64  `json:"total_memory_mb,omitempty"`
+	Above            bool   `json:"above"`
+}
+
+// AuditEvent is a single eligibility decision made by the aggregator, as
+// written to the audit log and exposed on the aggregator /v1/audit endpoint.
+type AuditEvent struct {
+	Timestamp   time.Time      `json:"timestamp"`
+	Instance    string         `json:"instance"`
+	NodeID      string         `json:"node_id"`
+	NodeAddress string         `json:"node_address"`
+	Datacenter  string         `json:"datacenter"`
+	Action      string         `json:"action"`
+	Reason      string         `json:"reason"`
+	Checks      []HealthCheck  `json:"checks"`
+	Threshold   ThresholdState `json:"threshold"`
+	Severity    int            `json:"severity,omitempty"`
+	Rank        int            `json:"rank,omitempty"`
+
+	// Flapping is true if the node is quarantined for flapping between
+	// healthy and unhealthy, until QuarantinedUntil.
+	Flapping         bool      `json:"flapping,omitempty"`
+	QuarantinedUntil time.Time `json:"quarantined_until,omitempty"`
+	DryRun           bool      `json:"dry_run"`
+	Result           string    `json:"result"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// Audit event results.
+const (
+	AuditResultSuccess = "success"
+	AuditResultError   = "error"
+	AuditResultBlocked = "blocked"
+	AuditResultDryRun  = "dry_run"
+
+	// AuditResultPlanned is the result of a decision made by
+	// `npd aggregator plan`, which never changes node eligibility.
+	AuditResultPlanned = "planned"
+)